@@ -3,6 +3,7 @@ package _examples
 import (
 	"github.com/peakedshout/go-socks"
 	"net"
+	"net/http"
 )
 
 func clientCONNECT() {
@@ -55,3 +56,41 @@ func clientUDPASSOCIATE() {
 	c, _ := sd.ListenPacket("udp", ":8888")
 	defer c.Close()
 }
+
+func clientHTTPCONNECT() {
+	// if an http proxy is 127.0.0.1:3128
+
+	// HTTPCONNECT tunnels through an HTTP/1.1 proxy, auth and header may be nil
+	hd, _ := socks.HTTPCONNECT("tcp", "127.0.0.1:3128", &socks.S5AuthPassword{
+		User:     "user",
+		Password: "password",
+	}, http.Header{"User-Agent": {"go-socks"}}, nil)
+	c, _ := hd.Dial("tcp", "123.45.67.89.10111")
+	defer c.Close()
+
+	// It is a Dialer like the socks ones, so it can carry them to a socks server behind the proxy
+	sd, _ := socks.SOCKS5CONNECT("tcp", "127.0.0.1:17999", &socks.S5Auth{
+		Socks5AuthNOAUTH: socks.DefaultAuthConnCb,
+	}, hd)
+	c2, _ := sd.Dial("tcp", "123.45.67.89.10111")
+	defer c2.Close()
+}
+
+func clientOptimistic() {
+	// if a trusted socks server is 127.0.0.1:17999
+
+	// The greeting, auth and request go out together, the handshake takes 1 RTT instead of 3
+	sd, _ := socks.SOCKS5CONNECTP("tcp", "127.0.0.1:17999", &socks.S5AuthPassword{
+		User:     "user",
+		Password: "password",
+	}, nil, socks.WithOptimistic(false))
+	c, _ := sd.Dial("tcp", "123.45.67.89.10111")
+	defer c.Close()
+
+	// With the first payload, Dial returns at once, the handshake rides on the first Write
+	// and the first Read returns the error if the request was rejected
+	sd2, _ := socks.SOCKS5CONNECTP("tcp", "127.0.0.1:17999", nil, nil, socks.WithOptimistic(true))
+	c2, _ := sd2.Dial("tcp", "123.45.67.89.10111")
+	defer c2.Close()
+	_, _ = c2.Write([]byte("GET / HTTP/1.1\r\nHost: example\r\n\r\n"))
+}
@@ -46,4 +46,30 @@ func newRelay() {
 			Socks5AuthNOAUTH: socks.DefaultAuthConnCb,
 		},
 	})
+
+	// The other end is a relay server, it is managed like a socks server
+	rs, _ := socks.NewRelayServer(context.Background(), &socks.RelayConfig{})
+	defer rs.Shutdown(context.Background())
+	_ = rs.ListenAndServe("tcp", ":1011")
+
+	// Behind NAT, the relay dials out to a worker pool of the socks server instead
+	_ = rs.ServeReverse(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", "123.45.67.89:1012") // worker pool of the socks server
+	}, socks.WithRelayKey("worker1", []byte("key")), socks.WithRelayLabels("eu"))
+
+	// and the socks server hands the requests to the workers with a label
+	pool := socks.NewRelayWorkerPool(context.Background(), &socks.RelayWorkerPoolConfig{
+		AuthKey: func(id string) ([]byte, bool) { return []byte("key"), true },
+	})
+	go pool.ListenAndServe("tcp", ":1012")
+	_ = socks.ListenAndServe("tcp", ":12345", &socks.ServerConfig{
+		VersionSwitch: socks.VersionSwitch{SwitchSocksVersion5: true},
+		CMDConfig: socks.CMDConfig{
+			SwitchCMDCONNECT:  true,
+			CMDCONNECTHandler: socks.RelayCMDCONNECTHandler(pool.DialLabel("eu")),
+		},
+		Socks5AuthCb: socks.S5AuthCb{
+			Socks5AuthNOAUTH: socks.DefaultAuthConnCb,
+		},
+	})
 }
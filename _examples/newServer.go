@@ -1,8 +1,14 @@
 package _examples
 
 import (
+	"context"
 	"github.com/peakedshout/go-socks"
 	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func newServer() {
@@ -28,8 +34,10 @@ func newServer() {
 	// If you want more advanced customization, then you need to fill in the configuration yourself
 	cfg := &socks.ServerConfig{
 		VersionSwitch: socks.VersionSwitch{
-			SwitchSocksVersion4: true, // socks4/4a
-			SwitchSocksVersion5: true, // socks5
+			SwitchSocksVersion4: true,  // socks4/4a
+			SwitchSocksVersion5: true,  // socks5
+			SwitchHTTP:          false, // HTTP CONNECT and forward proxy on the same port
+			SwitchTransparent:   false, // server.ServeTransparent/ServeTransparentUDP for iptables REDIRECT/TPROXY
 		},
 		CMDConfig: socks.CMDConfig{
 			SwitchCMDCONNECT:          false, // socks4/4a/5 CMDCONNECT
@@ -38,7 +46,9 @@ func newServer() {
 			CMDBINDHandler:            nil,   // if nil, use default handler
 			SwitchCMDUDPASSOCIATE:     false, // socks5 UDPASSOCIATE
 			CMDCMDUDPASSOCIATEHandler: nil,   // if nil, use default handler
+			SwitchCMDUDPOVERTCP:       false, // private cmd, socks5 UDPASSOCIATE carried on the tcp connection
 			UDPDataHandler:            nil,   // if nil, use default handler
+			TCPDataHandler:            nil,   // if nil, CONNECT and BIND streams are not transformed
 		},
 		Socks5AuthCb: socks.S5AuthCb{
 			Socks5AuthNOAUTHPriority:   0,
@@ -55,14 +65,95 @@ func newServer() {
 		Socks4AuthCb: socks.S4AuthCb{
 			Socks4UserIdAuth: nil,
 		},
-		ConnTimeout: 0,
-		DialTimeout: 0,
-		BindTimeout: 0,
-		UdpTimeout:  0,
+		ConnTimeout:    0, // the handshake must finish within it
+		IdleTimeout:    0, // closes CONNECT/BIND relays without traffic
+		MaxLifetime:    0, // closes any session this long after accept
+		DialTimeout:    0,
+		BindTimeout:    0,
+		UdpTimeout:     0,
+		UDPFilter:      nil, // if nil, udp replies from any address are forwarded (full-cone)
+		Ruleset:        nil, // if nil, every authenticated request is allowed
+		SessionHook:    nil, // sees every session open, close or get rejected
+		TLSConfig:      nil, // if set, socks over TLS, clients use socks.WithTLS
+		TLSCertUser:    nil, // maps client certificates to users who then need no socks auth
+		TransparentDst: nil, // if nil, SO_ORIGINAL_DST on linux
+		// the outbound network, e.g. socks.SOCKS5CONNECT to egress through another socks server
+		Dialer:               nil,
+		ListenerConfig:       nil,
+		PacketListenerConfig: nil,
+		// per session options of the outbound sockets, e.g. a source address for a user
+		SocketControl: func(info socks.SessionInfo) *socks.SocketOptions {
+			if info.User == "office" {
+				return &socks.SocketOptions{LocalAddr: net.IPv4(192, 0, 2, 10), Mark: 0x10, DSCP: 46}
+			}
+			return nil
+		},
+		// the other sessions rotate over these source addresses, a user like "name-session-abc" keeps one for abc
+		EgressPool: socks.NewEgressPool(socks.EgressRoundRobin, net.IPv4(192, 0, 2, 11), net.IPv4(192, 0, 2, 12)),
+		// behind haproxy with send-proxy, its connections start with the PROXY header of the client
+		ProxyProtocolTrusted: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+		ProxyProtocolHeader:  0,     // 1 or 2 tells the CONNECT targets the client address too
+		HalfCloseHandshake:   false, // true for clients that half-close before the CONNECT reply
 	}
 	server, _ := socks.NewServer(cfg)
 	defer server.Close()
 	// Of course, the server itself can serve multiple addresses
 	go server.ListenAndServe("tcp", "0.0.0.0:12345")
-	_ = server.ListenAndServe("tcp", "0.0.0.0:12346")
+	go server.ListenAndServe("tcp", "0.0.0.0:12346")
+
+	// With SwitchTransparent, traffic redirected by iptables is relayed without socks, e.g.
+	// iptables -t nat -A OUTPUT -p tcp --dport 80 -j REDIRECT --to-ports 12347
+	ln, _ := net.Listen("tcp", "0.0.0.0:12347")
+	go server.ServeTransparent(ln)
+	// TPROXY needs the transparent listeners, udp replies need CAP_NET_ADMIN
+	uconn, _ := socks.ListenTransparentUDP(context.Background(), "udp", "0.0.0.0:12348")
+	_ = server.ServeTransparentUDP(uconn)
+}
+
+func serveStdio() {
+	// run as an ssh ProxyCommand or from inetd, the session is the stdin and stdout of the process
+	server, _ := socks.NewServer(&socks.ServerConfig{
+		VersionSwitch: socks.DefaultSocksVersionSwitch,
+		CMDConfig:     socks.DefaultSocksCMDConfig,
+		Socks5AuthCb: socks.S5AuthCb{
+			Socks5AuthNOAUTH: socks.DefaultAuthConnCb,
+		},
+	})
+	defer server.Close()
+	_ = server.ServeConn(context.Background(), socks.StdioConn())
+}
+
+func serveSystemd() {
+	server, _ := socks.NewServer(&socks.ServerConfig{
+		VersionSwitch: socks.DefaultSocksVersionSwitch,
+		CMDConfig:     socks.DefaultSocksCMDConfig,
+		Socks5AuthCb: socks.S5AuthCb{
+			Socks5AuthNOAUTH: socks.DefaultAuthConnCb,
+		},
+	})
+	defer server.Close()
+	const path = "/run/go-socks/handoff.sock"
+	// a restarted process takes the listeners of the old one, a first start gets those of the socket unit
+	var lns []net.Listener
+	if os.Getenv("GO_SOCKS_UPGRADE") != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		lns, _, _ = socks.TakeListeners(ctx, path)
+		cancel()
+	} else {
+		lns, _, _ = socks.ActivationListeners()
+	}
+	for _, ln := range lns {
+		go server.Serve(ln)
+	}
+	// on SIGHUP start the new binary, hand it the listeners and drain the sessions for up to a minute
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	<-hup
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), "GO_SOCKS_UPGRADE=1")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	_ = cmd.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_ = server.Handoff(ctx, path)
 }
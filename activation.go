@@ -0,0 +1,91 @@
+package socks
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// with systemd socket activation the listeners come from the service manager, a socket unit
+// passes them from fd 3 on with LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES
+
+const listenFdsStart = 3
+
+// ActivationFiles returns the sockets systemd passed to the process, named after the FileDescriptorName
+// of the socket unit, nil if there are none. the environment is cleared so children do not take them too
+func ActivationFiles() ([]*os.File, error) {
+	return activationFiles(listenFdsStart)
+}
+
+// ActivationListeners returns the listeners and packet conns systemd passed to the process,
+// serve them with Serve, ServeTransparent or ServeTransparentUDP
+func ActivationListeners() ([]net.Listener, []net.PacketConn, error) {
+	files, err := ActivationFiles()
+	if err != nil {
+		return nil, nil, err
+	}
+	return FileListeners(files)
+}
+
+// FileListeners turns the stream sockets of files into listeners and the datagram ones into packet conns,
+// files are closed
+func FileListeners(files []*os.File) ([]net.Listener, []net.PacketConn, error) {
+	var lns []net.Listener
+	var pcs []net.PacketConn
+	closeAll := func() {
+		for _, ln := range lns {
+			_ = ln.Close()
+		}
+		for _, pc := range pcs {
+			_ = pc.Close()
+		}
+	}
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, f := range files {
+		ln, err := net.FileListener(f)
+		if err == nil {
+			lns = append(lns, ln)
+			continue
+		}
+		pc, perr := net.FilePacketConn(f)
+		if perr != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		pcs = append(pcs, pc)
+	}
+	return lns, pcs, nil
+}
+
+func activationFiles(start int) ([]*os.File, error) {
+	defer func() {
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, ErrActivationInvalid
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := make([]*os.File, 0, n)
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(start+i)
+		if len(names) == n && names[i] != "" {
+			name = names[i]
+		}
+		// children must not inherit them
+		closeOnExec(start + i)
+		files = append(files, os.NewFile(uintptr(start+i), name))
+	}
+	return files, nil
+}
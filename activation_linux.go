@@ -0,0 +1,9 @@
+//go:build linux
+
+package socks
+
+import "syscall"
+
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
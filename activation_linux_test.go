@@ -0,0 +1,67 @@
+//go:build linux
+
+package socks
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestActivationListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	_ = ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fd the service manager would pass
+	fd, err := syscall.Dup(int(f.Fd()))
+	_ = f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	files, err := activationFiles(fd)
+	if err != nil || files != nil {
+		t.Fatalf("took the sockets of another process: %v %v", files, err)
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "socks")
+	files, err = activationFiles(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "socks" || os.Getenv("LISTEN_FDS") != "" {
+		t.Fatalf("unexpected files: %v", files)
+	}
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+	if errno != 0 || flags&syscall.FD_CLOEXEC == 0 {
+		t.Fatalf("fd inherited by children: %v", errno)
+	}
+	lns, pcs, err := FileListeners(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lns) != 1 || len(pcs) != 0 {
+		t.Fatalf("unexpected listeners: %v %v", lns, pcs)
+	}
+	defer lns[0].Close()
+	conn, err := net.Dial("tcp", lns[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	aconn, err := lns[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = aconn.Close()
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package socks
+
+// systemd passes sockets on linux only
+func closeOnExec(fd int) {}
@@ -1,43 +1,96 @@
 package socks
 
-func SOCKS4CONNECT(network string, address string, userid S4UserId, forward Dialer) (Dialer, error) {
-	return newSocks4Config(network, address, socks4CDCONNECT, userid, forward, nil)
+import "crypto/tls"
+
+type ClientOption func(opts *clientOptions)
+
+type clientOptions struct {
+	tcpCb      TCPDataHandler
+	udpOverTCP bool
+	tlsCfg     *tls.Config
+	tlsPins    [][]byte
+	optimistic bool
+	lazy       bool
+}
+
+func newClientOptions(opts []ClientOption) clientOptions {
+	var co clientOptions
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&co)
+		}
+	}
+	return co
+}
+
+// WithTCPDataHandler transforms the stream of CONNECT and BIND after the socks handshake,
+// the server needs the same handler in CMDConfig.TCPDataHandler
+func WithTCPDataHandler(h TCPDataHandler) ClientOption {
+	return func(opts *clientOptions) {
+		opts.tcpCb = h
+	}
+}
+
+// WithUDPOverTCP makes UDP ASSOCIATE carry the datagrams on the control connection instead of a udp socket,
+// for networks where udp to the proxy is blocked. the server needs CMDConfig.SwitchCMDUDPOVERTCP
+func WithUDPOverTCP() ClientOption {
+	return func(opts *clientOptions) {
+		opts.udpOverTCP = true
+	}
+}
+
+// WithOptimistic sends the socks5 greeting, auth and request in one flight and reads the replies after,
+// a handshake of 1 RTT instead of 3. the greeting offers a single method, PASSWORD if set, else NOAUTH,
+// and the method callbacks get the conn after the request, so they must not change the stream.
+// with firstPayload, CONNECT returns at once and the handshake goes out with the first Write,
+// its replies are read by the first Read, which returns the error of a rejected request.
+// a socks4 request is one flight already, firstPayload still applies to its CONNECT.
+// only for a trusted server, an unexpected reply is seen late
+func WithOptimistic(firstPayload bool) ClientOption {
+	return func(opts *clientOptions) {
+		opts.optimistic = true
+		opts.lazy = firstPayload
+	}
+}
+
+func SOCKS4CONNECT(network string, address string, userid S4UserId, forward Dialer, opts ...ClientOption) (Dialer, error) {
+	return newSocks4Config(network, address, socks4CDCONNECT, userid, forward, nil, opts...)
 }
 
-func SOCKS4BIND(network string, address string, userid S4UserId, forward Dialer, bindCb BINDAddrCb) (Dialer, error) {
-	return newSocks4Config(network, address, socks4CDBIND, userid, forward, bindCb)
+func SOCKS4BIND(network string, address string, userid S4UserId, forward Dialer, bindCb BINDAddrCb, opts ...ClientOption) (Dialer, error) {
+	return newSocks4Config(network, address, socks4CDBIND, userid, forward, bindCb, opts...)
 }
 
-func SOCKS5CONNECT(network string, address string, auth *S5Auth, forward Dialer) (Dialer, error) {
-	return newSocks5Config(network, address, socks5CMDCONNECT, auth, forward, nil, nil, nil)
+func SOCKS5CONNECT(network string, address string, auth *S5Auth, forward Dialer, opts ...ClientOption) (Dialer, error) {
+	return newSocks5Config(network, address, socks5CMDCONNECT, auth, forward, nil, nil, nil, opts...)
 }
-func SOCKS5BIND(network string, address string, auth *S5Auth, forward Dialer, bindCb BINDAddrCb) (Dialer, error) {
-	return newSocks5Config(network, address, socks5CMDBIND, auth, forward, nil, bindCb, nil)
+func SOCKS5BIND(network string, address string, auth *S5Auth, forward Dialer, bindCb BINDAddrCb, opts ...ClientOption) (Dialer, error) {
+	return newSocks5Config(network, address, socks5CMDBIND, auth, forward, nil, bindCb, nil, opts...)
 }
 
-func SOCKS5UDPASSOCIATE(network string, address string, auth *S5Auth, forward Dialer, uforward PacketListenerConfig, udpCb UDPDataHandler) (PacketListenerConfig, error) {
-	return newSocks5Config(network, address, socks5CMDUDPASSOCIATE, auth, forward, uforward, nil, udpCb)
+func SOCKS5UDPASSOCIATE(network string, address string, auth *S5Auth, forward Dialer, uforward PacketListenerConfig, udpCb UDPDataHandler, opts ...ClientOption) (PacketListenerConfig, error) {
+	return newSocks5Config(network, address, socks5CMDUDPASSOCIATE, auth, forward, uforward, nil, udpCb, opts...)
 }
 
-func SOCKS5CONNECTP(network string, address string, auth *S5AuthPassword, forward Dialer) (Dialer, error) {
+func SOCKS5CONNECTP(network string, address string, auth *S5AuthPassword, forward Dialer, opts ...ClientOption) (Dialer, error) {
 	a := &S5Auth{
 		Socks5AuthNOAUTH:   DefaultAuthConnCb,
 		Socks5AuthPASSWORD: auth,
 	}
-	return newSocks5Config(network, address, socks5CMDCONNECT, a, forward, nil, nil, nil)
+	return newSocks5Config(network, address, socks5CMDCONNECT, a, forward, nil, nil, nil, opts...)
 }
-func SOCKS5BINDP(network string, address string, auth *S5AuthPassword, forward Dialer, bindCb BINDAddrCb) (Dialer, error) {
+func SOCKS5BINDP(network string, address string, auth *S5AuthPassword, forward Dialer, bindCb BINDAddrCb, opts ...ClientOption) (Dialer, error) {
 	a := &S5Auth{
 		Socks5AuthNOAUTH:   DefaultAuthConnCb,
 		Socks5AuthPASSWORD: auth,
 	}
-	return newSocks5Config(network, address, socks5CMDBIND, a, forward, nil, bindCb, nil)
+	return newSocks5Config(network, address, socks5CMDBIND, a, forward, nil, bindCb, nil, opts...)
 }
 
-func SOCKS5UDPASSOCIATEP(network string, address string, auth *S5AuthPassword, forward Dialer, uforward PacketListenerConfig, udpCb UDPDataHandler) (PacketListenerConfig, error) {
+func SOCKS5UDPASSOCIATEP(network string, address string, auth *S5AuthPassword, forward Dialer, uforward PacketListenerConfig, udpCb UDPDataHandler, opts ...ClientOption) (PacketListenerConfig, error) {
 	a := &S5Auth{
 		Socks5AuthNOAUTH:   DefaultAuthConnCb,
 		Socks5AuthPASSWORD: auth,
 	}
-	return newSocks5Config(network, address, socks5CMDUDPASSOCIATE, a, forward, uforward, nil, udpCb)
+	return newSocks5Config(network, address, socks5CMDUDPASSOCIATE, a, forward, uforward, nil, udpCb, opts...)
 }
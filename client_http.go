@@ -0,0 +1,143 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+type httpConfig struct {
+	proxyNetwork string
+	proxyAddress string
+
+	forward Dialer
+	auth    *S5AuthPassword
+	header  http.Header
+
+	clientOptions
+}
+
+// HTTPCONNECT returns a Dialer that tunnels through the HTTP/1.1 proxy at address with CONNECT.
+// auth, if not nil, is sent as basic Proxy-Authorization and header is added to every request.
+// WithTLS speaks to the proxy over TLS, WithTCPDataHandler transforms the tunnel
+func HTTPCONNECT(network string, address string, auth *S5AuthPassword, header http.Header, forward Dialer, opts ...ClientOption) (Dialer, error) {
+	return &httpConfig{
+		proxyNetwork:  network,
+		proxyAddress:  address,
+		forward:       forward,
+		auth:          auth,
+		header:        header,
+		clientOptions: newClientOptions(opts),
+	}, nil
+}
+
+func (hd *httpConfig) Dial(network string, addr string) (net.Conn, error) {
+	return hd.DialContext(context.Background(), network, addr)
+}
+
+func (hd *httpConfig) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, ErrNetworkNotSupport
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var conn net.Conn
+	var err error
+	if hd.forward != nil {
+		conn, err = hd.forward.DialContext(ctx, hd.proxyNetwork, hd.proxyAddress)
+	} else {
+		dr := net.Dialer{}
+		conn, err = dr.DialContext(ctx, hd.proxyNetwork, hd.proxyAddress)
+	}
+	if err != nil {
+		return nil, err
+	}
+	xctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-xctx.Done():
+		}
+	}()
+	tconn, err := hd.clientTLS(ctx, conn, hd.proxyAddress)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	conn = tconn
+	conn, err = hd.connectHTTP(conn, addr)
+	if err != nil || ctx.Err() != nil {
+		_ = tconn.Close()
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+	if hd.tcpCb != nil {
+		conn = newTCPDataConn(conn, hd.tcpCb)
+	}
+	return conn, nil
+}
+
+func (hd *httpConfig) connectHTTP(conn net.Conn, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Opaque: addr},
+		Host:       addr,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	for k, v := range hd.header {
+		req.Header[k] = v
+	}
+	if hd.auth != nil {
+		cred := base64.StdEncoding.EncodeToString([]byte(hd.auth.User + ":" + hd.auth.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	err := req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		_ = resp.Body.Close()
+		return nil, getHTTPRespErr(resp)
+	}
+	if br.Buffered() != 0 {
+		return &bufConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// getHTTPRespErr turns a refused CONNECT into a *ReplyError, the socks server passes the code on
+func getHTTPRespErr(resp *http.Response) error {
+	var code byte
+	switch resp.StatusCode {
+	case http.StatusProxyAuthRequired:
+		return &ReplyError{Code: socks5CMDRespConnNotAllowed, Err: ErrHTTPAuthRejected}
+	case http.StatusForbidden:
+		code = socks5CMDRespConnNotAllowed
+	case http.StatusGatewayTimeout:
+		code = socks5CMDRespTTLExpired
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		code = socks5CMDRespCMDNotSupported
+	default:
+		code = socks5CMDRespHostUnreachable
+	}
+	return &ReplyError{Code: code, Err: fmt.Errorf("http proxy: %s", resp.Status)}
+}
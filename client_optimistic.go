@@ -0,0 +1,94 @@
+package socks
+
+import (
+	"net"
+	"sync"
+)
+
+// optimisticConn holds the handshake until the first Write sends it with the payload,
+// the first Read waits for the replies, see WithOptimistic
+type optimisticConn struct {
+	net.Conn
+	finish func(conn net.Conn) (net.Conn, error)
+
+	wmux sync.Mutex
+	req  []byte
+	rw   net.Conn
+
+	once sync.Once
+	err  error
+}
+
+func newOptimisticConn(conn net.Conn, req []byte, finish func(conn net.Conn) (net.Conn, error)) *optimisticConn {
+	return &optimisticConn{
+		Conn:   conn,
+		finish: finish,
+		req:    req,
+	}
+}
+
+func (c *optimisticConn) Read(b []byte) (int, error) {
+	err := c.handshake()
+	if err != nil {
+		return 0, err
+	}
+	return c.rw.Read(b)
+}
+
+func (c *optimisticConn) Write(b []byte) (int, error) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	if c.req == nil {
+		if c.rw != nil {
+			return c.rw.Write(b)
+		}
+		return c.Conn.Write(b)
+	}
+	req := c.req
+	c.req = nil
+	n, err := c.Conn.Write(append(req, b...))
+	n -= len(req)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (c *optimisticConn) CloseWrite() error {
+	err := c.flush()
+	if err != nil {
+		return err
+	}
+	return closeWriteOf(c.Conn)
+}
+
+// flush sends the handshake if no Write took it yet
+func (c *optimisticConn) flush() error {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	if c.req == nil {
+		return nil
+	}
+	req := c.req
+	c.req = nil
+	_, err := c.Conn.Write(req)
+	return err
+}
+
+// handshake reads the replies once, a rejected request closes the conn
+func (c *optimisticConn) handshake() error {
+	c.once.Do(func() {
+		c.err = c.flush()
+		if c.err == nil {
+			var rw net.Conn
+			rw, c.err = c.finish(c.Conn)
+			c.wmux.Lock()
+			c.rw = rw
+			c.wmux.Unlock()
+		}
+		if c.err != nil {
+			_ = c.Conn.Close()
+		}
+	})
+	return c.err
+}
@@ -0,0 +1,76 @@
+package socks
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestOptimistic(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+			Socks5AuthPASSWORD: func(conn net.Conn, auth S5AuthPassword) net.Conn {
+				return auth.IsEqual2(conn, "test", "test123")
+			},
+		},
+		Socks4AuthCb: S4AuthCb{Socks4UserIdAuth: func(conn net.Conn, id S4UserId) (net.Conn, S4IdAuthCode) {
+			return id.IsEqual3(conn, S4UserId{1, 2, 3, 4, 5, 6})
+		}},
+	})
+	network, address := listen.Addr().Network(), listen.Addr().String()
+	for _, lazy := range []bool{false, true} {
+		drs := []Dialer{}
+		dr, err := SOCKS5CONNECTP(network, address, &S5AuthPassword{User: "test", Password: "test123"}, nil, WithOptimistic(lazy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		drs = append(drs, dr)
+		dr, err = SOCKS5CONNECT(network, address, &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}, nil, WithOptimistic(lazy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		drs = append(drs, dr)
+		// the first payload is pipelined after the socks4 request
+		dr, err = SOCKS4CONNECT(network, address, S4UserId{1, 2, 3, 4, 5, 6}, nil, WithOptimistic(lazy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		drs = append(drs, dr)
+		for _, dr := range drs {
+			conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				testConn(t, conn, newData(4096))
+			}
+			_ = conn.Close()
+		}
+
+		dr, err = SOCKS5CONNECTP(network, address, &S5AuthPassword{User: "test", Password: "wrong"}, nil, WithOptimistic(lazy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+		if !lazy {
+			if !errors.Is(err, ErrSocks5AuthRejected) {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = conn.Write([]byte("hello"))
+		_, err = conn.Read(make([]byte, 1))
+		if !errors.Is(err, ErrSocks5AuthRejected) {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+}
@@ -18,16 +18,19 @@ type socks4Config struct {
 	cd      byte
 
 	bindCb BINDAddrCb
+
+	clientOptions
 }
 
-func newSocks4Config(network string, address string, cd byte, userId S4UserId, forward Dialer, bindCb BINDAddrCb) (*socks4Config, error) {
+func newSocks4Config(network string, address string, cd byte, userId S4UserId, forward Dialer, bindCb BINDAddrCb, opts ...ClientOption) (*socks4Config, error) {
 	return &socks4Config{
-		proxyNetwork: network,
-		proxyAddress: address,
-		forward:      forward,
-		userId:       userId,
-		cd:           cd,
-		bindCb:       bindCb,
+		proxyNetwork:  network,
+		proxyAddress:  address,
+		forward:       forward,
+		userId:        userId,
+		cd:            cd,
+		bindCb:        bindCb,
+		clientOptions: newClientOptions(opts),
 	}, nil
 }
 
@@ -56,11 +59,31 @@ func (s4d *socks4Config) DialContext(ctx context.Context, network string, addr s
 			return nil, err
 		}
 	}
+	tconn, err := s4d.clientTLS(ctx, conn, s4d.proxyAddress)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	conn = tconn
+	if s4d.lazy && s4d.cd == socks4CDCONNECT {
+		// the request is one flight already, only the first payload can join it
+		conn, err = s4d.optimisticSocks4(conn, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if s4d.tcpCb != nil {
+			conn = newTCPDataConn(conn, s4d.tcpCb)
+		}
+		return conn, nil
+	}
 	err = s4d.dialSocks4(ctx, conn, network, addr)
 	if err != nil || ctx.Err() != nil {
 		_ = conn.Close()
 		return nil, err
 	}
+	if s4d.tcpCb != nil {
+		conn = newTCPDataConn(conn, s4d.tcpCb)
+	}
 	return conn, nil
 }
 
@@ -86,23 +109,16 @@ func (s4d *socks4Config) dialSocks4(ctx context.Context, conn net.Conn, network
 	if err != nil {
 		return err
 	}
-	buf := make([]byte, 8)
-	_, err = io.ReadFull(conn, buf)
-	if err != nil {
-		return err
-	}
-	cd, raddr, err := s4d.readSocks4Resp(buf)
-	if err != nil {
-		return err
-	}
-	err = getSocks4RespErr(cd)
+	raddr, err := s4d.readSocks4Reply(conn)
 	if err != nil {
 		return err
 	}
 	if s4d.cd == socks4CDBIND {
 		xaddr := raddr.(*net.TCPAddr)
 		if xaddr.IP.IsUnspecified() {
-			xaddr.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+			if ip := getAddrIP(conn.RemoteAddr()); ip != nil {
+				xaddr.IP = ip
+			}
 		}
 		if s4d.bindCb != nil {
 			err = s4d.bindCb(xaddr)
@@ -110,16 +126,7 @@ func (s4d *socks4Config) dialSocks4(ctx context.Context, conn net.Conn, network
 				return err
 			}
 		}
-		buf = make([]byte, 8)
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			return err
-		}
-		cd, _, err = s4d.readSocks4Resp(buf)
-		if err != nil {
-			return err
-		}
-		err = getSocks4RespErr(cd)
+		_, err = s4d.readSocks4Reply(conn)
 		if err != nil {
 			return err
 		}
@@ -127,6 +134,44 @@ func (s4d *socks4Config) dialSocks4(ctx context.Context, conn net.Conn, network
 	return nil
 }
 
+func (s4d *socks4Config) readSocks4Reply(conn net.Conn) (net.Addr, error) {
+	buf := make([]byte, 8)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	cd, raddr, err := s4d.readSocks4Resp(buf)
+	if err != nil {
+		return nil, err
+	}
+	err = getSocks4RespErr(cd)
+	if err != nil {
+		return nil, err
+	}
+	return raddr, nil
+}
+
+// optimisticSocks4 holds the request for the first Write, see WithOptimistic
+func (s4d *socks4Config) optimisticSocks4(conn net.Conn, network string, addr string) (net.Conn, error) {
+	err := s4d.networkCheck(network)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	b, err := s4d.getSocks4Bytes(s4d.cd, s4d.userId, addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return newOptimisticConn(conn, b, func(conn net.Conn) (net.Conn, error) {
+		_, err := s4d.readSocks4Reply(conn)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}), nil
+}
+
 func (s4d *socks4Config) networkCheck(network string) error {
 	switch network {
 	case "tcp", "tcp4", "tcp6":
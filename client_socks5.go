@@ -31,18 +31,21 @@ type socks5Config struct {
 
 	bindCb BINDAddrCb
 	udpCb  UDPDataHandler
+
+	clientOptions
 }
 
-func newSocks5Config(network string, address string, cmd byte, auth *S5Auth, forward Dialer, uforward PacketListenerConfig, bindCb BINDAddrCb, udpCb UDPDataHandler) (*socks5Config, error) {
+func newSocks5Config(network string, address string, cmd byte, auth *S5Auth, forward Dialer, uforward PacketListenerConfig, bindCb BINDAddrCb, udpCb UDPDataHandler, opts ...ClientOption) (*socks5Config, error) {
 	return &socks5Config{
-		proxyNetwork: network,
-		proxyAddress: address,
-		forward:      forward,
-		uforward:     uforward,
-		auth:         auth,
-		cmd:          cmd,
-		bindCb:       bindCb,
-		udpCb:        udpCb,
+		proxyNetwork:  network,
+		proxyAddress:  address,
+		forward:       forward,
+		uforward:      uforward,
+		auth:          auth,
+		cmd:           cmd,
+		bindCb:        bindCb,
+		udpCb:         udpCb,
+		clientOptions: newClientOptions(opts),
 	}, nil
 }
 
@@ -95,6 +98,16 @@ func (s5d *socks5Config) DialContext(ctx context.Context, network string, addr s
 	if err != nil {
 		return nil, err
 	}
+	if s5d.optimistic {
+		conn, err = s5d.optimisticSocks5(conn, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if s5d.tcpCb != nil {
+			conn = newTCPDataConn(conn, s5d.tcpCb)
+		}
+		return conn, nil
+	}
 	aconn, err := s5d.authSocks5(conn)
 	if err != nil {
 		_ = conn.Close()
@@ -105,6 +118,9 @@ func (s5d *socks5Config) DialContext(ctx context.Context, network string, addr s
 		_ = aconn.Close()
 		return nil, err
 	}
+	if s5d.tcpCb != nil {
+		aconn = newTCPDataConn(aconn, s5d.tcpCb)
+	}
 	return aconn, nil
 }
 
@@ -128,7 +144,12 @@ func (s5d *socks5Config) dialSocks5(ctx, xctx context.Context) (conn net.Conn, e
 		case <-xctx.Done():
 		}
 	}()
-	return conn, nil
+	tconn, err := s5d.clientTLS(ctx, conn, s5d.proxyAddress)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tconn, nil
 }
 
 func (s5d *socks5Config) cmdSocks5(conn net.Conn, network string, addr string) error {
@@ -144,18 +165,28 @@ func (s5d *socks5Config) cmdSocks5(conn net.Conn, network string, addr string) e
 	if err != nil {
 		return err
 	}
+	return s5d.readSocks5CMD(conn)
+}
+
+// readSocks5CMD reads the replies to a CONNECT or BIND request
+func (s5d *socks5Config) readSocks5CMD(conn net.Conn) error {
 	rep, raddr, err := s5d.readSocks5CMDResp(conn)
 	if err != nil {
 		return err
 	}
 	err = getSocks5RespErr(rep)
 	if err != nil {
-		return err
+		return &ReplyError{Code: rep, Err: err}
 	}
 	if s5d.cmd == socks5CMDBIND {
 		xaddr, err := net.ResolveTCPAddr("", raddr)
+		if err != nil {
+			return err
+		}
 		if xaddr.IP.IsUnspecified() {
-			xaddr.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+			if ip := getAddrIP(conn.RemoteAddr()); ip != nil {
+				xaddr.IP = ip
+			}
 		}
 		if s5d.bindCb != nil {
 			err = s5d.bindCb(xaddr)
@@ -169,13 +200,16 @@ func (s5d *socks5Config) cmdSocks5(conn net.Conn, network string, addr string) e
 		}
 		err = getSocks5RespErr(rep)
 		if err != nil {
-			return err
+			return &ReplyError{Code: rep, Err: err}
 		}
 	}
 	return nil
 }
 
 func (s5d *socks5Config) udpSocks5(ctx context.Context, conn net.Conn, network string, addr string) (net.PacketConn, error) {
+	if s5d.udpOverTCP {
+		return s5d.udpOverTCPSocks5(conn)
+	}
 	laddr, err := net.ResolveUDPAddr(network, addr)
 	if err != nil {
 		return nil, err
@@ -206,12 +240,17 @@ func (s5d *socks5Config) udpSocks5(ctx context.Context, conn net.Conn, network s
 		return nil, err
 	}
 	err = getSocks5RespErr(rep)
+	if err != nil {
+		return nil, &ReplyError{Code: rep, Err: err}
+	}
+	xaddr, err := net.ResolveUDPAddr("", raddr)
 	if err != nil {
 		return nil, err
 	}
-	xaddr, _ := net.ResolveUDPAddr("", raddr)
 	if xaddr.IP.IsUnspecified() {
-		xaddr.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+		if ip := getAddrIP(conn.RemoteAddr()); ip != nil {
+			xaddr.IP = ip
+		}
 	}
 	pc := &socks5PacketConn{
 		PacketConn: uconn,
@@ -223,6 +262,32 @@ func (s5d *socks5Config) udpSocks5(ctx context.Context, conn net.Conn, network s
 	return pc, nil
 }
 
+// udpOverTCPSocks5 needs no local socket, the datagrams go through conn
+func (s5d *socks5Config) udpOverTCPSocks5(conn net.Conn) (net.PacketConn, error) {
+	b, err := s5d.getSocks5CMDBytes(socks5CMDUDPOVERTCP, net.JoinHostPort(net.IPv4zero.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	rep, _, err := s5d.readSocks5CMDResp(conn)
+	if err != nil {
+		return nil, err
+	}
+	err = getSocks5RespErr(rep)
+	if err != nil {
+		return nil, &ReplyError{Code: rep, Err: err}
+	}
+	return &socks5PacketConn{
+		PacketConn: newTCPPacketConn(conn),
+		lifeConn:   conn,
+		socksAddr:  conn.RemoteAddr(),
+		cb:         s5d.udpCb,
+	}, nil
+}
+
 func (s5d *socks5Config) authSocks5(conn net.Conn) (net.Conn, error) {
 	b, err := s5d.getSocks5AuthBytes()
 	if err != nil {
@@ -289,18 +354,26 @@ func (s5d *socks5Config) authSocks5Password(conn net.Conn) (net.Conn, error) {
 	if s5d.auth.Socks5AuthPASSWORD == nil {
 		return nil, ErrSocks5AuthRejected
 	}
+	_, err := conn.Write(s5d.getSocks5AuthPasswordBytes())
+	if err != nil {
+		return nil, err
+	}
+	return s5d.readSocks5AuthPassword(conn)
+}
+
+func (s5d *socks5Config) getSocks5AuthPasswordBytes() []byte {
 	bs := new(bytes.Buffer)
 	bs.Write([]byte{socks5AuthPasswordVER})
 	bs.Write([]byte{byte(len(s5d.auth.Socks5AuthPASSWORD.User))})
 	bs.Write([]byte(s5d.auth.Socks5AuthPASSWORD.User))
 	bs.Write([]byte{byte(len(s5d.auth.Socks5AuthPASSWORD.Password))})
 	bs.Write([]byte(s5d.auth.Socks5AuthPASSWORD.Password))
-	_, err := conn.Write(bs.Bytes())
-	if err != nil {
-		return nil, err
-	}
+	return bs.Bytes()
+}
+
+func (s5d *socks5Config) readSocks5AuthPassword(conn net.Conn) (net.Conn, error) {
 	buf := make([]byte, 2)
-	_, err = io.ReadFull(conn, buf)
+	_, err := io.ReadFull(conn, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -320,6 +393,90 @@ func (s5d *socks5Config) authSocks5Password(conn net.Conn) (net.Conn, error) {
 	}
 }
 
+// optimisticSocks5 writes the greeting, auth and request together, see WithOptimistic
+func (s5d *socks5Config) optimisticSocks5(conn net.Conn, network string, addr string) (net.Conn, error) {
+	err := s5d.networkCheck(network)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	method, b, err := s5d.getSocks5OptimisticBytes()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	cb, err := s5d.getSocks5CMDBytes(s5d.cmd, addr)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	b = append(b, cb...)
+	finish := func(conn net.Conn) (net.Conn, error) {
+		aconn, err := s5d.readSocks5Optimistic(conn, method)
+		if err != nil {
+			return nil, err
+		}
+		err = s5d.readSocks5CMD(aconn)
+		if err != nil {
+			return nil, err
+		}
+		return aconn, nil
+	}
+	if s5d.lazy && s5d.cmd == socks5CMDCONNECT {
+		return newOptimisticConn(conn, b, finish), nil
+	}
+	_, err = conn.Write(b)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	aconn, err := finish(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return aconn, nil
+}
+
+// getSocks5OptimisticBytes is a greeting of the one method the server is expected to take, and its auth
+func (s5d *socks5Config) getSocks5OptimisticBytes() (byte, []byte, error) {
+	switch {
+	case s5d.auth == nil:
+		return 0, nil, ErrSocks5NeedMETHODSAuth
+	case s5d.auth.Socks5AuthPASSWORD != nil:
+		b := []byte{socksVersion5, 1, socks5METHODCodePASSWORD}
+		return socks5METHODCodePASSWORD, append(b, s5d.getSocks5AuthPasswordBytes()...), nil
+	case s5d.auth.Socks5AuthNOAUTH != nil:
+		return socks5METHODCodeNOAUTH, []byte{socksVersion5, 1, socks5METHODCodeNOAUTH}, nil
+	default:
+		return 0, nil, ErrSocks5NeedMETHODSAuth
+	}
+}
+
+func (s5d *socks5Config) readSocks5Optimistic(conn net.Conn, method byte) (net.Conn, error) {
+	buf := make([]byte, 2)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion5 {
+		return nil, ErrSocksMessageParsingFailure
+	}
+	if buf[1] != method {
+		if buf[1] == socks5RETHODCodeRejected {
+			return nil, ErrSocks5NOACCEPTABLEMETHODS
+		}
+		return nil, ErrSocksMessageParsingFailure
+	}
+	if method == socks5METHODCodePASSWORD {
+		return s5d.readSocks5AuthPassword(conn)
+	}
+	if nconn := s5d.auth.Socks5AuthNOAUTH(conn); nconn != nil {
+		return nconn, nil
+	}
+	return nil, ErrSocks5AuthRejected
+}
+
 func (s5d *socks5Config) getSocks5AuthBytes() ([]byte, error) {
 	if s5d.auth == nil {
 		return nil, ErrSocks5NeedMETHODSAuth
@@ -378,6 +535,19 @@ func (s5d *socks5Config) readSocks5CMDResp(conn net.Conn) (rep byte, addr string
 		}
 		addr = fmt.Sprintf("%s:%d", net.IP(buf[:4]).String(), binary.BigEndian.Uint16(buf[4:4+2]))
 		return rep, addr, nil
+	case socks5AddrTypeDomain:
+		buf = make([]byte, 256+2)
+		_, err = io.ReadFull(conn, buf[:1])
+		if err != nil {
+			return 0, "", err
+		}
+		addrL := int(buf[0])
+		_, err = io.ReadFull(conn, buf[:addrL+2])
+		if err != nil {
+			return 0, "", err
+		}
+		addr = net.JoinHostPort(string(buf[:addrL]), strconv.Itoa(int(binary.BigEndian.Uint16(buf[addrL:addrL+2]))))
+		return rep, addr, nil
 	case socks5AddrTypeIPv6:
 		buf = make([]byte, 256)
 		_, err = io.ReadFull(conn, buf[:16+2])
@@ -482,19 +652,20 @@ func (s5pc *socks5PacketConn) Close() error {
 }
 
 func (s5pc *socks5PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	data := p
 	if s5pc.cb != nil {
-		p, err = s5pc.cb.Encode(p)
+		data, err = s5pc.cb.Encode(p)
 		if err != nil {
 			return 0, err
 		}
 	}
-	b := marshalSocks5UDPASSOCIATEData(p, addr)
-	n, err = s5pc.PacketConn.WriteTo(b, s5pc.socksAddr)
+	b := marshalSocks5UDPASSOCIATEData(data, addr)
+	_, err = s5pc.PacketConn.WriteTo(b, s5pc.socksAddr)
 	if err != nil {
 		s5pc.errClosed(err)
 		return 0, err
 	}
-	return n, nil
+	return len(p), nil
 }
 
 func (s5pc *socks5PacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
@@ -508,7 +679,7 @@ func (s5pc *socks5PacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err erro
 		if raddr.String() != s5pc.socksAddr.String() {
 			continue
 		} else {
-			data, xaddr, err := unmarshalSocks5UDPASSOCIATEData2(p[:n1])
+			data, xaddr, err := unmarshalSocks5UDPASSOCIATEData3(p[:n1])
 			if err != nil {
 				continue
 			}
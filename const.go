@@ -50,6 +50,8 @@ const (
 	socks5CMDCONNECT      = 0x01
 	socks5CMDBIND         = 0x02
 	socks5CMDUDPASSOCIATE = 0x03
+
+	socks5CMDUDPOVERTCP = 0x83 //private, UDP ASSOCIATE with the datagrams framed on the control connection
 )
 
 const (
@@ -87,3 +89,9 @@ const (
 
 const udpTimeoutKey = "timeout"
 const udpHandlerKey = "handler"
+const udpFilterKey = "filter"
+const udpPacketConnKey = "pconn"
+const dialerKey = "dialer"
+const listenerKey = "listener"
+const packetListenerKey = "packetListener"
+const socketOptionsKey = "socketOptions"
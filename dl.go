@@ -19,3 +19,81 @@ type PacketListenerConfig interface {
 	ListenPacket(network string, address string) (net.PacketConn, error)
 	ListenPacketContext(ctx context.Context, network string, address string) (net.PacketConn, error)
 }
+
+// netListenConfig is the host network as ListenerConfig and PacketListenerConfig,
+// ip is the address of a listen without a host
+type netListenConfig struct {
+	net.ListenConfig
+	ip     net.IP
+	egress *EgressPool //ip came from it
+}
+
+func (lc *netListenConfig) Listen(network string, address string) (net.Listener, error) {
+	return lc.ListenContext(context.Background(), network, address)
+}
+
+func (lc *netListenConfig) ListenContext(ctx context.Context, network string, address string) (net.Listener, error) {
+	ln, err := lc.ListenConfig.Listen(ctx, network, lc.address(address))
+	if err != nil && lc.egress != nil {
+		lc.egress.failed(lc.ip, err)
+	}
+	return ln, err
+}
+
+func (lc *netListenConfig) ListenPacket(network string, address string) (net.PacketConn, error) {
+	return lc.ListenPacketContext(context.Background(), network, address)
+}
+
+func (lc *netListenConfig) ListenPacketContext(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	pconn, err := lc.ListenConfig.ListenPacket(ctx, network, lc.address(address))
+	if err != nil && lc.egress != nil {
+		lc.egress.failed(lc.ip, err)
+	}
+	return pconn, err
+}
+
+func (lc *netListenConfig) address(address string) string {
+	if lc.ip == nil {
+		return address
+	}
+	host, port, err := net.SplitHostPort(address)
+	if address == "" {
+		host, port, err = "", "0", nil
+	}
+	if err != nil || host != "" {
+		return address
+	}
+	return net.JoinHostPort(lc.ip.String(), port)
+}
+
+// the default handlers take the outbound network of ServerConfig from their ctx, the host network if unset
+
+func getDialer(ctx context.Context) Dialer {
+	if dr, ok := ctx.Value(dialerKey).(Dialer); ok {
+		return dr
+	}
+	if o, ok := ctx.Value(socketOptionsKey).(*SocketOptions); ok {
+		return o.dialer()
+	}
+	return &net.Dialer{}
+}
+
+func getListenerConfig(ctx context.Context) ListenerConfig {
+	if lc, ok := ctx.Value(listenerKey).(ListenerConfig); ok {
+		return lc
+	}
+	if o, ok := ctx.Value(socketOptionsKey).(*SocketOptions); ok {
+		return o.listenConfig()
+	}
+	return &netListenConfig{}
+}
+
+func getPacketListenerConfig(ctx context.Context) PacketListenerConfig {
+	if lc, ok := ctx.Value(packetListenerKey).(PacketListenerConfig); ok {
+		return lc
+	}
+	if o, ok := ctx.Value(socketOptionsKey).(*SocketOptions); ok {
+		return o.listenConfig()
+	}
+	return &netListenConfig{}
+}
@@ -0,0 +1,98 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+type testCountListenConfig struct {
+	netListenConfig
+	n atomic.Int32
+}
+
+func (lc *testCountListenConfig) ListenContext(ctx context.Context, network string, address string) (net.Listener, error) {
+	lc.n.Add(1)
+	return lc.netListenConfig.ListenContext(ctx, network, address)
+}
+
+func (lc *testCountListenConfig) ListenPacketContext(ctx context.Context, network string, address string) (net.PacketConn, error) {
+	lc.n.Add(1)
+	return lc.netListenConfig.ListenPacketContext(ctx, network, address)
+}
+
+func TestServerOutboundNetwork(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	pConn := testLPConn(t)
+	defer pConn.Close()
+	auth := &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}
+
+	// the server egresses through another one
+	targets := make(chan string, 8)
+	upstream := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb:  S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+		SessionHook: func(event SessionEvent) {
+			if event.Type == SessionOpen {
+				targets <- event.Info.Target
+			}
+		},
+	})
+	dr, err := SOCKS5CONNECT(upstream.Addr().Network(), upstream.Addr().String(), auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plc := &testCountListenConfig{}
+	cmdCfg := DefaultSocksCMDConfig
+	cmdCfg.SwitchCMDUDPOVERTCP = true
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch:        DefaultSocksVersionSwitch,
+		CMDConfig:            cmdCfg,
+		Socks5AuthCb:         S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+		Dialer:               dr,
+		PacketListenerConfig: plc,
+	})
+
+	dr2, err := SOCKS5CONNECT(listen.Addr().Network(), listen.Addr().String(), auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr2.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testConn(t, conn, newData(4096))
+	if target := <-targets; target != ln.Addr().String() {
+		t.Fatalf("unexpected target: %s", target)
+	}
+
+	ucfg, err := SOCKS5UDPASSOCIATE(listen.Addr().Network(), listen.Addr().String(), auth, nil, nil, nil, WithUDPOverTCP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pConn2, err := ucfg.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pConn2.Close()
+	testPConn(t, pConn2, pConn.LocalAddr(), newData(1024))
+	if plc.n.Load() != 1 {
+		t.Fatal("outbound udp not listened by PacketListenerConfig")
+	}
+
+	// BIND listens with the ListenerConfig
+	lc := &testCountListenConfig{}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), listenerKey, ListenerConfig(lc)))
+	defer cancel()
+	_, err = DefaultCMDBINDHandler(ctx, make(chan net.Conn), "127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lc.n.Load() != 1 {
+		t.Fatal("BIND not listened by ListenerConfig")
+	}
+}
@@ -0,0 +1,135 @@
+package socks
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EgressStrategy int
+
+const (
+	EgressRoundRobin        EgressStrategy = iota //each session takes the next address
+	EgressRandom                                  //each session takes any address
+	EgressStickyUser                              //a user keeps the same address
+	EgressStickyDestination                       //a destination host keeps the same address
+)
+
+// egressSessionSep in a socks5 or http user like "user-session-abc" asks for an address of its own for
+// the session id abc, whatever the strategy. the auth callbacks and SessionInfo.User see "user"
+const egressSessionSep = "-session-"
+
+// EgressPool is a set of local addresses the outbound sockets of the sessions egress from,
+// see ServerConfig.EgressPool. an address that fails to bind is removed
+type EgressPool struct {
+	strategy EgressStrategy
+	mux      sync.Mutex
+	addrs    []net.IP
+	next     int
+	rand     *rand.Rand
+}
+
+func NewEgressPool(strategy EgressStrategy, addrs ...net.IP) *EgressPool {
+	p := &EgressPool{
+		strategy: strategy,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, ip := range addrs {
+		p.Add(ip)
+	}
+	return p
+}
+
+// Add puts ip back in the pool, if it is not in yet
+func (p *EgressPool) Add(ip net.IP) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for _, one := range p.addrs {
+		if one.Equal(ip) {
+			return
+		}
+	}
+	p.addrs = append(p.addrs, ip)
+}
+
+func (p *EgressPool) Remove(ip net.IP) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	for i, one := range p.addrs {
+		if one.Equal(ip) {
+			p.addrs = append(p.addrs[:i:i], p.addrs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *EgressPool) Addrs() []net.IP {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return append([]net.IP{}, p.addrs...)
+}
+
+// pick chooses the address of a session, nil if the pool is empty
+func (p *EgressPool) pick(info SessionInfo, session string) net.IP {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if len(p.addrs) == 0 {
+		return nil
+	}
+	if session != "" {
+		return p.sticky(info.User + egressSessionSep + session)
+	}
+	switch p.strategy {
+	case EgressRandom:
+		return p.addrs[p.rand.Intn(len(p.addrs))]
+	case EgressStickyUser:
+		return p.sticky(info.User)
+	case EgressStickyDestination:
+		host, _, err := net.SplitHostPort(info.Target)
+		if err != nil {
+			host = info.Target
+		}
+		return p.sticky(host)
+	default:
+		ip := p.addrs[p.next%len(p.addrs)]
+		p.next++
+		return ip
+	}
+}
+
+// sticky picks by rendezvous hashing, a key only moves if its address leaves the pool
+func (p *EgressPool) sticky(key string) net.IP {
+	var best net.IP
+	var max uint64
+	for _, ip := range p.addrs {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write(ip)
+		if w := h.Sum64(); best == nil || w > max {
+			best, max = ip, w
+		}
+	}
+	return best
+}
+
+// failed removes ip if err says it cannot be bound
+func (p *EgressPool) failed(ip net.IP, err error) {
+	var serr *os.SyscallError
+	if errors.As(err, &serr) && serr.Syscall == "bind" {
+		p.Remove(ip)
+	}
+}
+
+// parseEgressUser splits the session id off a user, see egressSessionSep
+func parseEgressUser(user string) (string, string) {
+	i := strings.LastIndex(user, egressSessionSep)
+	if i <= 0 || i+len(egressSessionSep) == len(user) {
+		return user, ""
+	}
+	return user[:i], user[i+len(egressSessionSep):]
+}
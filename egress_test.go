@@ -0,0 +1,112 @@
+package socks
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEgressPool(t *testing.T) {
+	ips := []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)}
+	p := NewEgressPool(EgressRoundRobin, ips...)
+	for i := 0; i < 6; i++ {
+		if ip := p.pick(SessionInfo{}, ""); !ip.Equal(ips[i%3]) {
+			t.Fatalf("unexpected round robin: %v", ip)
+		}
+	}
+
+	p = NewEgressPool(EgressStickyUser, ips...)
+	alice := p.pick(SessionInfo{User: "alice"}, "")
+	for i := 0; i < 5; i++ {
+		if ip := p.pick(SessionInfo{User: "alice", Target: newData(4)}, ""); !ip.Equal(alice) {
+			t.Fatal("user not sticky")
+		}
+	}
+	// another address leaving keeps the assignment
+	for _, ip := range ips {
+		if !ip.Equal(alice) {
+			p.Remove(ip)
+			break
+		}
+	}
+	if ip := p.pick(SessionInfo{User: "alice"}, ""); !ip.Equal(alice) {
+		t.Fatal("user moved")
+	}
+
+	p = NewEgressPool(EgressStickyDestination, ips...)
+	dst := p.pick(SessionInfo{Target: "example.com:80"}, "")
+	if ip := p.pick(SessionInfo{User: "bob", Target: "example.com:443"}, ""); !ip.Equal(dst) {
+		t.Fatal("destination not sticky")
+	}
+
+	// the sessions of a user spread
+	p = NewEgressPool(EgressStickyUser, ips...)
+	seen := make(map[string]bool)
+	for i := 0; i < 32; i++ {
+		seen[p.pick(SessionInfo{User: "alice"}, newData(8)).String()] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("sessions not spread")
+	}
+
+	for user, want := range map[string][2]string{
+		"alice-session-abc": {"alice", "abc"},
+		"alice":             {"alice", ""},
+		"alice-session-":    {"alice-session-", ""},
+		"-session-abc":      {"-session-abc", ""},
+		"a-session-b-c":     {"a", "b-c"},
+	} {
+		u, s := parseEgressUser(user)
+		if u != want[0] || s != want[1] {
+			t.Fatalf("unexpected split of %s: %s %s", user, u, s)
+		}
+	}
+}
+
+func TestServerEgressPool(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	users := make(chan string, 8)
+	events := make(chan SessionEvent, 8)
+	// the documentation address cannot be bound and leaves the pool
+	pool := NewEgressPool(EgressRoundRobin, net.IPv4(192, 0, 2, 1), net.IPv4(127, 0, 0, 1))
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthPASSWORD: func(conn net.Conn, auth S5AuthPassword) net.Conn {
+				users <- auth.User
+				return conn
+			},
+		},
+		SessionHook: func(event SessionEvent) {
+			if event.Type == SessionOpen {
+				events <- event
+			}
+		},
+		EgressPool: pool,
+	})
+	opened := 0
+	for _, user := range []string{"alice-session-1", "alice", "alice", "alice"} {
+		dr, err := SOCKS5CONNECTP(listen.Addr().Network(), listen.Addr().String(), &S5AuthPassword{User: user, Password: "x"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+		if user := <-users; user != "alice" {
+			t.Fatalf("unexpected user: %s", user)
+		}
+		if err != nil {
+			continue
+		}
+		testConn(t, conn, newData(64))
+		_ = conn.Close()
+		ev := testSessionEvent(t, events)
+		if ev.Info.User != "alice" || !ev.Info.Egress.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+		opened++
+	}
+	if opened < 3 || len(pool.Addrs()) != 1 {
+		t.Fatalf("unbindable address kept: %v", pool.Addrs())
+	}
+}
@@ -3,6 +3,8 @@ package socks
 import (
 	"errors"
 	"fmt"
+	"net"
+	"syscall"
 )
 
 var ErrNeedServerConfig = errors.New("need server config")
@@ -18,15 +20,49 @@ var ErrMeaninglessServiceCmd = errors.New("meaningless service: not handle socks
 var ErrSocksMessageParsingFailure = errors.New("socks message parsing failure")
 var ErrSocksVersionNotSupport = errors.New("socks version not support")
 
+var ErrSocksBINDFailure = errors.New("socks BIND failure: no incoming connection")
+
 var ErrSocks4UserIdInvalid = errors.New("socks4 user-id invalid")
 
 var ErrSocks5NOACCEPTABLEMETHODS = errors.New("socks5 NO ACCEPTABLE METHODS")
 var ErrSocks5NeedMETHODSAuth = errors.New("socks5 need METHODS auth")
 var ErrSocks5AuthRejected = errors.New("socks5 Auth Rejected")
 var ErrSocks5UDPASSOCIATEDataUnmarshalFailure = errors.New("socks5 UDP ASSOCIATE data unmarshal failure")
+var ErrSocks5UDPOverTCPFrameTooLarge = errors.New("socks5 UDP over TCP frame too large")
 
 var ErrSocks4NotSupportIPv6 = errors.New("socks4 not support IPv6")
 
+var ErrRelayVersionNotSupport = errors.New("relay version not support")
+var ErrRelayUDPFrameTooLarge = errors.New("relay UDP frame too large")
+var ErrRelayAuthRejected = errors.New("relay auth rejected")
+var ErrRelayAuthIdInvalid = errors.New("relay auth id invalid")
+var ErrRelayNotAllowed = errors.New("relay destination not allowed")
+var ErrRelayChainInvalid = errors.New("relay chain invalid")
+
+var ErrTLSPinMismatch = errors.New("tls certificate does not match the pins")
+var ErrTLSCertRejected = errors.New("tls client certificate rejected")
+var ErrTLSCertUnverified = errors.New("tls TLSCertUser needs ClientAuth VerifyClientCertIfGiven or RequireAndVerifyClientCert")
+
+var ErrHTTPAuthRejected = errors.New("http proxy auth rejected")
+var ErrHTTPRequestInvalid = errors.New("http proxy request invalid")
+var ErrHTTPMethodNotSupport = errors.New("http proxy method not support")
+
+var ErrHandshakeTimeout = errors.New("session handshake timeout")
+var ErrSessionIdleTimeout = errors.New("session idle timeout")
+var ErrSessionLifetime = errors.New("session lifetime exceeded")
+
+var ErrTransparentNotSupport = errors.New("transparent proxy not support on this platform")
+var ErrTransparentLoop = errors.New("transparent destination is the proxy itself")
+var ErrTransparentNoOrigDst = errors.New("transparent original destination not found")
+
+var ErrSocketOptionNotSupport = errors.New("socket option not support on this platform")
+var ErrSocketOptionInvalid = errors.New("socket option invalid")
+var ErrProxyProtocolInvalid = errors.New("proxy protocol header invalid")
+var ErrProxyProtocolVersion = errors.New("proxy protocol version must be 1 or 2")
+var ErrActivationInvalid = errors.New("socket activation environment invalid")
+var ErrHandoffNotSupport = errors.New("listener handoff not support on this platform")
+var ErrHandoffInvalid = errors.New("listener handoff message invalid")
+
 var ErrAddrInvalid = func(addr string, err ...string) error { return fmt.Errorf("addr invalid: %s - %v", addr, err) }
 
 func getSocks4RespErr(cd byte) error {
@@ -67,3 +103,37 @@ func getSocks5RespErr(rep byte) error {
 		return ErrSocksMessageParsingFailure
 	}
 }
+
+// ReplyError carries the socks5 reply code of a failed request,
+// handlers can return it to choose the reply the client gets
+type ReplyError struct {
+	Code byte
+	Err  error
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("socks reply 0x%02x: %v", e.Code, e.Err)
+}
+
+func (e *ReplyError) Unwrap() error {
+	return e.Err
+}
+
+// getReplyCode maps err to a socks5 reply code, def is used when nothing more specific is known
+func getReplyCode(err error, def byte) byte {
+	var re *ReplyError
+	if errors.As(err, &re) {
+		return re.Code
+	}
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5CMDRespConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5CMDRespNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socks5CMDRespHostUnreachable
+	default:
+		return def
+	}
+}
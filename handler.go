@@ -8,15 +8,17 @@ import (
 	"time"
 )
 
+// CMDCONNECTHandler dials addr, ctx ends when the client goes away or after DialTimeout
 type CMDCONNECTHandler = func(ctx context.Context, addr string) (net.Conn, error)
 
+// CMDBINDHandler sends the conn of raddr to ch, ctx ends when the client goes away or after BindTimeout
 type CMDBINDHandler = func(ctx context.Context, ch chan<- net.Conn, raddr string) (laddr net.Addr, err error)
 
+// CMDCMDUDPASSOCIATEHandler relays the datagrams of the client at addr, ctx ends with the session
 type CMDCMDUDPASSOCIATEHandler = func(ctx context.Context, addr net.Addr) (net.PacketConn, error)
 
 var DefaultCMDCONNECTHandler CMDCONNECTHandler = func(ctx context.Context, addr string) (net.Conn, error) {
-	dr := net.Dialer{}
-	conn, err := dr.DialContext(ctx, "tcp", addr)
+	conn, err := getDialer(ctx).DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -24,8 +26,7 @@ var DefaultCMDCONNECTHandler CMDCONNECTHandler = func(ctx context.Context, addr
 }
 
 var DefaultCMDBINDHandler CMDBINDHandler = func(ctx context.Context, ch chan<- net.Conn, raddr string) (laddr net.Addr, err error) {
-	lner := net.ListenConfig{}
-	ln, err := lner.Listen(ctx, "tcp", "")
+	ln, err := getListenerConfig(ctx).ListenContext(ctx, "tcp", "")
 	if err != nil {
 		return nil, err
 	}
@@ -57,8 +58,7 @@ var DefaultCMDBINDHandler CMDBINDHandler = func(ctx context.Context, ch chan<- n
 }
 
 var DefaultCMDCMDUDPASSOCIATEHandler CMDCMDUDPASSOCIATEHandler = func(ctx context.Context, addr net.Addr) (net.PacketConn, error) {
-	lner := net.ListenConfig{}
-	pconn, err := lner.ListenPacket(ctx, "udp", ":0")
+	pconn, err := listenUDPASSOCIATE(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -66,24 +66,37 @@ var DefaultCMDCMDUDPASSOCIATEHandler CMDCMDUDPASSOCIATEHandler = func(ctx contex
 	return uconn, nil
 }
 
+// listenUDPASSOCIATE returns the client side socket of an association, on the host network
+// as the client reaches it there, which is the control connection in UDP over TCP mode
+func listenUDPASSOCIATE(ctx context.Context) (net.PacketConn, error) {
+	if pconn, ok := ctx.Value(udpPacketConnKey).(net.PacketConn); ok {
+		return pconn, nil
+	}
+	lner := net.ListenConfig{}
+	return lner.ListenPacket(ctx, "udp", ":0")
+}
+
 type udpConn struct {
 	net.PacketConn
-	mux     sync.Mutex
-	m       map[net.Addr]net.PacketConn
-	laddr   net.Addr
-	ctx     context.Context
-	cancel  context.CancelFunc
-	timeout time.Duration
-	cb      UDPDataHandler
+	mux      sync.Mutex
+	m        map[string]*udpSubConn
+	laddr    net.Addr
+	ctx      context.Context
+	cancel   context.CancelFunc
+	timeout  time.Duration
+	cb       UDPDataHandler
+	filter   *UDPFilter
+	resolver *udpResolver
 }
 
 func newUdpConn(ctx context.Context, pconn net.PacketConn, laddr net.Addr) net.PacketConn {
 	uc := &udpConn{
 		PacketConn: pconn,
 		mux:        sync.Mutex{},
-		m:          make(map[net.Addr]net.PacketConn),
+		m:          make(map[string]*udpSubConn),
 		laddr:      laddr,
 		timeout:    30 * time.Second,
+		resolver:   newUdpResolver(),
 	}
 	value := ctx.Value(udpTimeoutKey)
 	if value != nil {
@@ -99,6 +112,13 @@ func newUdpConn(ctx context.Context, pconn net.PacketConn, laddr net.Addr) net.P
 			uc.cb = u
 		}
 	}
+	value = ctx.Value(udpFilterKey)
+	if value != nil {
+		f, ok := value.(*UDPFilter)
+		if ok {
+			uc.filter = f
+		}
+	}
 	uc.ctx, uc.cancel = context.WithCancel(ctx)
 	return uc
 }
@@ -110,7 +130,7 @@ func (u *udpConn) ReadFrom(p []byte) (a int, b net.Addr, c error) {
 			return 0, nil, err
 		}
 
-		data, xaddr, err := unmarshalSocks5UDPASSOCIATEData2(p[:n])
+		data, xaddr, err := unmarshalSocks5UDPASSOCIATEData3(p[:n])
 		if err != nil {
 			continue
 		}
@@ -138,22 +158,50 @@ func (u *udpConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	if !ok {
 		return 0, errors.New("invalid net.Addr")
 	}
+	raddr, wait, err := u.resolver.resolve(u.ctx, uaddr.raddr)
+	if wait != nil {
+		// a slow lookup must not hold up the datagrams to the other targets
+		b := append([]byte{}, p...)
+		go func() {
+			raddr, err := wait()
+			if err == nil {
+				_, _ = u.writeTo(b, uaddr, raddr)
+			}
+		}()
+		return len(p), nil
+	}
+	if err != nil {
+		//drop the datagram, not the association
+		return len(p), nil
+	}
+	return u.writeTo(p, uaddr, raddr)
+}
+
+func (u *udpConn) writeTo(p []byte, uaddr *udpAddr, raddr *net.UDPAddr) (n int, err error) {
+	if !u.filter.allowDest(raddr) {
+		return len(p), nil
+	}
 	u.mux.Lock()
 	defer u.mux.Unlock()
-	pconn, ok := u.m[uaddr.laddr]
+	// a lookup that ended after Close
+	if u.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	key := uaddr.laddr.String()
+	sc, ok := u.m[key]
 	for {
 		if !ok {
-			listenConfig := net.ListenConfig{}
-			pconn, err = listenConfig.ListenPacket(u.ctx, uaddr.laddr.Network(), ":0")
+			pconn, err := getPacketListenerConfig(u.ctx).ListenPacketContext(u.ctx, "udp", ":0")
 			if err != nil {
 				return 0, err
 			}
-			u.m[uaddr.laddr] = pconn
-			go u.subRead(pconn, uaddr.laddr)
+			sc = newUdpSubConn(pconn, u.filter, u.timeout)
+			u.m[key] = sc
+			go u.subRead(sc, key, uaddr.laddr)
 		}
-		err = pconn.SetDeadline(time.Now().Add(u.timeout))
+		err = sc.SetDeadline(time.Now().Add(u.timeout))
 		if err != nil {
-			_ = pconn.Close()
+			_ = sc.Close()
 			if errors.Is(err, net.ErrClosed) {
 				ok = false
 				continue
@@ -162,48 +210,53 @@ func (u *udpConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		}
 		break
 	}
-
-	return pconn.WriteTo(p, uaddr.raddr)
+	if !sc.record(raddr, uaddr.raddr) {
+		return len(p), nil
+	}
+	return sc.WriteTo(p, raddr)
 }
 
 func (u *udpConn) Close() error {
 	u.cancel()
 	u.mux.Lock()
 	defer u.mux.Unlock()
-	for _, pconn := range u.m {
-		_ = pconn.Close()
+	for _, sc := range u.m {
+		_ = sc.Close()
 	}
 	return u.PacketConn.Close()
 }
 
-func (u *udpConn) subRead(pconn net.PacketConn, laddr net.Addr) {
+func (u *udpConn) subRead(sc *udpSubConn, key string, laddr net.Addr) {
 	defer func() {
-		pconn.Close()
+		sc.Close()
 		u.mux.Lock()
 		defer u.mux.Unlock()
-		xconn, ok := u.m[laddr]
-		if ok && xconn == pconn {
-			delete(u.m, laddr)
+		xconn, ok := u.m[key]
+		if ok && xconn == sc {
+			delete(u.m, key)
 		}
 	}()
 	buf := make([]byte, defaultUdpBufferSize)
 	for {
-		err := pconn.SetDeadline(time.Now().Add(u.timeout))
+		err := sc.SetDeadline(time.Now().Add(u.timeout))
 		if err != nil {
 			return
 		}
-		n, addr, err := pconn.ReadFrom(buf)
+		n, addr, err := sc.ReadFrom(buf)
 		if err != nil {
 			return
 		}
-		var data []byte
+		if !sc.accept(addr) {
+			continue
+		}
+		data := buf[:n]
 		if u.cb != nil {
-			data, err = u.cb.Encode(buf[:n])
+			data, err = u.cb.Encode(data)
 			if err != nil {
 				continue
 			}
 		}
-		data = marshalSocks5UDPASSOCIATEData(buf[:n], addr)
+		data = marshalSocks5UDPASSOCIATEData(data, sc.lookup(addr))
 		_, err = u.PacketConn.WriteTo(data, laddr)
 		if err != nil {
 			return
@@ -211,6 +264,199 @@ func (u *udpConn) subRead(pconn net.PacketConn, laddr net.Addr) {
 	}
 }
 
+// udpSubConn is the outbound socket of one client address,
+// it remembers which domain targets were resolved to which ip so that replies carry the domain back,
+// and which peers were contacted so that replies can be filtered by UDPFilter.NATMode.
+// both forget entries unused for the udp timeout and hold at most udpSubConnMaxEntries
+type udpSubConn struct {
+	net.PacketConn
+	mux     sync.Mutex
+	domains map[string]udpSubDomain
+	filter  *UDPFilter
+	peers   map[string]time.Time
+	timeout time.Duration
+}
+
+const udpSubConnMaxEntries = 4096
+
+type udpSubDomain struct {
+	addr *DomainAddr
+	used time.Time
+}
+
+func newUdpSubConn(pconn net.PacketConn, filter *UDPFilter, timeout time.Duration) *udpSubConn {
+	return &udpSubConn{
+		PacketConn: pconn,
+		domains:    make(map[string]udpSubDomain),
+		filter:     filter,
+		peers:      make(map[string]time.Time),
+		timeout:    timeout,
+	}
+}
+
+// record remembers a datagram to raddr, false if there are too many peers to send it
+func (sc *udpSubConn) record(raddr *net.UDPAddr, addr net.Addr) bool {
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+	now := time.Now()
+	if key := sc.filter.natKey(raddr); key != "" {
+		if _, ok := sc.peers[key]; !ok && len(sc.peers) >= udpSubConnMaxEntries {
+			sc.prune(now)
+			if len(sc.peers) >= udpSubConnMaxEntries {
+				return false
+			}
+		}
+		sc.peers[key] = now
+	}
+	if da, ok := addr.(*DomainAddr); ok {
+		key := raddr.String()
+		if _, ok := sc.domains[key]; !ok && len(sc.domains) >= udpSubConnMaxEntries {
+			sc.prune(now)
+		}
+		// without room the replies carry the ip
+		if len(sc.domains) < udpSubConnMaxEntries {
+			sc.domains[key] = udpSubDomain{addr: da, used: now}
+		}
+	}
+	return true
+}
+
+// prune forgets the entries unused for the timeout, the lock is held
+func (sc *udpSubConn) prune(now time.Time) {
+	for key, used := range sc.peers {
+		if now.Sub(used) > sc.timeout {
+			delete(sc.peers, key)
+		}
+	}
+	for key, d := range sc.domains {
+		if now.Sub(d.used) > sc.timeout {
+			delete(sc.domains, key)
+		}
+	}
+}
+
+func (sc *udpSubConn) accept(addr net.Addr) bool {
+	key := sc.filter.natKey(addr)
+	if key == "" {
+		return true
+	}
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+	now := time.Now()
+	if used, ok := sc.peers[key]; ok && now.Sub(used) <= sc.timeout {
+		sc.peers[key] = now
+		return true
+	}
+	sc.filter.dropNAT()
+	return false
+}
+
+func (sc *udpSubConn) lookup(addr net.Addr) net.Addr {
+	sc.mux.Lock()
+	defer sc.mux.Unlock()
+	key := addr.String()
+	if d, ok := sc.domains[key]; ok {
+		d.used = time.Now()
+		sc.domains[key] = d
+		return d.addr
+	}
+	return addr
+}
+
+// udpResolver resolves each domain target once per association, a failed lookup is tried again after udpResolveRetry
+type udpResolver struct {
+	mux sync.Mutex
+	m   map[string]*udpLookup
+}
+
+const udpResolveRetry = 5 * time.Second
+
+type udpLookup struct {
+	done chan struct{}
+	ip   net.IP
+	err  error
+	end  time.Time
+}
+
+func newUdpResolver() *udpResolver {
+	return &udpResolver{m: make(map[string]*udpLookup)}
+}
+
+// resolve returns the address of addr. for a domain still being looked up it returns wait instead,
+// which blocks until the lookup ended
+func (r *udpResolver) resolve(ctx context.Context, addr net.Addr) (raddr *net.UDPAddr, wait func() (*net.UDPAddr, error), err error) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a, nil, nil
+	case *DomainAddr:
+		l := r.lookup(ctx, a.Host)
+		select {
+		case <-l.done:
+			raddr, err = l.udpAddr(a.Port)
+			return raddr, nil, err
+		default:
+			return nil, func() (*net.UDPAddr, error) {
+				select {
+				case <-l.done:
+					return l.udpAddr(a.Port)
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}, nil
+		}
+	default:
+		raddr, err = net.ResolveUDPAddr("udp", addr.String())
+		return raddr, nil, err
+	}
+}
+
+// lookup starts the lookup of host unless one is running or done, the lock is not held meanwhile
+func (r *udpResolver) lookup(ctx context.Context, host string) *udpLookup {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if l, ok := r.m[host]; ok && !l.expired() {
+		return l
+	}
+	l := &udpLookup{done: make(chan struct{})}
+	r.m[host] = l
+	go func() {
+		defer close(l.done)
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err == nil && len(ips) == 0 {
+			err = ErrAddrInvalid(host, "no such host")
+		}
+		if err != nil {
+			l.err, l.end = err, time.Now().Add(udpResolveRetry)
+			return
+		}
+		l.ip = ips[0].IP
+		for _, ip := range ips {
+			if ip.IP.To4() != nil {
+				l.ip = ip.IP
+				break
+			}
+		}
+	}()
+	return l
+}
+
+// expired tells if l failed long enough ago to be tried again
+func (l *udpLookup) expired() bool {
+	select {
+	case <-l.done:
+		return l.err != nil && time.Now().After(l.end)
+	default:
+		return false
+	}
+}
+
+func (l *udpLookup) udpAddr(port int) (*net.UDPAddr, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	return &net.UDPAddr{IP: l.ip, Port: port}, nil
+}
+
 type udpAddr struct {
 	laddr, raddr net.Addr
 }
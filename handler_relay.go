@@ -3,6 +3,10 @@ package socks
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net"
@@ -10,93 +14,251 @@ import (
 	"time"
 )
 
+// relay protocol v2, a mux session (see mux.go) starts with relayMuxMagic and a v1 session starts with its cmd instead of relayMagic
+//
+//	request:  MAGIC VER CAPS(2) CMD ATYP DST.ADDR DST.PORT
+//	reply:    VER CAPS(2) REP ATYP BND.ADDR BND.PORT
+//
+// CAPS in the request are the ones of the client, in the reply the agreed ones, for relayCapCHAIN see handler_relay_chain.go.
+// REP mirrors the socks5 reply codes. with relayCapAUTH agreed the server sends NONCE(32) right after CAPS
+// and waits for IDLEN ID MAC(32), MAC = HMAC-SHA256(key, NONCE VER CAPS CMD ATYP DST.ADDR DST.PORT ID). BIND sends a second REP ATYP ADDR PORT once the peer connected.
+// UDPASSOCIATE then carries frames of ATYP LADDR LPORT ATYP RADDR RPORT LEN(2) DATA
+const (
+	relayMagic    = 0xfe
+	relayVersion2 = 0x02
+)
+
 const (
 	relayCMDCONNECT = iota
 	relayCMDBIND
 	relayCMDUDPASSOCIATE
 )
 
+const (
+	relayCapCONNECT      uint16 = 1 << relayCMDCONNECT
+	relayCapBIND         uint16 = 1 << relayCMDBIND
+	relayCapUDPASSOCIATE uint16 = 1 << relayCMDUDPASSOCIATE
+)
+
+const relayCapAUTH uint16 = 1 << 8
+
+const relayCaps = relayCapCONNECT | relayCapBIND | relayCapUDPASSOCIATE
+
+const relayNonceLen = 32
+
+type RelayConfig struct {
+	UdpTimeout time.Duration //default 30s
+	UDPFilter  *UDPFilter    //if nil, endpoint-independent and any destination
+	// AuthKey returns the pre-shared key of a client id, if nil the relay is open to anyone.
+	// with AuthKey set, v1 peers are refused since they can not authenticate
+	AuthKey func(id string) (key []byte, ok bool)
+	// Allow decides which destinations id may reach, network is tcp for CONNECT and BIND (the expected peer)
+	// and udp for every datagram. if nil, any destination. id is empty without AuthKey
+	Allow func(id string, network string, addr string) bool
+	Mux   *MuxConfig //settings of mux sessions from RelayMuxPool, if nil, defaults
+	// Route returns the hops a request goes through from here on, given the ones it brought along.
+	// no hops means the relay serves it itself, it is also where the credentials of the next hop are filled in.
+	// if nil, the hops of the request are used
+	Route func(ctx context.Context, info SessionInfo, hops []RelayHop) ([]RelayHop, error)
+
+	Dialer               Dialer               //dials CONNECT, if nil, net.Dialer
+	ListenerConfig       ListenerConfig       //listens for BIND, if nil, net.ListenConfig
+	PacketListenerConfig PacketListenerConfig //listens for UDPASSOCIATE, if nil, net.ListenConfig
+	Ruleset              Ruleset              //asked after Allow, if nil, every request is allowed
+	SessionHook          SessionHook          //observes the sessions, a mux session is not one but each of its streams
+}
+
+func (cfg *RelayConfig) dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if cfg.Dialer != nil {
+		return cfg.Dialer.DialContext(ctx, network, addr)
+	}
+	dr := net.Dialer{}
+	return dr.DialContext(ctx, network, addr)
+}
+
+func (cfg *RelayConfig) listen(ctx context.Context, network string, addr string) (net.Listener, error) {
+	if cfg.ListenerConfig != nil {
+		return cfg.ListenerConfig.ListenContext(ctx, network, addr)
+	}
+	lc := net.ListenConfig{}
+	return lc.Listen(ctx, network, addr)
+}
+
+func (cfg *RelayConfig) listenPacket(ctx context.Context, network string, addr string) (net.PacketConn, error) {
+	if cfg.PacketListenerConfig != nil {
+		return cfg.PacketListenerConfig.ListenPacketContext(ctx, network, addr)
+	}
+	lc := net.ListenConfig{}
+	return lc.ListenPacket(ctx, network, addr)
+}
+
+type RelayOption func(opts *relayOptions)
+
+type relayOptions struct {
+	id     string
+	key    []byte
+	hops   []RelayHop
+	labels []string
+}
+
+func newRelayOptions(opts []RelayOption) relayOptions {
+	var ro relayOptions
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&ro)
+		}
+	}
+	return ro
+}
+
+// WithRelayKey authenticates to the relay as id, the relay needs the same key in RelayConfig.AuthKey
+func WithRelayKey(id string, key []byte) RelayOption {
+	return func(opts *relayOptions) {
+		opts.id = id
+		opts.key = key
+	}
+}
+
 func RelayServe(rwc io.ReadWriteCloser) error {
+	return RelayServeWithConfig(rwc, nil)
+}
+
+func RelayServeWithConfig(rwc io.ReadWriteCloser, cfg *RelayConfig) error {
+	if cfg == nil {
+		cfg = &RelayConfig{}
+	}
+	return relayServe(context.Background(), rwc, cfg, true)
+}
+
+// relayConn is the server side of one relay session
+type relayConn struct {
+	io.ReadWriteCloser
+	ctx  context.Context
+	cfg  *RelayConfig
+	sess *session
+}
+
+// allow asks the Ruleset about the request of id
+func (rc *relayConn) allow(id string, cmd byte, addr string) error {
+	rc.sess.info.User = id
+	return rc.sess.allow(rc.ctx, relayCMDName(cmd), addr)
+}
+
+func relayCMDName(cmd byte) string {
+	switch cmd {
+	case relayCMDCONNECT:
+		return "CONNECT"
+	case relayCMDBIND:
+		return "BIND"
+	case relayCMDUDPASSOCIATE:
+		return "UDPASSOCIATE"
+	default:
+		return ""
+	}
+}
+
+// relayServe serves one session, a stream of a mux session may not start another one
+func relayServe(ctx context.Context, rwc io.ReadWriteCloser, cfg *RelayConfig, allowMux bool) (err error) {
 	defer rwc.Close()
 	b := make([]byte, 1)
-	_, err := io.ReadFull(rwc, b)
+	_, err = io.ReadFull(rwc, b)
 	if err != nil {
 		return err
 	}
+	if b[0] == relayMuxMagic && allowMux {
+		//every stream authenticates on its own
+		return relayServeMux(ctx, rwc, cfg)
+	}
+	sess := newSession("relay", rwc, cfg.Ruleset, cfg.SessionHook)
+	sess.in.Add(1)
+	defer func() {
+		sess.end(err)
+	}()
+	rc := &relayConn{
+		ReadWriteCloser: &countReadWriteCloser{ReadWriteCloser: rwc, sess: sess},
+		ctx:             ctx,
+		cfg:             cfg,
+		sess:            sess,
+	}
+	if b[0] != relayMagic && cfg.AuthKey != nil {
+		return ErrRelayAuthRejected
+	}
 	switch b[0] {
+	case relayMagic:
+		return relayServeV2(rc)
 	case relayCMDCONNECT:
-		return relayServeCMDCONNECT(rwc)
+		return relayServeV1CONNECT(rc)
 	case relayCMDBIND:
-		return relayServeCMDBIND(rwc)
+		return relayServeV1BIND(rc)
 	case relayCMDUDPASSOCIATE:
-		return relayServeCMDCMDUDPASSOCIATE(rwc)
+		return relayServeV1UDPASSOCIATE(rc)
 	default:
 		return errors.New("invalid relay")
 	}
 }
 
-func RelayCMDCONNECTHandler(cb func(ctx context.Context) (net.Conn, error)) CMDCONNECTHandler {
+func RelayCMDCONNECTHandler(cb func(ctx context.Context) (net.Conn, error), opts ...RelayOption) CMDCONNECTHandler {
+	ro := newRelayOptions(opts)
 	return func(ctx context.Context, addr string) (net.Conn, error) {
 		rwc, err := cb(ctx)
 		if err != nil {
 			return nil, err
 		}
-		_, err = rwc.Write(append([]byte{relayCMDCONNECT}, makeStrBytes(addr)...))
-		if err != nil {
-			return nil, err
-		}
-		b := make([]byte, 1)
-		_, err = io.ReadFull(rwc, b)
+		_, err = relayRequest(rwc, relayCMDCONNECT, addr, ro)
 		if err != nil {
-			return nil, err
-		}
-		if b[0] != 0xff {
 			_ = rwc.Close()
-			return nil, io.ErrClosedPipe
+			return nil, err
 		}
 		return rwc, nil
 	}
 }
 
-func RelayCMDBINDHandler(cb func(ctx context.Context) (net.Conn, error)) CMDBINDHandler {
+func RelayCMDBINDHandler(cb func(ctx context.Context) (net.Conn, error), opts ...RelayOption) CMDBINDHandler {
+	ro := newRelayOptions(opts)
 	return func(ctx context.Context, ch chan<- net.Conn, raddr string) (laddr net.Addr, err error) {
 		rwc, err := cb(ctx)
 		if err != nil {
 			return nil, err
 		}
-		_, err = rwc.Write(append([]byte{relayCMDBIND}, makeStrBytes(raddr)...))
+		lnAddr, err := relayRequest(rwc, relayCMDBIND, raddr, ro)
 		if err != nil {
+			_ = rwc.Close()
 			return nil, err
 		}
-		lnAddr, err := readStr(rwc)
-		if err != nil {
-			return
-		}
-		tcpAddr, err := net.ResolveTCPAddr("", lnAddr)
-		if err != nil {
-			return
+		ip := getAddrIP(lnAddr)
+		if ip == nil {
+			_ = rwc.Close()
+			return nil, ErrAddrInvalid(lnAddr.String())
 		}
+		tcpAddr := &net.TCPAddr{IP: ip, Port: lnAddr.(*net.UDPAddr).Port}
 		if tcpAddr.IP.IsUnspecified() {
-			addr := rwc.RemoteAddr().String()
-			host, _, _ := net.SplitHostPort(addr)
-			tcpAddr.IP = net.ParseIP(host)
+			if rip := getAddrIP(rwc.RemoteAddr()); rip != nil {
+				tcpAddr.IP = rip
+			}
 		}
-		ctx1, cl := monitorConn(ctx, rwc)
+		// ctx is canceled once the server took rwc, so only a wait that has not finished may close it
+		stop := make(chan struct{})
 		go func() {
-			defer cl()
-			b := make([]byte, 1)
-			_, err = io.ReadFull(rwc, b)
-			if err != nil {
-				close(ch)
-				return
+			select {
+			case <-ctx.Done():
+				select {
+				case <-stop:
+				default:
+					_ = rwc.Close()
+				}
+			case <-stop:
 			}
-			if b[0] != 0xff {
+		}()
+		go func() {
+			_, err := readRelayReply(rwc)
+			close(stop)
+			if err != nil {
 				close(ch)
 				_ = rwc.Close()
 				return
 			}
 			select {
-			case <-ctx1.Done():
+			case <-ctx.Done():
 				_ = rwc.Close()
 				return
 			case ch <- rwc:
@@ -107,253 +269,379 @@ func RelayCMDBINDHandler(cb func(ctx context.Context) (net.Conn, error)) CMDBIND
 	}
 }
 
-func RelayCMDCMDUDPASSOCIATE(cb func(ctx context.Context) (net.Conn, error)) CMDCMDUDPASSOCIATEHandler {
+func RelayCMDCMDUDPASSOCIATE(cb func(ctx context.Context) (net.Conn, error), opts ...RelayOption) CMDCMDUDPASSOCIATEHandler {
+	ro := newRelayOptions(opts)
 	return func(ctx context.Context, addr net.Addr) (net.PacketConn, error) {
 		rwc, err := cb(ctx)
 		if err != nil {
 			return nil, err
 		}
-		_, err = rwc.Write([]byte{relayCMDUDPASSOCIATE})
+		_, err = relayRequest(rwc, relayCMDUDPASSOCIATE, net.JoinHostPort(net.IPv4zero.String(), "0"), ro)
 		if err != nil {
+			_ = rwc.Close()
 			return nil, err
 		}
-		b := make([]byte, 1)
-		_, err = io.ReadFull(rwc, b)
+		pconn, err := listenUDPASSOCIATE(ctx)
 		if err != nil {
-			return nil, err
-		}
-		if b[0] != 0xff {
 			_ = rwc.Close()
-			return nil, io.ErrClosedPipe
-		}
-		lner := net.ListenConfig{}
-		pconn, err := lner.ListenPacket(ctx, "udp", ":0")
-		if err != nil {
 			return nil, err
 		}
-		return newRelayUdpConn(pconn, rwc, addr), nil
+		h, _ := ctx.Value(udpHandlerKey).(UDPDataHandler)
+		return newRelayUdpConn(pconn, rwc, addr, h), nil
 	}
 }
 
-func newRelayUdpConn(pconn net.PacketConn, rwc io.ReadWriteCloser, laddr net.Addr) *relayUdpConn {
-	ruc := &relayUdpConn{
-		PacketConn: pconn,
-		rwc:        rwc,
-		laddr:      laddr,
-		cb:         nil,
+// relayRequest sends a v2 request and returns the bound address of a successful reply
+func relayRequest(rw io.ReadWriter, cmd byte, addr string, opts relayOptions) (net.Addr, error) {
+	xaddr, err := parseUDPAddr(addr)
+	if err != nil {
+		return nil, err
 	}
-	go ruc.async()
-	return ruc
-}
-
-type relayUdpConn struct {
-	net.PacketConn
-	rwc   io.ReadWriteCloser
-	laddr net.Addr
-	cb    UDPDataHandler
-}
-
-func (ruc *relayUdpConn) ReadFrom(p []byte) (a int, b net.Addr, c error) {
-	for {
-		n, raddr, err := ruc.PacketConn.ReadFrom(p)
+	if len(opts.id) > 255 {
+		return nil, ErrRelayAuthIdInvalid
+	}
+	caps := relayCaps
+	if opts.key != nil {
+		caps |= relayCapAUTH
+	}
+	if len(opts.hops) != 0 {
+		caps |= relayCapCHAIN
+	}
+	req := []byte{relayVersion2, 0, 0, cmd}
+	binary.BigEndian.PutUint16(req[1:3], caps)
+	req = append(req, getSocks5AddrTypeBytes(xaddr)...)
+	if len(opts.hops) != 0 {
+		hops, err := makeRelayHops(opts.hops)
 		if err != nil {
-			return 0, nil, err
+			return nil, err
 		}
-
-		data, xaddr, err := unmarshalSocks5UDPASSOCIATEData2(p[:n])
+		req = append(req, hops...)
+	}
+	_, err = rw.Write(append([]byte{relayMagic}, req...))
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 3)
+	_, err = io.ReadFull(rw, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if hdr[0] != relayVersion2 {
+		return nil, ErrRelayVersionNotSupport
+	}
+	if binary.BigEndian.Uint16(hdr[1:])&relayCapAUTH != 0 {
+		nonce := make([]byte, relayNonceLen)
+		_, err = io.ReadFull(rw, nonce)
 		if err != nil {
-			continue
-		}
-		if ruc.laddr != nil && ruc.laddr.String() != raddr.String() {
-			continue
+			return nil, err
 		}
-		if ruc.cb != nil {
-			data, err = ruc.cb.Decode(data)
-			if err != nil {
-				continue
-			}
+		b := append([]byte{byte(len(opts.id))}, opts.id...)
+		_, err = rw.Write(append(b, relayMAC(opts.key, nonce, req, opts.id)...))
+		if err != nil {
+			return nil, err
 		}
+	}
+	return readRelayReply(rw)
+}
 
-		uaddr := &udpAddr{
-			laddr: raddr,
-			raddr: xaddr,
-		}
+func relayMAC(key []byte, nonce []byte, req []byte, id string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(nonce)
+	h.Write(req)
+	h.Write([]byte(id))
+	return h.Sum(nil)
+}
 
-		return copy(p, data), uaddr, nil
+// relayServeAuth sends hdr and a nonce, then checks the answer of the client and returns its id
+func relayServeAuth(rwc io.ReadWriter, hdr []byte, req []byte, cfg *RelayConfig) (string, error) {
+	nonce := make([]byte, relayNonceLen)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	_, err = rwc.Write(append(append([]byte{}, hdr...), nonce...))
+	if err != nil {
+		return "", err
 	}
+	id, err := readStr(rwc)
+	if err != nil {
+		return "", err
+	}
+	mac := make([]byte, sha256.Size)
+	_, err = io.ReadFull(rwc, mac)
+	if err != nil {
+		return "", err
+	}
+	key, ok := cfg.AuthKey(id)
+	if !ok || !hmac.Equal(mac, relayMAC(key, nonce, req, id)) {
+		return "", ErrRelayAuthRejected
+	}
+	return id, nil
 }
 
-func (ruc *relayUdpConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	uaddr, ok := addr.(*udpAddr)
-	if !ok {
-		return 0, errors.New("invalid net.Addr")
+// readRelayReply reads REP ATYP ADDR PORT, a failure comes back as *ReplyError
+func readRelayReply(r io.Reader) (net.Addr, error) {
+	rep := make([]byte, 1)
+	_, err := io.ReadFull(r, rep)
+	if err != nil {
+		return nil, err
+	}
+	s, err := readSocks5TypedAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	if rep[0] != socks5CMDRespSuccess {
+		return nil, &ReplyError{Code: rep[0], Err: getSocks5RespErr(rep[0])}
 	}
-	bs := new(bytes.Buffer)
-	bs.Write(makeStrBytes(uaddr.laddr.String()))
-	bs.Write(makeStrBytes(uaddr.raddr.String()))
-	bs.Write(p)
-	return ruc.rwc.Write(bs.Bytes())
+	return parseUDPAddr(s)
 }
 
-func (ruc *relayUdpConn) Close() error {
-	_ = ruc.rwc.Close()
-	return ruc.PacketConn.Close()
+// writeRelayReply writes hdr, REP and the typed addr, hdr is nil for the second reply of BIND
+func writeRelayReply(w io.Writer, hdr []byte, code byte, addr net.Addr) error {
+	b := append(append(append([]byte{}, hdr...), code), getSocks5AddrTypeBytes(addr)...)
+	_, err := w.Write(b)
+	return err
 }
 
-func (ruc *relayUdpConn) async() {
-	defer ruc.Close()
-	for {
-		laddr, err := readStr(ruc.rwc)
-		if err != nil {
-			return
-		}
-		raddr, err := readStr(ruc.rwc)
-		if err != nil {
-			return
-		}
-		b, err := readBytes(ruc.rwc)
+func relayServeV2(rc *relayConn) error {
+	// the request is kept for the MAC
+	req := new(bytes.Buffer)
+	r := io.TeeReader(rc, req)
+	b := make([]byte, 4)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return err
+	}
+	hdr := []byte{relayVersion2, 0, 0}
+	if b[0] != relayVersion2 {
+		_ = writeRelayReply(rc, hdr, socks5CMDRespFailure, nil)
+		return ErrRelayVersionNotSupport
+	}
+	caps := relayCaps | relayCapCHAIN
+	if rc.cfg.AuthKey != nil {
+		caps |= relayCapAUTH
+	}
+	caps &= binary.BigEndian.Uint16(b[1:3])
+	binary.BigEndian.PutUint16(hdr[1:], caps)
+	cmd := b[3]
+	addr, err := readSocks5TypedAddr(r)
+	if err != nil {
+		_ = writeRelayReply(rc, hdr, socks5CMDRespAddNotSupported, nil)
+		return err
+	}
+	var hops []RelayHop
+	if caps&relayCapCHAIN != 0 {
+		hops, err = readRelayHops(r)
 		if err != nil {
-			return
+			_ = writeRelayReply(rc, hdr, socks5CMDRespAddNotSupported, nil)
+			return err
 		}
-		xraddr, err := net.ResolveUDPAddr("", raddr)
-		if err != nil {
-			return
+	}
+	var id string
+	if rc.cfg.AuthKey != nil {
+		if caps&relayCapAUTH == 0 {
+			_ = writeRelayReply(rc, hdr, socks5CMDRespConnNotAllowed, nil)
+			return ErrRelayAuthRejected
 		}
-		xladdr, err := net.ResolveUDPAddr("", laddr)
+		id, err = relayServeAuth(rc, hdr, req.Bytes(), rc.cfg)
 		if err != nil {
-			return
-		}
-		if ruc.cb != nil {
-			b, err = ruc.cb.Encode(b)
-			if err != nil {
-				continue
-			}
+			_ = writeRelayReply(rc, nil, socks5CMDRespConnNotAllowed, nil)
+			return err
 		}
-		data := marshalSocks5UDPASSOCIATEData(b, xraddr)
-		_, err = ruc.PacketConn.WriteTo(data, xladdr)
+		//hdr went out with the nonce
+		hdr = nil
+	}
+	if cmd > relayCMDUDPASSOCIATE || caps&(1<<cmd) == 0 {
+		_ = writeRelayReply(rc, hdr, socks5CMDRespCMDNotSupported, nil)
+		return ErrSocks5CMDNotSupport
+	}
+	if cmd != relayCMDUDPASSOCIATE && rc.cfg.Allow != nil && !rc.cfg.Allow(id, "tcp", addr) {
+		_ = writeRelayReply(rc, hdr, socks5CMDRespConnNotAllowed, nil)
+		return ErrRelayNotAllowed
+	}
+	//the relay dials the next hop only
+	if len(hops) != 0 && rc.cfg.Allow != nil && !rc.cfg.Allow(id, "tcp", hops[0].Addr) {
+		_ = writeRelayReply(rc, hdr, socks5CMDRespConnNotAllowed, nil)
+		return ErrRelayNotAllowed
+	}
+	err = rc.allow(id, cmd, addr)
+	if err != nil {
+		_ = writeRelayReply(rc, hdr, getReplyCode(err, socks5CMDRespConnNotAllowed), nil)
+		return err
+	}
+	hops, err = rc.relayRoute(hops)
+	if err != nil {
+		_ = writeRelayReply(rc, hdr, getReplyCode(err, socks5CMDRespConnNotAllowed), nil)
+		return err
+	}
+	if len(hops) != 0 {
+		return relayServeV2Chain(rc, hdr, cmd, addr, hops)
+	}
+	switch cmd {
+	case relayCMDCONNECT:
+		return relayServeV2CONNECT(rc, hdr, addr)
+	case relayCMDBIND:
+		return relayServeV2BIND(rc, hdr, addr)
+	default:
+		err = writeRelayReply(rc, hdr, socks5CMDRespSuccess, nil)
 		if err != nil {
-			return
+			return err
 		}
+		rc.sess.open()
+		return relayServeUDPASSOCIATE(rc, id, readRelayUdpFrame, makeRelayUdpFrame)
 	}
 }
 
-func relayServeCMDCONNECT(rwc io.ReadWriteCloser) error {
-	addr, err := readStr(rwc)
-	if err != nil {
-		return err
-	}
-	ctx, cl := monitorConn(context.Background(), rwc)
-	dr := net.Dialer{}
-	conn, err := dr.DialContext(ctx, "tcp", addr)
+func relayServeV2CONNECT(rc *relayConn, hdr []byte, addr string) error {
+	ctx, cl := monitorConn(rc.ctx, rc)
+	conn, err := rc.cfg.dial(ctx, "tcp", addr)
 	cl()
 	if err != nil {
+		_ = writeRelayReply(rc, hdr, getReplyCode(err, socks5CMDRespNetworkUnreachable), nil)
 		return err
 	}
 	defer conn.Close()
-	_, err = rwc.Write([]byte{0xff})
+	err = writeRelayReply(rc, hdr, socks5CMDRespSuccess, conn.LocalAddr())
 	if err != nil {
 		return err
 	}
-	go io.Copy(rwc, conn)
-	_, err = io.Copy(conn, rwc)
-	return err
+	rc.sess.open()
+	return pipe(rc.ReadWriteCloser, conn, true)
 }
 
-func relayServeCMDBIND(rwc io.ReadWriteCloser) error {
-	raddr, err := readStr(rwc)
+func relayServeV2BIND(rc *relayConn, hdr []byte, raddr string) error {
+	ctx, cl := monitorConn(rc.ctx, rc)
+	defer cl()
+	ln, err := rc.cfg.listen(ctx, "tcp", "")
+	if err != nil {
+		_ = writeRelayReply(rc, hdr, getReplyCode(err, socks5CMDRespFailure), nil)
+		return err
+	}
+	err = writeRelayReply(rc, hdr, socks5CMDRespSuccess, ln.Addr())
 	if err != nil {
+		_ = ln.Close()
 		return err
 	}
-	ctx, cl := monitorConn(context.Background(), rwc)
-	lner := net.ListenConfig{}
-	ln, err := lner.Listen(ctx, "tcp", "")
+	conn, err := relayBINDAccept(ctx, ln, raddr)
 	if err != nil {
-		cl()
+		_ = writeRelayReply(rc, nil, socks5CMDRespTTLExpired, nil)
 		return err
 	}
-	_, err = rwc.Write(makeStrBytes(ln.Addr().String()))
+	cl()
+	defer conn.Close()
+	err = writeRelayReply(rc, nil, socks5CMDRespSuccess, conn.RemoteAddr())
 	if err != nil {
-		cl()
 		return err
 	}
+	rc.sess.open()
+	return pipe(rc.ReadWriteCloser, conn, true)
+}
+
+// relayBINDAccept waits for raddr on ln, ln is closed on return
+func relayBINDAccept(ctx context.Context, ln net.Listener, raddr string) (net.Conn, error) {
+	defer ln.Close()
 	waitFunc(ctx, func() {
 		_ = ln.Close()
 	})
-	var conn net.Conn
 	for {
-		conn, err = ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
-			cl()
-			return err
+			return nil, err
 		}
 		if conn.RemoteAddr().String() != raddr {
-			conn.Close()
-		} else {
-			select {
-			case <-ctx.Done():
-				conn.Close()
-				return ctx.Err()
-			default:
-			}
-			break
+			_ = conn.Close()
+			continue
+		}
+		if ctx.Err() != nil {
+			_ = conn.Close()
+			return nil, ctx.Err()
 		}
+		return conn, nil
 	}
-	cl()
-	defer conn.Close()
-	_, err = rwc.Write([]byte{0xff})
+}
+
+func readRelayUdpFrame(r io.Reader) (laddr string, raddr string, data []byte, err error) {
+	laddr, err = readSocks5TypedAddr(r)
 	if err != nil {
-		return err
+		return "", "", nil, err
 	}
-	go io.Copy(rwc, conn)
-	_, err = io.Copy(conn, rwc)
-	return err
+	raddr, err = readSocks5TypedAddr(r)
+	if err != nil {
+		return "", "", nil, err
+	}
+	l := make([]byte, 2)
+	_, err = io.ReadFull(r, l)
+	if err != nil {
+		return "", "", nil, err
+	}
+	data = make([]byte, binary.BigEndian.Uint16(l))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return laddr, raddr, data, nil
+}
+
+// makeRelayUdpFrame returns nil if data does not fit in a frame
+func makeRelayUdpFrame(laddr string, raddr net.Addr, data []byte) []byte {
+	if len(data) > 0xffff {
+		return nil
+	}
+	var xladdr net.Addr
+	if a, err := parseUDPAddr(laddr); err == nil {
+		xladdr = a
+	}
+	b := append(getSocks5AddrTypeBytes(xladdr), getSocks5AddrTypeBytes(raddr)...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
 }
 
-func relayServeCMDCMDUDPASSOCIATE(rwc io.ReadWriteCloser) error {
+// relayServeUDPASSOCIATE relays the frames of one association, shared by v1 and v2 which differ in framing only
+func relayServeUDPASSOCIATE(rc *relayConn, id string,
+	readFrame func(r io.Reader) (laddr string, raddr string, data []byte, err error),
+	makeFrame func(laddr string, raddr net.Addr, data []byte) []byte) error {
+	cfg := rc.cfg
 	uTimeout := 30 * time.Second
-	ctx, cl := monitorConn(context.Background(), rwc)
+	if cfg.UdpTimeout != 0 {
+		uTimeout = cfg.UdpTimeout
+	}
+	ctx, cl := monitorConn(rc.ctx, rc)
 	defer cl()
 	var mux sync.Mutex
-	m := make(map[string]net.PacketConn)
+	var wmux sync.Mutex
+	m := make(map[string]*udpSubConn)
+	resolver := newUdpResolver()
+	closed := false
 	defer func() {
 		mux.Lock()
 		defer mux.Unlock()
+		closed = true
 		for _, conn := range m {
 			_ = conn.Close()
 		}
 	}()
-	_, err := rwc.Write([]byte{0xff})
-	if err != nil {
-		return err
-	}
-	for {
-		laddr, err := readStr(rwc)
-		if err != nil {
-			return err
-		}
-		raddr, err := readStr(rwc)
-		if err != nil {
-			return err
-		}
-		data, err := readBytes(rwc)
-		if err != nil {
-			return err
-		}
-		xaddr, err := net.ResolveUDPAddr("", raddr)
-		if err != nil {
-			return err
+	send := func(laddr string, data []byte, xaddr *net.UDPAddr, daddr net.Addr) error {
+		if !cfg.UDPFilter.allowDest(xaddr) {
+			return nil
 		}
+		var err error
 		mux.Lock()
+		if closed {
+			// a lookup that ended after the association
+			mux.Unlock()
+			return net.ErrClosed
+		}
 		packetConn, ok := m[laddr]
 		for {
 			if !ok {
-				lp := net.ListenConfig{}
-				packetConn, err = lp.ListenPacket(ctx, "udp", ":0")
+				var pconn net.PacketConn
+				pconn, err = cfg.listenPacket(ctx, "udp", ":0")
 				if err != nil {
 					break
 				}
+				packetConn = newUdpSubConn(pconn, cfg.UDPFilter, uTimeout)
 				m[laddr] = packetConn
-				go func() {
+				go func(laddr string, packetConn *udpSubConn) {
 					defer func() {
 						_ = packetConn.Close()
 						mux.Lock()
@@ -373,16 +661,21 @@ func relayServeCMDCMDUDPASSOCIATE(rwc io.ReadWriteCloser) error {
 						if err != nil {
 							return
 						}
-						bs := new(bytes.Buffer)
-						bs.Write(makeStrBytes(laddr))
-						bs.Write(makeStrBytes(addr.String()))
-						bs.Write(makeBytes(buf[:n]))
-						_, err = rwc.Write(bs.Bytes())
+						if !packetConn.accept(addr) {
+							continue
+						}
+						frame := makeFrame(laddr, packetConn.lookup(addr), buf[:n])
+						if frame == nil {
+							continue
+						}
+						wmux.Lock()
+						_, err = rc.Write(frame)
+						wmux.Unlock()
 						if err != nil {
 							return
 						}
 					}
-				}()
+				}(laddr, packetConn)
 			}
 			err = packetConn.SetDeadline(time.Now().Add(uTimeout))
 			if err != nil {
@@ -391,49 +684,149 @@ func relayServeCMDCMDUDPASSOCIATE(rwc io.ReadWriteCloser) error {
 					ok = false
 					continue
 				}
-				break
 			}
+			break
 		}
 		mux.Unlock()
 		if err != nil {
 			return err
 		}
-		_, _ = packetConn.WriteTo(data, xaddr)
+		if packetConn.record(xaddr, daddr) {
+			_, _ = packetConn.WriteTo(data, xaddr)
+		}
+		return nil
+	}
+	for {
+		laddr, raddr, data, err := readFrame(rc)
+		if err != nil {
+			return err
+		}
+		if cfg.Allow != nil && !cfg.Allow(id, "udp", raddr) {
+			continue
+		}
+		daddr, err := parseUDPAddr(raddr)
+		if err != nil {
+			continue
+		}
+		xaddr, wait, err := resolver.resolve(ctx, daddr)
+		if wait != nil {
+			// a slow lookup must not hold up the datagrams to the other targets
+			data = append([]byte{}, data...)
+			go func() {
+				xaddr, err := wait()
+				if err == nil {
+					_ = send(laddr, data, xaddr, daddr)
+				}
+			}()
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		err = send(laddr, data, xaddr, daddr)
+		if err != nil {
+			return err
+		}
 	}
 }
 
-func makeStrBytes(s string) []byte {
-	return append([]byte{byte(len(s))}, []byte(s)...)
+func newRelayUdpConn(pconn net.PacketConn, rwc io.ReadWriteCloser, laddr net.Addr, h UDPDataHandler) *relayUdpConn {
+	ruc := &relayUdpConn{
+		PacketConn: pconn,
+		rwc:        rwc,
+		laddr:      laddr,
+		cb:         h,
+	}
+	go ruc.async()
+	return ruc
 }
 
-func makeBytes(b []byte) []byte {
-	return append([]byte{byte(len(b))}, b...)
+type relayUdpConn struct {
+	net.PacketConn
+	rwc   io.ReadWriteCloser
+	laddr net.Addr
+	cb    UDPDataHandler
+	wmux  sync.Mutex
 }
 
-func readStr(r io.Reader) (string, error) {
-	b := make([]byte, 1)
-	_, err := io.ReadFull(r, b)
-	if err != nil {
-		return "", err
-	}
-	b = make([]byte, b[0])
-	_, err = io.ReadFull(r, b)
-	if err != nil {
-		return "", err
+func (ruc *relayUdpConn) ReadFrom(p []byte) (a int, b net.Addr, c error) {
+	for {
+		n, raddr, err := ruc.PacketConn.ReadFrom(p)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		data, xaddr, err := unmarshalSocks5UDPASSOCIATEData3(p[:n])
+		if err != nil {
+			continue
+		}
+		if ruc.laddr != nil && ruc.laddr.String() != raddr.String() {
+			continue
+		}
+		if ruc.cb != nil {
+			data, err = ruc.cb.Decode(data)
+			if err != nil {
+				continue
+			}
+		}
+
+		uaddr := &udpAddr{
+			laddr: raddr,
+			raddr: xaddr,
+		}
+
+		return copy(p, data), uaddr, nil
 	}
-	return string(b), nil
 }
 
-func readBytes(r io.Reader) ([]byte, error) {
-	b := make([]byte, 1)
-	_, err := io.ReadFull(r, b)
-	if err != nil {
-		return nil, err
+func (ruc *relayUdpConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	uaddr, ok := addr.(*udpAddr)
+	if !ok {
+		return 0, errors.New("invalid net.Addr")
+	}
+	frame := makeRelayUdpFrame(uaddr.laddr.String(), uaddr.raddr, p)
+	if frame == nil {
+		return 0, ErrRelayUDPFrameTooLarge
 	}
-	b = make([]byte, b[0])
-	_, err = io.ReadFull(r, b)
+	ruc.wmux.Lock()
+	defer ruc.wmux.Unlock()
+	_, err = ruc.rwc.Write(frame)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ruc *relayUdpConn) Close() error {
+	_ = ruc.rwc.Close()
+	return ruc.PacketConn.Close()
+}
+
+func (ruc *relayUdpConn) async() {
+	defer ruc.Close()
+	for {
+		laddr, raddr, b, err := readRelayUdpFrame(ruc.rwc)
+		if err != nil {
+			return
+		}
+		xraddr, err := parseUDPAddr(raddr)
+		if err != nil {
+			return
+		}
+		xladdr, err := net.ResolveUDPAddr("", laddr)
+		if err != nil {
+			return
+		}
+		if ruc.cb != nil {
+			b, err = ruc.cb.Encode(b)
+			if err != nil {
+				continue
+			}
+		}
+		data := marshalSocks5UDPASSOCIATEData(b, xraddr)
+		_, err = ruc.PacketConn.WriteTo(data, xladdr)
+		if err != nil {
+			return
+		}
 	}
-	return b, nil
 }
@@ -0,0 +1,157 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// with relayCapCHAIN in the request, DST.PORT is followed by NHOPS and NHOPS times TYPE ATYP ADDR PORT,
+// the hops the request passes before DST in order. a relay takes the first one off, sends the request
+// with the rest on and answers with the reply of the next hop, so a failure anywhere reaches the client
+const relayCapCHAIN uint16 = 1 << 9
+
+const (
+	relayHopRelay  = 0x00
+	relayHopSocks5 = 0x01
+)
+
+// RelayHop is a step of a relay chain
+type RelayHop struct {
+	Addr   string
+	Socks5 bool //a socks5 server instead of a relay, only as the last hop and for CONNECT
+	// credentials for the hop, they stay with the relay that dials it and are not sent on
+	Opts []RelayOption //for a relay
+	Auth *S5Auth       //for a socks5 server, if nil, NOAUTH
+}
+
+// WithRelayChain sends the request through hops after the relay dialed by the handler,
+// each hop is asked by the one before it, see RelayConfig.Route for their credentials
+func WithRelayChain(hops ...RelayHop) RelayOption {
+	return func(opts *relayOptions) {
+		opts.hops = hops
+	}
+}
+
+func makeRelayHops(hops []RelayHop) ([]byte, error) {
+	if len(hops) > 255 {
+		return nil, ErrRelayChainInvalid
+	}
+	b := []byte{byte(len(hops))}
+	for i, hop := range hops {
+		if hop.Socks5 && i != len(hops)-1 {
+			return nil, ErrRelayChainInvalid
+		}
+		addr, err := parseUDPAddr(hop.Addr)
+		if err != nil {
+			return nil, err
+		}
+		var typ byte = relayHopRelay
+		if hop.Socks5 {
+			typ = relayHopSocks5
+		}
+		b = append(append(b, typ), getSocks5AddrTypeBytes(addr)...)
+	}
+	return b, nil
+}
+
+func readRelayHops(r io.Reader) ([]RelayHop, error) {
+	n := make([]byte, 1)
+	_, err := io.ReadFull(r, n)
+	if err != nil {
+		return nil, err
+	}
+	hops := make([]RelayHop, 0, n[0])
+	for i := 0; i < int(n[0]); i++ {
+		_, err = io.ReadFull(r, n)
+		if err != nil {
+			return nil, err
+		}
+		typ := n[0]
+		addr, err := readSocks5TypedAddr(r)
+		if err != nil {
+			return nil, err
+		}
+		if typ > relayHopSocks5 {
+			return nil, ErrRelayChainInvalid
+		}
+		hops = append(hops, RelayHop{Addr: addr, Socks5: typ == relayHopSocks5})
+	}
+	return hops, nil
+}
+
+// relayRoute gives the hops a request takes from here, the ones it brought unless RelayConfig.Route says otherwise
+func (rc *relayConn) relayRoute(hops []RelayHop) ([]RelayHop, error) {
+	if rc.cfg.Route != nil {
+		return rc.cfg.Route(rc.ctx, rc.sess.info, hops)
+	}
+	return hops, nil
+}
+
+// relayServeV2Chain hands the request to the next hop and relays whatever follows,
+// the second reply of BIND and the frames of UDPASSOCIATE included
+func relayServeV2Chain(rc *relayConn, hdr []byte, cmd byte, addr string, hops []RelayHop) error {
+	ctx, cl := monitorConn(rc.ctx, rc)
+	conn, baddr, err := relayDialHops(ctx, rc.cfg, cmd, addr, hops)
+	cl()
+	if err != nil {
+		_ = writeRelayReply(rc, hdr, getReplyCode(err, socks5CMDRespHostUnreachable), nil)
+		return err
+	}
+	defer conn.Close()
+	err = writeRelayReply(rc, hdr, socks5CMDRespSuccess, baddr)
+	if err != nil {
+		return err
+	}
+	rc.sess.open()
+	return pipe(rc.ReadWriteCloser, conn, true)
+}
+
+// relayDialHops asks hops[0] for addr and returns the conn and the bound address of its reply
+func relayDialHops(ctx context.Context, cfg *RelayConfig, cmd byte, addr string, hops []RelayHop) (net.Conn, net.Addr, error) {
+	hop := hops[0]
+	if hop.Socks5 {
+		if len(hops) != 1 || cmd != relayCMDCONNECT {
+			return nil, nil, &ReplyError{Code: socks5CMDRespCMDNotSupported, Err: ErrRelayChainInvalid}
+		}
+		auth := hop.Auth
+		if auth == nil {
+			auth = &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}
+		}
+		dr, err := SOCKS5CONNECT("tcp", hop.Addr, auth, cfg.Dialer)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := dr.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn.LocalAddr(), nil
+	}
+	conn, err := cfg.dial(ctx, "tcp", hop.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the next hop may stall, ctx ends the wait
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case <-stop:
+			default:
+				_ = conn.Close()
+			}
+		case <-stop:
+		}
+	}()
+	ro := newRelayOptions(hop.Opts)
+	ro.hops = hops[1:]
+	baddr, err := relayRequest(conn, cmd, addr, ro)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, baddr, nil
+}
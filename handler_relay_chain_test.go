@@ -0,0 +1,221 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func testRelayServerHook(t *testing.T, cfg *RelayConfig) (net.Listener, <-chan SessionEvent) {
+	events := make(chan SessionEvent, 16)
+	cfg.SessionHook = func(event SessionEvent) {
+		if event.Type == SessionOpen {
+			events <- event
+		}
+	}
+	rs, err := NewRelayServer(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = rs.Close()
+	})
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = rs.Serve(listen)
+	}()
+	return listen, events
+}
+
+func testSocksServerRelay(t *testing.T, relay net.Addr, opts ...RelayOption) net.Listener {
+	cb := func(ctx context.Context) (net.Conn, error) {
+		dr := net.Dialer{}
+		return dr.DialContext(ctx, relay.Network(), relay.String())
+	}
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+	}
+	cfg.CMDConfig.CMDCONNECTHandler = RelayCMDCONNECTHandler(cb, opts...)
+	cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler = RelayCMDCMDUDPASSOCIATE(cb, opts...)
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	return listen
+}
+
+func TestRelayChain(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	relayB, eventsB := testRelayServerHook(t, &RelayConfig{
+		AuthKey: func(id string) ([]byte, bool) {
+			return []byte("test123"), id == "relayA"
+		},
+	})
+	relayA, eventsA := testRelayServerHook(t, &RelayConfig{
+		Route: func(ctx context.Context, info SessionInfo, hops []RelayHop) ([]RelayHop, error) {
+			for i := range hops {
+				if hops[i].Addr == relayB.Addr().String() {
+					hops[i].Opts = []RelayOption{WithRelayKey("relayA", []byte("test123"))}
+				}
+			}
+			return hops, nil
+		},
+	})
+	listen := testSocksServerRelay(t, relayA.Addr(), WithRelayChain(RelayHop{Addr: relayB.Addr().String()}))
+	auth := &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}
+	dr, err := SOCKS5CONNECT(listen.Addr().Network(), listen.Addr().String(), auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testConn(t, conn, newData(64*1024))
+	for _, events := range []<-chan SessionEvent{eventsA, eventsB} {
+		ev := testSessionEvent(t, events)
+		if ev.Info.Target != ln.Addr().String() {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	}
+
+	// the refusal of the last hop reaches the socks client
+	closed := testListen(t)
+	_ = closed.Close()
+	_, err = dr.Dial("tcp", closed.Addr().String())
+	var re *ReplyError
+	if !errors.As(err, &re) || re.Code != socks5CMDRespConnRefused {
+		t.Fatalf("want connection refused from the last hop, got %v", err)
+	}
+
+	pConn := testLPConn(t)
+	defer pConn.Close()
+	ucfg, err := SOCKS5UDPASSOCIATE(listen.Addr().Network(), listen.Addr().String(), auth, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pConn2, err := ucfg.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pConn2.Close()
+	_ = pConn2.SetReadDeadline(time.Now().Add(3 * time.Second))
+	testPConn(t, pConn2, pConn.LocalAddr(), newData(4096))
+}
+
+func TestRelayChainSocks5(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	events := make(chan SessionEvent, 4)
+	upstream, err := NewServer(&ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthPASSWORD: func(conn net.Conn, auth S5AuthPassword) net.Conn {
+				return auth.IsEqual2(conn, "test", "test123")
+			},
+		},
+		SessionHook: func(event SessionEvent) {
+			if event.Type == SessionOpen {
+				events <- event
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	upLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = upstream.Serve(upLn)
+	}()
+	// requests without hops are routed to the upstream
+	relay, _ := testRelayServerHook(t, &RelayConfig{
+		Route: func(ctx context.Context, info SessionInfo, hops []RelayHop) ([]RelayHop, error) {
+			if len(hops) != 0 || info.Cmd != "CONNECT" {
+				return hops, nil
+			}
+			return []RelayHop{{
+				Addr:   upLn.Addr().String(),
+				Socks5: true,
+				Auth:   &S5Auth{Socks5AuthPASSWORD: &S5AuthPassword{User: "test", Password: "test123"}},
+			}}, nil
+		},
+	})
+	cb := func(ctx context.Context) (net.Conn, error) {
+		dr := net.Dialer{}
+		return dr.DialContext(ctx, relay.Addr().Network(), relay.Addr().String())
+	}
+	conn, err := RelayCMDCONNECTHandler(cb)(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testConn(t, conn, newData(4096))
+	ev := testSessionEvent(t, events)
+	if ev.Info.User != "test" || ev.Info.Target != ln.Addr().String() {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	// a socks5 hop ends the chain
+	_, err = RelayCMDCONNECTHandler(cb, WithRelayChain(RelayHop{Addr: upLn.Addr().String(), Socks5: true}, RelayHop{Addr: relay.Addr().String()}))(context.Background(), ln.Addr().String())
+	if !errors.Is(err, ErrRelayChainInvalid) {
+		t.Fatalf("want invalid chain, got %v", err)
+	}
+}
+
+func FuzzRelayHops(f *testing.F) {
+	f.Add([]byte{0x02, relayHopRelay, 0x01, 127, 0, 0, 1, 0x04, 0x00, relayHopSocks5, 0x03, 0x09, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0x04, 0x38})
+	f.Add([]byte{0x01, relayHopSocks5, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x00, 0x50})
+	f.Add([]byte{0x01, 0x07, 0x01, 127, 0, 0, 1, 0x04, 0x00})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		hops, err := readRelayHops(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		xb, err := makeRelayHops(hops)
+		if err != nil {
+			// a socks5 hop in the middle is read but never sent
+			return
+		}
+		// a v4-mapped v6 address comes back as v4, after that the encoding is stable
+		hops2, err := readRelayHops(bytes.NewReader(xb))
+		if err != nil || len(hops2) != len(hops) {
+			t.Fatalf("round trip of %x failed: %v", b, err)
+		}
+		xb2, err := makeRelayHops(hops2)
+		if err != nil || !bytes.Equal(xb, xb2) {
+			t.Fatalf("round trip of %x changed %x -> %x", b, xb, xb2)
+		}
+		for i := range hops {
+			if hops[i].Socks5 != hops2[i].Socks5 {
+				t.Fatalf("round trip of %x changed %v -> %v", b, hops[i], hops2[i])
+			}
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"net"
+)
+
+// v1 relay protocol, superseded by v2 and kept so that RelayServe still serves old peers.
+// a session is the cmd byte followed by
+//   CONNECT: str(addr), replies 0xff
+//   BIND: str(raddr), replies str(laddr) and 0xff once raddr connected
+//   UDPASSOCIATE: replies 0xff, then frames of str(laddr) str(raddr) bytes(data)
+// where str and bytes carry a one-byte length, so longer datagrams are truncated
+
+func relayServeV1CONNECT(rc *relayConn) error {
+	addr, err := readStr(rc)
+	if err != nil {
+		return err
+	}
+	if rc.cfg.Allow != nil && !rc.cfg.Allow("", "tcp", addr) {
+		return ErrRelayNotAllowed
+	}
+	err = rc.allow("", relayCMDCONNECT, addr)
+	if err != nil {
+		return err
+	}
+	ctx, cl := monitorConn(rc.ctx, rc)
+	conn, err := rc.cfg.dial(ctx, "tcp", addr)
+	cl()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = rc.Write([]byte{0xff})
+	if err != nil {
+		return err
+	}
+	rc.sess.open()
+	return pipe(rc.ReadWriteCloser, conn, true)
+}
+
+func relayServeV1BIND(rc *relayConn) error {
+	raddr, err := readStr(rc)
+	if err != nil {
+		return err
+	}
+	if rc.cfg.Allow != nil && !rc.cfg.Allow("", "tcp", raddr) {
+		return ErrRelayNotAllowed
+	}
+	err = rc.allow("", relayCMDBIND, raddr)
+	if err != nil {
+		return err
+	}
+	ctx, cl := monitorConn(rc.ctx, rc)
+	defer cl()
+	ln, err := rc.cfg.listen(ctx, "tcp", "")
+	if err != nil {
+		return err
+	}
+	_, err = rc.Write(makeStrBytes(ln.Addr().String()))
+	if err != nil {
+		_ = ln.Close()
+		return err
+	}
+	conn, err := relayBINDAccept(ctx, ln, raddr)
+	if err != nil {
+		return err
+	}
+	cl()
+	defer conn.Close()
+	_, err = rc.Write([]byte{0xff})
+	if err != nil {
+		return err
+	}
+	rc.sess.open()
+	return pipe(rc.ReadWriteCloser, conn, true)
+}
+
+func relayServeV1UDPASSOCIATE(rc *relayConn) error {
+	err := rc.allow("", relayCMDUDPASSOCIATE, "")
+	if err != nil {
+		return err
+	}
+	_, err = rc.Write([]byte{0xff})
+	if err != nil {
+		return err
+	}
+	rc.sess.open()
+	return relayServeUDPASSOCIATE(rc, "", readRelayV1UdpFrame, makeRelayV1UdpFrame)
+}
+
+func readRelayV1UdpFrame(r io.Reader) (laddr string, raddr string, data []byte, err error) {
+	laddr, err = readStr(r)
+	if err != nil {
+		return "", "", nil, err
+	}
+	raddr, err = readStr(r)
+	if err != nil {
+		return "", "", nil, err
+	}
+	data, err = readBytes(r)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return laddr, raddr, data, nil
+}
+
+func makeRelayV1UdpFrame(laddr string, raddr net.Addr, data []byte) []byte {
+	bs := new(bytes.Buffer)
+	bs.Write(makeStrBytes(laddr))
+	bs.Write(makeStrBytes(raddr.String()))
+	bs.Write(makeBytes(data))
+	return bs.Bytes()
+}
+
+func makeStrBytes(s string) []byte {
+	return append([]byte{byte(len(s))}, []byte(s)...)
+}
+
+func makeBytes(b []byte) []byte {
+	return append([]byte{byte(len(b))}, b...)
+}
+
+func readStr(r io.Reader) (string, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return "", err
+	}
+	b = make([]byte, b[0])
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	b = make([]byte, b[0])
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,37 @@
+package socks
+
+import (
+	"context"
+	"syscall"
+	"time"
+)
+
+// a restart without downtime: the new process takes the listening sockets of the old one over a unix socket
+// (SCM_RIGHTS) and accepts on them, while the old one stops accepting and drains its sessions.
+// connections waiting in the backlog are not lost, both processes share the sockets
+
+const (
+	handoffMaxFiles = 253 // SCM_MAX_FD
+	handoffAck      = 0x01
+	handoffRetry    = 50 * time.Millisecond
+)
+
+// Handoff waits at path for the new process to call TakeListeners, gives it the listeners being served,
+// then Shutdown drains the sessions. ctx bounds both the wait and the drain.
+// the listeners must be syscall.Conn like those of net.Listen, a tls.Listener is not
+func (sl *serverLife) Handoff(ctx context.Context, path string) error {
+	lns := sl.listeners()
+	conns := make([]syscall.Conn, 0, len(lns))
+	for _, ln := range lns {
+		sc, ok := ln.(syscall.Conn)
+		if !ok {
+			return ErrHandoffNotSupport
+		}
+		conns = append(conns, sc)
+	}
+	err := HandoffListeners(ctx, path, conns...)
+	if err != nil {
+		return err
+	}
+	return sl.Shutdown(ctx)
+}
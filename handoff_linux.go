@@ -0,0 +1,182 @@
+//go:build linux
+
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// HandoffListeners waits at path for one TakeListeners and passes it the sockets of conns,
+// it returns once the new process has them. conns stay open, close them or Shutdown the server after,
+// a unix listener then leaves its path to the new process
+func HandoffListeners(ctx context.Context, path string, conns ...syscall.Conn) error {
+	if len(conns) == 0 || len(conns) > handoffMaxFiles {
+		return ErrHandoffInvalid
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// a socket left by an old crash
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	waitFunc(ctx, func() {
+		_ = ln.Close()
+	})
+	conn, err := ln.Accept()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	_ = ln.Close()
+	waitFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	err = sendHandoff(conn.(*net.UnixConn), conns)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 1)
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if b[0] != handoffAck {
+		return ErrHandoffInvalid
+	}
+	for _, c := range conns {
+		if ul, ok := c.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return nil
+}
+
+func sendHandoff(conn *net.UnixConn, conns []syscall.Conn) error {
+	fds := make([]int, 0, len(conns))
+	for _, c := range conns {
+		rc, err := c.SyscallConn()
+		if err != nil {
+			return err
+		}
+		// the fds are used after Control, conns are not closed before the message is sent
+		err = rc.Control(func(fd uintptr) {
+			fds = append(fds, int(fd))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(len(fds)))
+	_, _, err := conn.WriteMsgUnix(b, syscall.UnixRights(fds...), nil)
+	return err
+}
+
+// TakeListeners gets the listening sockets of the old process from its HandoffListeners at path,
+// it retries until the old process listens there or ctx is done
+func TakeListeners(ctx context.Context, path string) ([]net.Listener, []net.PacketConn, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	conn, err := dialHandoff(ctx, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	waitFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	files, err := recvHandoff(conn)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
+	}
+	lns, pcs, err := FileListeners(files)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = conn.Write([]byte{handoffAck})
+	if err != nil {
+		for _, ln := range lns {
+			_ = ln.Close()
+		}
+		for _, pc := range pcs {
+			_ = pc.Close()
+		}
+		return nil, nil, err
+	}
+	return lns, pcs, nil
+}
+
+func dialHandoff(ctx context.Context, path string) (*net.UnixConn, error) {
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, "unix", path)
+		if err == nil {
+			return conn.(*net.UnixConn), nil
+		}
+		if !errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(handoffRetry):
+		}
+	}
+}
+
+func recvHandoff(conn *net.UnixConn) ([]*os.File, error) {
+	b := make([]byte, 2)
+	oob := make([]byte, syscall.CmsgSpace(4*handoffMaxFiles))
+	n, oobn, _, _, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	files := make([]*os.File, 0, len(fds))
+	for _, fd := range fds {
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), "handoff:"+strconv.Itoa(fd)))
+	}
+	if n != len(b) || int(binary.BigEndian.Uint16(b)) != len(files) || len(files) == 0 {
+		for _, f := range files {
+			_ = f.Close()
+		}
+		return nil, ErrHandoffInvalid
+	}
+	return files, nil
+}
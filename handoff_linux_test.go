@@ -0,0 +1,131 @@
+//go:build linux
+
+package socks
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServerHandoff(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	cfg := func(events chan SessionEvent) *ServerConfig {
+		return &ServerConfig{
+			VersionSwitch: DefaultSocksVersionSwitch,
+			CMDConfig:     DefaultSocksCMDConfig,
+			Socks5AuthCb:  S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+			SessionHook: func(event SessionEvent) {
+				if event.Type == SessionOpen {
+					events <- event
+				}
+			},
+		}
+	}
+	oldEvents, newEvents := make(chan SessionEvent, 4), make(chan SessionEvent, 4)
+	oldServer, err := NewServer(cfg(oldEvents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldServer.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = oldServer.Serve(listen)
+	}()
+	dial := func() net.Conn {
+		dr, err := SOCKS5CONNECTP("tcp", listen.Addr().String(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testConn(t, conn, newData(64))
+		return conn
+	}
+	draining := dial()
+	testSessionEvent(t, oldEvents)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	errc := make(chan error, 1)
+	go func() {
+		errc <- oldServer.Handoff(ctx, path)
+	}()
+	lns, pcs, err := TakeListeners(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lns) != 1 || len(pcs) != 0 || lns[0].Addr().String() != listen.Addr().String() {
+		t.Fatalf("unexpected listeners: %v %v", lns, pcs)
+	}
+	newServer, err := NewServer(cfg(newEvents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newServer.Close()
+	go func() {
+		_ = newServer.Serve(lns[0])
+	}()
+
+	// the old server drains, the new one takes the new connections
+	testConn(t, draining, newData(64))
+	select {
+	case err = <-errc:
+		t.Fatalf("handoff returned before the session ended: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn := dial()
+	defer conn.Close()
+	testSessionEvent(t, newEvents)
+	_ = draining.Close()
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(64))
+}
+
+func TestHandoffUnixListener(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "socks.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	path := filepath.Join(dir, "handoff.sock")
+	errc := make(chan error, 1)
+	go func() {
+		errc <- HandoffListeners(ctx, path, ln.(syscall.Conn))
+	}()
+	lns, _, err := TakeListeners(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lns[0].Close()
+	if err = <-errc; err != nil {
+		t.Fatal(err)
+	}
+	// the old process closing its copy leaves the path to the new one
+	_ = ln.Close()
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	aconn, err := lns[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = aconn.Close()
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package socks
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// HandoffListeners needs linux
+func HandoffListeners(ctx context.Context, path string, conns ...syscall.Conn) error {
+	return ErrHandoffNotSupport
+}
+
+// TakeListeners needs linux
+func TakeListeners(ctx context.Context, path string) ([]net.Listener, []net.PacketConn, error) {
+	return nil, nil, ErrHandoffNotSupport
+}
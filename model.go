@@ -2,7 +2,12 @@ package socks
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
 	"net"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,6 +17,7 @@ type ServerSimplifyConfig struct {
 	SwitchCMDCONNECT      bool
 	SwitchCMDBIND         bool
 	SwitchCMDUDPASSOCIATE bool
+	SwitchHTTP            bool //HTTP CONNECT and forward proxy on the same port, with the user of Socks5Auth
 	Socks5Auth            *SimplifySocks5Auth
 	Socks4Auth            *SimplifySocks4Auth
 }
@@ -21,6 +27,7 @@ func (ssc ServerSimplifyConfig) Build() *ServerConfig {
 		VersionSwitch: VersionSwitch{
 			SwitchSocksVersion4: ssc.SwitchSocksVersion4,
 			SwitchSocksVersion5: ssc.SwitchSocksVersion5,
+			SwitchHTTP:          ssc.SwitchHTTP,
 		},
 		CMDConfig: CMDConfig{
 			SwitchCMDCONNECT:      ssc.SwitchCMDCONNECT,
@@ -66,10 +73,41 @@ type ServerConfig struct {
 
 	Socks5AuthCb S5AuthCb
 	Socks4AuthCb S4AuthCb
-	ConnTimeout  time.Duration //this is the lifetime to complete the configuration
+	ConnTimeout  time.Duration //the handshake, from accept to the granted request, must finish within it
+	IdleTimeout  time.Duration //closes a CONNECT or BIND relay without traffic in either direction
+	MaxLifetime  time.Duration //closes any session this long after accept
 	DialTimeout  time.Duration //This is the time to dial
 	BindTimeout  time.Duration //default 5s
 	UdpTimeout   time.Duration //default 30s
+	UDPFilter    *UDPFilter    //if nil, endpoint-independent and any destination
+	Ruleset      Ruleset       //if nil, every request that passed auth is allowed
+	SessionHook  SessionHook   //observes the sessions, for logging and metrics
+	TLSConfig    *tls.Config   //if set, clients speak socks over TLS
+	// TLSCertUser maps a verified client certificate to a user, who then needs no socks auth,
+	// !ok closes the connection. TLSConfig.ClientAuth must be VerifyClientCertIfGiven or RequireAndVerifyClientCert
+	TLSCertUser func(cert *x509.Certificate) (user string, ok bool)
+	// TransparentDst finds the original destination of a ServeTransparent connection,
+	// if nil, SO_ORIGINAL_DST on linux, which also covers TPROXY
+	TransparentDst func(conn net.Conn) (net.Addr, error)
+	// the outbound network of the default handlers, e.g. another proxy, a netstack or a test network.
+	// if nil, the host network. the udp socket that faces the client stays on the host
+	Dialer               Dialer               //dials the CONNECT targets
+	ListenerConfig       ListenerConfig       //listens for the BIND peer
+	PacketListenerConfig PacketListenerConfig //listens for the UDP ASSOCIATE targets
+	// SocketControl picks the SocketOptions of a session by its user, source or destination, nil for none.
+	// for UDP ASSOCIATE the destination is the one of the request, often empty
+	SocketControl func(info SessionInfo) *SocketOptions
+	// EgressPool sets the source address of the sessions, unless their SocketOptions have one
+	EgressPool *EgressPool
+	// ProxyProtocolTrusted are the balancers in front of the server, their connections must start with
+	// a PROXY protocol v1 or v2 header, whose client address the session then has. if nil, none is read
+	ProxyProtocolTrusted []*net.IPNet
+	// ProxyProtocolHeader 1 or 2 sends a PROXY header of that version on the CONNECT dials,
+	// so the targets see the client address. 0 for none
+	ProxyProtocolHeader int
+	// HalfCloseHandshake keeps dialing for a client that sent its payload and half-closed before the reply.
+	// by default its EOF ends the dial and the Ruleset like a client that went away, with it only a reset does
+	HalfCloseHandshake bool
 }
 
 type CMDConfig struct {
@@ -79,12 +117,16 @@ type CMDConfig struct {
 	CMDBINDHandler            CMDBINDHandler
 	SwitchCMDUDPASSOCIATE     bool
 	CMDCMDUDPASSOCIATEHandler CMDCMDUDPASSOCIATEHandler
+	SwitchCMDUDPOVERTCP       bool //private cmd, UDP ASSOCIATE carried on the control connection, uses CMDCMDUDPASSOCIATEHandler
 	UDPDataHandler            UDPDataHandler
+	TCPDataHandler            TCPDataHandler
 }
 
 type VersionSwitch struct {
 	SwitchSocksVersion4 bool
 	SwitchSocksVersion5 bool
+	SwitchHTTP          bool //HTTP CONNECT and forward proxy, they use CMDCONNECT and the socks5 NOAUTH/PASSWORD callbacks
+	SwitchTransparent   bool //ServeTransparent and ServeTransparentUDP, they use CMDCONNECT and CMDUDPASSOCIATE
 }
 
 type S4AuthCb struct {
@@ -187,3 +229,154 @@ type UDPDataHandler interface {
 	Encode(b []byte) ([]byte, error)
 	Decode(b []byte) ([]byte, error)
 }
+
+// UDPDataHandlerChain encodes with the handlers in order and decodes in reverse order
+func UDPDataHandlerChain(hs ...UDPDataHandler) UDPDataHandler {
+	return udpDataHandlerChain(hs)
+}
+
+type udpDataHandlerChain []UDPDataHandler
+
+func (udhc udpDataHandlerChain) Encode(b []byte) (_ []byte, err error) {
+	for _, h := range udhc {
+		b, err = h.Encode(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (udhc udpDataHandlerChain) Decode(b []byte) (_ []byte, err error) {
+	for i := len(udhc) - 1; i >= 0; i-- {
+		b, err = udhc[i].Decode(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// TCPDataHandler is the stream counterpart of UDPDataHandler, e.g. cipher.StreamWriter/cipher.StreamReader
+type TCPDataHandler interface {
+	Encode(w io.Writer) io.Writer
+	Decode(r io.Reader) io.Reader
+}
+
+// TCPDataHandlerChain encodes with the handlers in order and decodes in reverse order
+func TCPDataHandlerChain(hs ...TCPDataHandler) TCPDataHandler {
+	return tcpDataHandlerChain(hs)
+}
+
+type tcpDataHandlerChain []TCPDataHandler
+
+func (tdhc tcpDataHandlerChain) Encode(w io.Writer) io.Writer {
+	for i := len(tdhc) - 1; i >= 0; i-- {
+		w = tdhc[i].Encode(w)
+	}
+	return w
+}
+
+func (tdhc tcpDataHandlerChain) Decode(r io.Reader) io.Reader {
+	for i := len(tdhc) - 1; i >= 0; i-- {
+		r = tdhc[i].Decode(r)
+	}
+	return r
+}
+
+// DomainAddr is a socks5 DOMAINNAME (ATYP 0x03) address, it is carried as is and never resolved by the client
+type DomainAddr struct {
+	Net  string
+	Host string
+	Port int
+}
+
+func (da *DomainAddr) Network() string {
+	if da.Net == "" {
+		return "udp"
+	}
+	return da.Net
+}
+
+func (da *DomainAddr) String() string {
+	return net.JoinHostPort(da.Host, strconv.Itoa(da.Port))
+}
+
+// UDPNATMode is the filtering behavior applied to replies of UDP ASSOCIATE (rfc4787)
+type UDPNATMode byte
+
+const (
+	UDPNATEndpointIndependent      UDPNATMode = iota //forward replies from any address (full-cone)
+	UDPNATAddressRestricted                          //forward replies only from ips the client has sent to
+	UDPNATAddressAndPortRestricted                   //forward replies only from ip:port the client has sent to
+)
+
+// UDPFilter
+//
+//	empty AllowPorts/AllowCIDRs allow any destination;
+//	the same filter can be shared by many servers, the counters are aggregated
+type UDPFilter struct {
+	droppedNAT  uint64
+	droppedDest uint64
+
+	NATMode    UDPNATMode
+	AllowPorts []uint16
+	AllowCIDRs []*net.IPNet
+}
+
+// DroppedNAT is the number of replies dropped by NATMode
+func (uf *UDPFilter) DroppedNAT() uint64 {
+	return atomic.LoadUint64(&uf.droppedNAT)
+}
+
+// DroppedDest is the number of datagrams dropped because the destination is not allowed
+func (uf *UDPFilter) DroppedDest() uint64 {
+	return atomic.LoadUint64(&uf.droppedDest)
+}
+
+func (uf *UDPFilter) allowDest(addr *net.UDPAddr) bool {
+	if uf == nil {
+		return true
+	}
+	ok := len(uf.AllowPorts) == 0
+	for _, port := range uf.AllowPorts {
+		if int(port) == addr.Port {
+			ok = true
+			break
+		}
+	}
+	if ok && len(uf.AllowCIDRs) != 0 {
+		ok = false
+		for _, ipNet := range uf.AllowCIDRs {
+			if ipNet.Contains(addr.IP) {
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		atomic.AddUint64(&uf.droppedDest, 1)
+	}
+	return ok
+}
+
+func (uf *UDPFilter) natKey(addr net.Addr) string {
+	if uf == nil {
+		return ""
+	}
+	switch uf.NATMode {
+	case UDPNATAddressRestricted:
+		if ip := getAddrIP(addr); ip != nil {
+			return ip.String()
+		}
+		return addr.String()
+	case UDPNATAddressAndPortRestricted:
+		return addr.String()
+	default:
+		return ""
+	}
+}
+
+func (uf *UDPFilter) dropNAT() {
+	atomic.AddUint64(&uf.droppedNAT, 1)
+}
@@ -0,0 +1,649 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a mux session starts with relayMuxMagic and muxVersion, then carries frames of
+//
+//	VER CMD LEN(2) SID(4) DATA
+//
+// streams opened by the client have odd ids. both ends announce their StreamWindow with muxCMDWND first,
+// a stream may have the StreamWindow of the reader in flight, which returns credit with muxCMDUPD once
+// it consumed half of it. muxCMDFIN ends one direction like CloseWrite, muxCMDRST the whole stream
+const (
+	relayMuxMagic = 0xfd
+	muxVersion    = 0x01
+)
+
+const (
+	muxCMDSYN  = iota //open a stream
+	muxCMDFIN         //no more data from the sender
+	muxCMDPSH         //data
+	muxCMDUPD         //window update, DATA is the returned credit as uint32
+	muxCMDPING        //keepalive
+	muxCMDPONG        //keepalive reply
+	muxCMDWND         //the StreamWindow of the sender as uint32, once per session on id 0
+	muxCMDRST         //close a stream
+)
+
+const (
+	muxHeaderLen    = 8
+	muxMaxFrameSize = 32 * 1024
+)
+
+var ErrMuxSessionClosed = errors.New("mux session closed")
+
+type MuxConfig struct {
+	KeepAliveInterval time.Duration //default 10s
+	KeepAliveTimeout  time.Duration //default 30s, the session is closed when nothing arrived for this long
+	StreamWindow      uint32        //default 256KiB
+}
+
+func (mc *MuxConfig) build() MuxConfig {
+	cfg := MuxConfig{
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveTimeout:  30 * time.Second,
+		StreamWindow:      256 * 1024,
+	}
+	if mc == nil {
+		return cfg
+	}
+	if mc.KeepAliveInterval != 0 {
+		cfg.KeepAliveInterval = mc.KeepAliveInterval
+	}
+	if mc.KeepAliveTimeout != 0 {
+		cfg.KeepAliveTimeout = mc.KeepAliveTimeout
+	}
+	if mc.StreamWindow != 0 {
+		cfg.StreamWindow = mc.StreamWindow
+	}
+	return cfg
+}
+
+// RelayMuxPool keeps up to size mux sessions to a relay and opens a stream per request,
+// its Dial fits the cb of RelayCMDCONNECTHandler, RelayCMDBINDHandler and RelayCMDCMDUDPASSOCIATE
+type RelayMuxPool struct {
+	cb   func(ctx context.Context) (net.Conn, error)
+	size int
+	cfg  MuxConfig
+
+	mux      sync.Mutex
+	sessions []*muxSession
+	next     int
+	closed   bool
+}
+
+// NewRelayMuxPool dials the sessions with cb lazily, cfg may be nil
+func NewRelayMuxPool(cb func(ctx context.Context) (net.Conn, error), size int, cfg *MuxConfig) *RelayMuxPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &RelayMuxPool{
+		cb:   cb,
+		size: size,
+		cfg:  cfg.build(),
+	}
+}
+
+func (rmp *RelayMuxPool) Dial(ctx context.Context) (net.Conn, error) {
+	sess, err := rmp.session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sess.open(ctx)
+}
+
+func (rmp *RelayMuxPool) Close() error {
+	rmp.mux.Lock()
+	defer rmp.mux.Unlock()
+	rmp.closed = true
+	for _, sess := range rmp.sessions {
+		_ = sess.Close()
+	}
+	rmp.sessions = nil
+	return nil
+}
+
+func (rmp *RelayMuxPool) session(ctx context.Context) (*muxSession, error) {
+	rmp.mux.Lock()
+	defer rmp.mux.Unlock()
+	if rmp.closed {
+		return nil, ErrMuxSessionClosed
+	}
+	alive := rmp.sessions[:0]
+	for _, sess := range rmp.sessions {
+		if !sess.isClosed() {
+			alive = append(alive, sess)
+		}
+	}
+	rmp.sessions = alive
+	if len(rmp.sessions) >= rmp.size {
+		rmp.next = (rmp.next + 1) % len(rmp.sessions)
+		return rmp.sessions[rmp.next], nil
+	}
+	//dialing under the lock keeps concurrent callers from overfilling the pool
+	conn, err := rmp.cb(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write([]byte{relayMuxMagic, muxVersion})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	sess := newMuxSession(conn, true, rmp.cfg)
+	rmp.sessions = append(rmp.sessions, sess)
+	return sess, nil
+}
+
+// relayServeMux serves every stream of a session like a connection of its own
+func relayServeMux(ctx context.Context, rwc io.ReadWriteCloser, cfg *RelayConfig) error {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(rwc, b)
+	if err != nil {
+		return err
+	}
+	if b[0] != muxVersion {
+		return ErrRelayVersionNotSupport
+	}
+	sess := newMuxSession(rwc, false, cfg.Mux.build())
+	defer sess.Close()
+	for {
+		stream, err := sess.accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			_ = relayServe(ctx, stream, cfg, false)
+		}()
+	}
+}
+
+type muxSession struct {
+	conn   io.ReadWriteCloser
+	client bool
+	cfg    MuxConfig
+	laddr  net.Addr
+	raddr  net.Addr
+
+	mux        sync.Mutex
+	streams    map[uint32]*muxStream
+	nextId     uint32
+	peerWindow int64 //the StreamWindow of the peer, 0 until its muxCMDWND
+
+	wmux     sync.Mutex
+	acceptCh chan *muxStream
+	lastRecv atomic.Int64
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func newMuxSession(conn io.ReadWriteCloser, client bool, cfg MuxConfig) *muxSession {
+	ms := &muxSession{
+		conn:     conn,
+		client:   client,
+		cfg:      cfg,
+		laddr:    &net.UnixAddr{Name: "mux", Net: "mux"},
+		raddr:    &net.UnixAddr{Name: "mux", Net: "mux"},
+		streams:  make(map[uint32]*muxStream),
+		acceptCh: make(chan *muxStream, 64),
+		die:      make(chan struct{}),
+	}
+	if c, ok := conn.(net.Conn); ok {
+		ms.laddr, ms.raddr = c.LocalAddr(), c.RemoteAddr()
+	}
+	if client {
+		ms.nextId = 1
+	} else {
+		ms.nextId = 2
+	}
+	ms.lastRecv.Store(time.Now().UnixNano())
+	go ms.recvLoop()
+	go ms.keepAlive()
+	go func() {
+		_ = ms.writeFrame(muxCMDWND, 0, binary.BigEndian.AppendUint32(nil, cfg.StreamWindow))
+	}()
+	return ms
+}
+
+func (ms *muxSession) Close() error {
+	ms.dieOnce.Do(func() {
+		close(ms.die)
+		_ = ms.conn.Close()
+	})
+	return nil
+}
+
+func (ms *muxSession) isClosed() bool {
+	select {
+	case <-ms.die:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ms *muxSession) open(ctx context.Context) (*muxStream, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ms.mux.Lock()
+	if ms.isClosed() {
+		ms.mux.Unlock()
+		return nil, ErrMuxSessionClosed
+	}
+	id := ms.nextId
+	ms.nextId += 2
+	stream := newMuxStream(id, ms)
+	ms.streams[id] = stream
+	ms.mux.Unlock()
+	if ctx.Done() == nil {
+		err := ms.writeFrame(muxCMDSYN, id, nil)
+		if err != nil {
+			ms.remove(id)
+			return nil, err
+		}
+		return stream, nil
+	}
+	// the SYN may wait behind other frames of a stalled session, ctx bounds the wait
+	done := make(chan error, 1)
+	go func() {
+		done <- ms.writeFrame(muxCMDSYN, id, nil)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			ms.remove(id)
+			return nil, err
+		}
+		return stream, nil
+	case <-ctx.Done():
+		go func() {
+			if <-done == nil {
+				_ = stream.Close()
+			} else {
+				ms.remove(id)
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (ms *muxSession) accept() (*muxStream, error) {
+	select {
+	case stream := <-ms.acceptCh:
+		return stream, nil
+	case <-ms.die:
+		return nil, ErrMuxSessionClosed
+	}
+}
+
+func (ms *muxSession) remove(id uint32) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	delete(ms.streams, id)
+}
+
+func (ms *muxSession) writeFrame(cmd byte, id uint32, data []byte) error {
+	b := make([]byte, muxHeaderLen+len(data))
+	b[0], b[1] = muxVersion, cmd
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(data)))
+	binary.BigEndian.PutUint32(b[4:8], id)
+	copy(b[muxHeaderLen:], data)
+	ms.wmux.Lock()
+	defer ms.wmux.Unlock()
+	if ms.isClosed() {
+		return ErrMuxSessionClosed
+	}
+	_, err := ms.conn.Write(b)
+	if err != nil {
+		_ = ms.Close()
+	}
+	return err
+}
+
+func (ms *muxSession) recvLoop() {
+	defer ms.Close()
+	hdr := make([]byte, muxHeaderLen)
+	for {
+		_, err := io.ReadFull(ms.conn, hdr)
+		if err != nil {
+			return
+		}
+		if hdr[0] != muxVersion {
+			return
+		}
+		cmd, id := hdr[1], binary.BigEndian.Uint32(hdr[4:8])
+		data := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+		_, err = io.ReadFull(ms.conn, data)
+		if err != nil {
+			return
+		}
+		ms.lastRecv.Store(time.Now().UnixNano())
+		ms.mux.Lock()
+		stream := ms.streams[id]
+		ms.mux.Unlock()
+		switch cmd {
+		case muxCMDSYN:
+			if ms.client || stream != nil || id%2 != 1 {
+				return
+			}
+			ms.mux.Lock()
+			stream = newMuxStream(id, ms)
+			ms.streams[id] = stream
+			ms.mux.Unlock()
+			select {
+			case ms.acceptCh <- stream:
+			case <-ms.die:
+				return
+			}
+		case muxCMDFIN:
+			if stream != nil {
+				stream.remoteFin()
+			}
+		case muxCMDRST:
+			if stream != nil {
+				stream.remoteReset()
+			}
+		case muxCMDPSH:
+			if stream != nil && !stream.push(data) {
+				return
+			}
+		case muxCMDUPD:
+			if len(data) != 4 {
+				return
+			}
+			if stream != nil {
+				stream.addWindow(binary.BigEndian.Uint32(data))
+			}
+		case muxCMDWND:
+			if len(data) != 4 || !ms.setPeerWindow(binary.BigEndian.Uint32(data)) {
+				return
+			}
+		case muxCMDPING:
+			go func() {
+				_ = ms.writeFrame(muxCMDPONG, 0, nil)
+			}()
+		case muxCMDPONG:
+		default:
+			return
+		}
+	}
+}
+
+// setPeerWindow gives the streams the window of the peer, the streams opened before waited for it
+func (ms *muxSession) setPeerWindow(n uint32) bool {
+	ms.mux.Lock()
+	if n == 0 || ms.peerWindow != 0 {
+		ms.mux.Unlock()
+		return false
+	}
+	ms.peerWindow = int64(n)
+	streams := make([]*muxStream, 0, len(ms.streams))
+	for _, stream := range ms.streams {
+		streams = append(streams, stream)
+	}
+	ms.mux.Unlock()
+	for _, stream := range streams {
+		stream.addWindow(n)
+	}
+	return true
+}
+
+func (ms *muxSession) keepAlive() {
+	tk := time.NewTicker(ms.cfg.KeepAliveInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-ms.die:
+			return
+		case <-tk.C:
+			if time.Since(time.Unix(0, ms.lastRecv.Load())) > ms.cfg.KeepAliveTimeout {
+				_ = ms.Close()
+				return
+			}
+			_ = ms.writeFrame(muxCMDPING, 0, nil)
+		}
+	}
+}
+
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mux      sync.Mutex
+	buf      bytes.Buffer
+	consumed uint32
+	rfin     bool //the peer sent all
+	wfin     bool //CloseWrite
+	reset    bool //the peer closed the stream
+	readEv   chan struct{}
+
+	window   atomic.Int64
+	windowEv chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	rdeadline atomic.Value
+	wdeadline atomic.Value
+}
+
+// newMuxStream is called with sess.mux held
+func newMuxStream(id uint32, sess *muxSession) *muxStream {
+	stream := &muxStream{
+		id:       id,
+		sess:     sess,
+		readEv:   make(chan struct{}, 1),
+		windowEv: make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	stream.window.Store(sess.peerWindow)
+	stream.rdeadline.Store(time.Time{})
+	stream.wdeadline.Store(time.Time{})
+	return stream
+}
+
+func (stream *muxStream) Read(p []byte) (n int, err error) {
+	for {
+		stream.mux.Lock()
+		if stream.buf.Len() > 0 {
+			n, _ = stream.buf.Read(p)
+			stream.consumed += uint32(n)
+			var credit uint32
+			if stream.consumed >= stream.sess.cfg.StreamWindow/2 {
+				credit, stream.consumed = stream.consumed, 0
+			}
+			stream.mux.Unlock()
+			if credit != 0 {
+				_ = stream.sess.writeFrame(muxCMDUPD, stream.id, binary.BigEndian.AppendUint32(nil, credit))
+			}
+			return n, nil
+		}
+		eof := stream.rfin || stream.reset
+		stream.mux.Unlock()
+		if eof {
+			return 0, io.EOF
+		}
+		if stream.isClosed() || stream.sess.isClosed() {
+			return 0, io.ErrClosedPipe
+		}
+		if len(p) == 0 {
+			return 0, nil
+		}
+		timer, err := deadlineTimer(stream.rdeadline.Load().(time.Time))
+		if err != nil {
+			return 0, err
+		}
+		select {
+		case <-stream.readEv:
+		case <-stream.closed:
+		case <-stream.sess.die:
+		case <-timer:
+		}
+	}
+}
+
+func (stream *muxStream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		stream.mux.Lock()
+		done := stream.wfin || stream.reset
+		stream.mux.Unlock()
+		if done || stream.isClosed() {
+			return n, io.ErrClosedPipe
+		}
+		if stream.sess.isClosed() {
+			return n, ErrMuxSessionClosed
+		}
+		window := stream.window.Load()
+		if window <= 0 {
+			timer, err := deadlineTimer(stream.wdeadline.Load().(time.Time))
+			if err != nil {
+				return n, err
+			}
+			select {
+			case <-stream.windowEv:
+			case <-stream.closed:
+			case <-stream.sess.die:
+			case <-timer:
+			}
+			continue
+		}
+		size := len(p)
+		if int64(size) > window {
+			size = int(window)
+		}
+		if size > muxMaxFrameSize {
+			size = muxMaxFrameSize
+		}
+		// concurrent writers must not spend the same window
+		if !stream.window.CompareAndSwap(window, window-int64(size)) {
+			continue
+		}
+		err = stream.sess.writeFrame(muxCMDPSH, stream.id, p[:size])
+		if err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// CloseWrite tells the peer that no more data comes, it can still answer
+func (stream *muxStream) CloseWrite() error {
+	stream.mux.Lock()
+	if stream.wfin || stream.isClosed() {
+		stream.mux.Unlock()
+		return nil
+	}
+	stream.wfin = true
+	stream.mux.Unlock()
+	notify(stream.windowEv)
+	return stream.sess.writeFrame(muxCMDFIN, stream.id, nil)
+}
+
+func (stream *muxStream) Close() error {
+	stream.closeOnce.Do(func() {
+		close(stream.closed)
+		stream.sess.remove(stream.id)
+		_ = stream.sess.writeFrame(muxCMDRST, stream.id, nil)
+	})
+	return nil
+}
+
+func (stream *muxStream) isClosed() bool {
+	select {
+	case <-stream.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// push returns false if the peer overran the window
+func (stream *muxStream) push(data []byte) bool {
+	stream.mux.Lock()
+	defer stream.mux.Unlock()
+	if uint32(stream.buf.Len()+len(data)) > stream.sess.cfg.StreamWindow {
+		return false
+	}
+	stream.buf.Write(data)
+	notify(stream.readEv)
+	return true
+}
+
+func (stream *muxStream) remoteFin() {
+	stream.mux.Lock()
+	stream.rfin = true
+	stream.mux.Unlock()
+	notify(stream.readEv)
+}
+
+func (stream *muxStream) remoteReset() {
+	stream.mux.Lock()
+	stream.reset = true
+	stream.mux.Unlock()
+	notify(stream.readEv)
+	notify(stream.windowEv)
+}
+
+func (stream *muxStream) addWindow(n uint32) {
+	stream.window.Add(int64(n))
+	notify(stream.windowEv)
+}
+
+func (stream *muxStream) LocalAddr() net.Addr {
+	return stream.sess.laddr
+}
+
+func (stream *muxStream) RemoteAddr() net.Addr {
+	return stream.sess.raddr
+}
+
+func (stream *muxStream) SetDeadline(t time.Time) error {
+	_ = stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+func (stream *muxStream) SetReadDeadline(t time.Time) error {
+	stream.rdeadline.Store(t)
+	notify(stream.readEv)
+	return nil
+}
+
+func (stream *muxStream) SetWriteDeadline(t time.Time) error {
+	stream.wdeadline.Store(t)
+	notify(stream.windowEv)
+	return nil
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// deadlineTimer returns a channel firing at t, nil for no deadline and an error if t passed
+func deadlineTimer(t time.Time) (<-chan time.Time, error) {
+	if t.IsZero() {
+		return nil, nil
+	}
+	d := time.Until(t)
+	if d <= 0 {
+		return nil, os.ErrDeadlineExceeded
+	}
+	return time.After(d), nil
+}
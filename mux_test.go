@@ -0,0 +1,282 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testMuxPair(t *testing.T, cfg MuxConfig) (*muxSession, *muxSession) {
+	c1, c2 := net.Pipe()
+	client := newMuxSession(c1, true, cfg)
+	server := newMuxSession(c2, false, cfg)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	cfg := (&MuxConfig{StreamWindow: 4096}).build()
+	client, server := testMuxPair(t, cfg)
+	data := []byte(newData(1024 * 1024))
+	go func() {
+		stream, err := server.accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		_, _ = io.Copy(stream, stream)
+	}()
+	stream, err := client.open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	go func() {
+		_, _ = stream.Write(data)
+	}()
+	buf := make([]byte, len(data))
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(stream, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("test failed")
+	}
+	// the peer never had more than a window buffered
+	if w := stream.window.Load(); w < 0 || w > int64(cfg.StreamWindow) {
+		t.Fatalf("window out of range: %d", w)
+	}
+}
+
+func TestMuxWindowPeers(t *testing.T) {
+	// peers with different windows and concurrent writers on one stream
+	c1, c2 := net.Pipe()
+	client := newMuxSession(c1, true, (&MuxConfig{StreamWindow: 64 * 1024}).build())
+	server := newMuxSession(c2, false, (&MuxConfig{StreamWindow: 4096}).build())
+	defer client.Close()
+	defer server.Close()
+	const writers, size = 8, 32 * 1024
+	got := make(chan []byte, 1)
+	go func() {
+		stream, err := server.accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		buf := make([]byte, writers*size)
+		_, _ = io.ReadFull(stream, buf)
+		got <- buf
+		_, _ = stream.Write(buf)
+	}()
+	stream, err := client.open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _ = stream.Write(bytes.Repeat([]byte{byte(i)}, size))
+		}(i)
+	}
+	wg.Wait()
+	select {
+	case buf := <-got:
+		if len(buf) != writers*size {
+			t.Fatal("short read")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream stalled, sessions closed: %v %v", client.isClosed(), server.isClosed())
+	}
+	buf := make([]byte, writers*size)
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(stream, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxHalfClose(t *testing.T) {
+	client, server := testMuxPair(t, (&MuxConfig{}).build())
+	go func() {
+		stream, err := server.accept()
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+		// answer once the request ended
+		b, _ := io.ReadAll(stream)
+		_, _ = stream.Write(b)
+		_, _ = stream.Write(b)
+	}()
+	stream, err := client.open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	data := newData(4096)
+	_, err = stream.Write([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Write([]byte(data)); err == nil {
+		t.Fatal("write after CloseWrite")
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(3 * time.Second))
+	b, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != data+data {
+		t.Fatalf("response cut after %d bytes", len(b))
+	}
+}
+
+func TestMuxKeepAlive(t *testing.T) {
+	cfg := (&MuxConfig{KeepAliveInterval: 20 * time.Millisecond, KeepAliveTimeout: 100 * time.Millisecond}).build()
+	client, server := testMuxPair(t, cfg)
+	time.Sleep(300 * time.Millisecond)
+	// pings keep both alive
+	if client.isClosed() || server.isClosed() {
+		t.Fatal("session closed despite keepalive")
+	}
+
+	// a peer that stops answering is dropped
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, c2)
+	}()
+	lonely := newMuxSession(c1, true, cfg)
+	select {
+	case <-lonely.die:
+	case <-time.After(3 * time.Second):
+		t.Fatal("silent peer kept the session")
+	}
+}
+
+func TestRelayMux(t *testing.T) {
+	var sessions atomic.Int32
+	relay := testRelayServer(t)
+	defer relay.Close()
+	pool := NewRelayMuxPool(func(ctx context.Context) (net.Conn, error) {
+		sessions.Add(1)
+		dr := net.Dialer{}
+		return dr.DialContext(ctx, relay.Addr().Network(), relay.Addr().String())
+	}, 2, nil)
+	defer pool.Close()
+
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+	}
+	cfg.CMDConfig.CMDCONNECTHandler = RelayCMDCONNECTHandler(pool.Dial)
+	cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler = RelayCMDCMDUDPASSOCIATE(pool.Dial)
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	auth := &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}
+	dr, err := SOCKS5CONNECT(listen.Addr().Network(), listen.Addr().String(), auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := testListen(t)
+	defer ln.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			for j := 0; j < 3; j++ {
+				testConn(t, conn, newData(64*1024))
+			}
+		}()
+	}
+	wg.Wait()
+
+	pConn := testLPConn(t)
+	defer pConn.Close()
+	ucfg, err := SOCKS5UDPASSOCIATE(listen.Addr().Network(), listen.Addr().String(), auth, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pConn2, err := ucfg.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pConn2.Close()
+	_ = pConn2.SetReadDeadline(time.Now().Add(3 * time.Second))
+	testPConn(t, pConn2, pConn.LocalAddr(), newData(4096))
+
+	if n := sessions.Load(); n != 2 {
+		t.Fatalf("want 2 sessions, dialed %d", n)
+	}
+}
+
+func FuzzMuxSession(f *testing.F) {
+	f.Add([]byte{muxVersion, muxCMDSYN, 0, 0, 0, 0, 0, 1, muxVersion, muxCMDPSH, 0, 2, 0, 0, 0, 1, 'h', 'i'})
+	f.Add([]byte{muxVersion, muxCMDUPD, 0, 4, 0, 0, 0, 1, 0, 0, 0x10, 0, muxVersion, muxCMDFIN, 0, 0, 0, 0, 0, 1})
+	f.Add([]byte{muxVersion, muxCMDPING, 0, 0, 0, 0, 0, 0})
+	f.Add([]byte{muxVersion, muxCMDWND, 0, 4, 0, 0, 0, 0, 0, 0, 0x10, 0, muxVersion, muxCMDRST, 0, 0, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c1, c2 := net.Pipe()
+		sess := newMuxSession(c2, false, (&MuxConfig{StreamWindow: 16}).build())
+		go func() {
+			for {
+				stream, err := sess.accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					_, _ = io.Copy(io.Discard, stream)
+				}()
+			}
+		}()
+		go func() {
+			_, _ = io.Copy(io.Discard, c1)
+		}()
+		_, _ = c1.Write(b)
+		_ = c1.Close()
+		select {
+		case <-sess.die:
+		case <-time.After(fuzzSessionTimeout):
+			t.Fatalf("mux session hangs on %x", b)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const pipeBufferSize = 32 * 1024
+
+var pipeBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, pipeBufferSize)
+		return &b
+	},
+}
+
+var errNoHalfClose = errors.New("half-close not support")
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe relays between a and b until both directions are done. the end of one direction is
+// passed on with CloseWrite, so the other one keeps going, a side that cannot half-close or
+// an error ends both. with splice, two tcp connections are relayed by the kernel on linux,
+// the counters then move once per direction, so a session that needs every read leaves it off
+func pipe(a, b io.ReadWriteCloser, splice bool) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- pipeOne(a, b, splice)
+	}()
+	err := pipeOne(b, a, splice)
+	err2 := <-errc
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+// pipeOne copies src to dst and closes the write side of dst once src is done
+func pipeOne(dst, src io.ReadWriteCloser, splice bool) error {
+	var err error
+	ok := false
+	if splice {
+		ok, err = spliceTCP(dst, src)
+	}
+	if !ok {
+		err = copyBuffer(dst, src)
+	}
+	if err != nil || !closeWrite(dst) {
+		_ = dst.Close()
+		_ = src.Close()
+	}
+	if errors.Is(err, net.ErrClosed) {
+		// the other direction ended both
+		return nil
+	}
+	return err
+}
+
+func copyBuffer(dst io.Writer, src io.Reader) error {
+	bp := pipeBufferPool.Get().(*[]byte)
+	defer pipeBufferPool.Put(bp)
+	buf := *bp
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			_, werr := dst.Write(buf[:n])
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func closeWrite(c io.ReadWriteCloser) bool {
+	return closeWriteOf(c) == nil
+}
+
+// closeWriteOf half-closes c, wrappers pass it on to what they wrap
+func closeWriteOf(c any) error {
+	if cw, ok := c.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+// spliceTCP lets *net.TCPConn.ReadFrom copy, which splices on linux, if both sides are tcp
+func spliceTCP(dst, src io.ReadWriteCloser) (bool, error) {
+	d, dcount := pipeTCP(dst, false)
+	s, scount := pipeTCP(src, true)
+	if d == nil || s == nil {
+		return false, nil
+	}
+	n, err := d.ReadFrom(s)
+	dcount(n)
+	scount(n)
+	return true, err
+}
+
+// pipeTCP returns the tcp connection of c and the counter of its session for the direction
+func pipeTCP(c io.ReadWriteCloser, read bool) (*net.TCPConn, func(n int64)) {
+	switch x := c.(type) {
+	case *net.TCPConn:
+		return x, func(n int64) {}
+	case *countConn:
+		conn := x.Conn
+		if pc, ok := conn.(*proxyConn); ok {
+			conn = pc.Conn
+		}
+		tc, ok := conn.(*net.TCPConn)
+		if !ok {
+			return nil, nil
+		}
+		counter := &x.sess.out
+		if read {
+			counter = &x.sess.in
+		}
+		return tc, func(n int64) {
+			x.sess.add(counter, n)
+		}
+	case *countReadWriteCloser:
+		tc, ok := x.ReadWriteCloser.(*net.TCPConn)
+		if !ok {
+			return nil, nil
+		}
+		counter := &x.sess.out
+		if read {
+			counter = &x.sess.in
+		}
+		return tc, func(n int64) {
+			x.sess.add(counter, n)
+		}
+	default:
+		return nil, nil
+	}
+}
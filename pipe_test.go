@@ -0,0 +1,146 @@
+package socks
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHalfClose(t *testing.T) {
+	// the target answers once the client is done sending
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				b, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(b)
+			}()
+		}
+	}()
+	for _, idle := range []bool{false, true} {
+		cfg := &ServerConfig{
+			VersionSwitch: DefaultSocksVersionSwitch,
+			CMDConfig:     DefaultSocksCMDConfig,
+			Socks5AuthCb: S5AuthCb{
+				Socks5AuthNOAUTH: DefaultAuthConnCb,
+			},
+		}
+		if idle {
+			// without splice
+			cfg.IdleTimeout = 5e9
+		}
+		listen := testServer(t, cfg)
+		dr, err := SOCKS5CONNECTP(listen.Addr().Network(), listen.Addr().String(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := newData(256 * 1024)
+		_, err = conn.Write([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cw, ok := conn.(closeWriter)
+		if !ok {
+			t.Fatal("test failed")
+		}
+		err = cw.CloseWrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != data {
+			t.Fatal("test failed")
+		}
+		_ = conn.Close()
+	}
+}
+
+func benchmarkPipe(b *testing.B, relay func(a, b net.Conn)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	// client <-> (a relay b) <-> sink
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	go func() {
+		conn, err := sink.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	go func() {
+		a, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		c, err := net.Dial("tcp", sink.Addr().String())
+		if err != nil {
+			_ = a.Close()
+			return
+		}
+		relay(a, c)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, pipeBufferSize)
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err = conn.Write(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPipe(b *testing.B) {
+	benchmarkPipe(b, func(x, y net.Conn) {
+		_ = pipe(x, y, false)
+	})
+}
+
+func BenchmarkPipeSplice(b *testing.B) {
+	benchmarkPipe(b, func(x, y net.Conn) {
+		_ = pipe(x, y, true)
+	})
+}
+
+// BenchmarkIoCopy is the relay before pipe
+func BenchmarkIoCopy(b *testing.B) {
+	benchmarkPipe(b, func(x, y net.Conn) {
+		defer x.Close()
+		defer y.Close()
+		go io.Copy(x, y)
+		_, _ = io.Copy(y, x)
+	})
+}
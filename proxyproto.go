@@ -0,0 +1,225 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// the HAProxy PROXY protocol, a balancer in front of the server tells the client address with it,
+// see ServerConfig.ProxyProtocolTrusted, and the server tells it the targets, see ServerConfig.ProxyProtocolHeader
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLen    = 107
+	proxyV2HeaderLen = 16
+	proxyV2Ver       = 0x20
+	proxyV2CmdLocal  = 0x00
+	proxyV2CmdProxy  = 0x01
+	proxyV2FamInet   = 0x10
+	proxyV2FamInet6  = 0x20
+	proxyV2Stream    = 0x01
+	proxyV2Dgram     = 0x02
+	proxyV2Inet4Len  = 12
+	proxyV2Inet6Len  = 36
+)
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection that came through a balancer, its addresses are the ones of the header
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *proxyConn) CloseWrite() error {
+	return closeWriteOf(c.Conn)
+}
+
+// isProxyTrusted tells if addr may send a PROXY header
+func isProxyTrusted(addr net.Addr, trusted []*net.IPNet) bool {
+	ip := getAddrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptProxyHeader reads the PROXY header conn starts with, the conn it returns has the addresses of the
+// client and what it connected to, or those of conn for a health check of the balancer
+func acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReaderSize(conn, proxyV2HeaderLen+proxyV2Inet6Len)
+	src, dst, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	conn = unreadConn(conn, reader)
+	if src == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remote: src, local: dst}, nil
+}
+
+// readProxyHeader reads a v1 or v2 header, the addresses are nil if it has none
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(b, proxyV2Sig) {
+		return readProxyV2Header(r)
+	}
+	if string(b[:len(proxyV1Prefix)]) == proxyV1Prefix {
+		return readProxyV1Header(r)
+	}
+	return nil, nil, ErrProxyProtocolInvalid
+}
+
+func readProxyV1Header(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == proxyV1MaxLen {
+			return nil, nil, ErrProxyProtocolInvalid
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, ErrProxyProtocolInvalid
+	}
+	fields := strings.Split(s, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrProxyProtocolInvalid
+	}
+	src, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyV1Addr(proto string, host string, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != (proto == "TCP4") {
+		return nil, ErrProxyProtocolInvalid
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, ErrProxyProtocolInvalid
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	b := make([]byte, proxyV2HeaderLen)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if b[12]&0xf0 != proxyV2Ver {
+		return nil, nil, ErrProxyProtocolInvalid
+	}
+	cmd, fam := b[12]&0x0f, b[13]
+	body := make([]byte, binary.BigEndian.Uint16(b[14:16]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch cmd {
+	case proxyV2CmdLocal:
+		return nil, nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, nil, ErrProxyProtocolInvalid
+	}
+	var ipLen int
+	switch fam & 0xf0 {
+	case proxyV2FamInet:
+		ipLen = net.IPv4len
+	case proxyV2FamInet6:
+		ipLen = net.IPv6len
+	default:
+		// unspec or unix, nothing to tell
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, ErrProxyProtocolInvalid
+	}
+	srcIP := net.IP(append([]byte{}, body[:ipLen]...))
+	dstIP := net.IP(append([]byte{}, body[ipLen:2*ipLen]...))
+	srcPort := int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+	if fam&0x0f == proxyV2Dgram {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+// marshalProxyHeader makes a header of version 1 or 2 for a stream from src to dst,
+// addresses of different or unknown families make an UNKNOWN or LOCAL one
+func marshalProxyHeader(version int, src net.Addr, dst net.Addr) []byte {
+	srcIP, dstIP := getAddrIP(src), getAddrIP(dst)
+	srcPort, _ := strconv.Atoi(getAddrPort(src))
+	dstPort, _ := strconv.Atoi(getAddrPort(dst))
+	ipv4 := srcIP.To4() != nil && dstIP.To4() != nil
+	known := srcIP != nil && dstIP != nil && (ipv4 || (srcIP.To4() == nil && dstIP.To4() == nil))
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, srcPort, dstPort))
+	}
+	b := append([]byte{}, proxyV2Sig...)
+	if !known {
+		return append(b, proxyV2Ver|proxyV2CmdLocal, 0, 0, 0)
+	}
+	fam, ipLen := byte(proxyV2FamInet6), net.IPv6len
+	if ipv4 {
+		fam, ipLen, srcIP, dstIP = proxyV2FamInet, net.IPv4len, srcIP.To4(), dstIP.To4()
+	} else {
+		srcIP, dstIP = srcIP.To16(), dstIP.To16()
+	}
+	b = append(b, proxyV2Ver|proxyV2CmdProxy, fam|proxyV2Stream)
+	b = binary.BigEndian.AppendUint16(b, uint16(2*ipLen+4))
+	b = append(b, srcIP...)
+	b = append(b, dstIP...)
+	b = binary.BigEndian.AppendUint16(b, uint16(srcPort))
+	return binary.BigEndian.AppendUint16(b, uint16(dstPort))
+}
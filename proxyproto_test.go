@@ -0,0 +1,144 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4src := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 4242}
+	v4dst := &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 1080}
+	v6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 4242}
+	v6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080}
+	for _, version := range []int{1, 2} {
+		for _, addrs := range [][2]net.Addr{{v4src, v4dst}, {v6src, v6dst}, {v4src, v6dst}} {
+			b := marshalProxyHeader(version, addrs[0], addrs[1])
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(b), bytes.NewReader([]byte("data"))))
+			src, dst, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatal(version, err)
+			}
+			if addrs[0] == v4src && addrs[1] == v6dst {
+				// mixed families say nothing
+				if src != nil || dst != nil {
+					t.Fatalf("v%d: unexpected addresses: %v %v", version, src, dst)
+				}
+			} else if src.String() != addrs[0].String() || dst.String() != addrs[1].String() {
+				t.Fatalf("v%d: unexpected addresses: %v %v", version, src, dst)
+			}
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "data" {
+				t.Fatalf("v%d: unexpected data: %q", version, rest)
+			}
+		}
+	}
+	for _, s := range []string{
+		"\x05\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		"PROXY TCP4 203.0.113.7 198.51.100.1 4242\r\n",
+		"PROXY TCP4 2001:db8::7 2001:db8::1 4242 1080\r\n",
+		"PROXY TCP4 203.0.113.7 198.51.100.1 4242 65536\r\n",
+		"PROXY TCP4 203.0.113.7 198.51.100.1 4242 1080\n",
+		"PROXY TCP4 " + string(bytes.Repeat([]byte{'1'}, proxyV1MaxLen)) + "\r\n",
+		string(proxyV2Sig) + "\x21\x11\x00\x04\x00\x00\x00\x00",
+		string(proxyV2Sig) + "\x11\x11\x00\x00",
+	} {
+		_, _, err := readProxyHeader(bufio.NewReader(bytes.NewReader([]byte(s))))
+		if err == nil {
+			t.Fatalf("invalid header accepted: %q", s)
+		}
+	}
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	// the target reads the header of the server, then echoes
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	headers := make(chan net.Addr, 1)
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				src, _, err := readProxyHeader(reader)
+				if err != nil {
+					return
+				}
+				headers <- src
+				_, _ = io.Copy(conn, reader)
+			}()
+		}
+	}()
+	events := make(chan SessionEvent, 4)
+	_, trusted, _ := net.ParseCIDR("127.0.0.0/8")
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb:  S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+		SessionHook: func(event SessionEvent) {
+			if event.Type == SessionOpen {
+				events <- event
+			}
+		},
+		ProxyProtocolTrusted: []*net.IPNet{trusted},
+		ProxyProtocolHeader:  2,
+	})
+	client := &net.TCPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 4242}
+	for _, version := range []int{1, 2} {
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write(marshalProxyHeader(version, client, listen.Addr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dr, err := SOCKS5CONNECTP("tcp", listen.Addr().String(), nil, &testConnDialer{conn: conn})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tconn, err := dr.Dial("tcp", target.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testConn(t, tconn, newData(64))
+		_ = tconn.Close()
+		if src := <-headers; src.String() != client.String() {
+			t.Fatalf("target saw %v", src)
+		}
+		if ev := testSessionEvent(t, events); ev.Info.RemoteAddr.String() != client.String() {
+			t.Fatalf("unexpected session source: %v", ev.Info.RemoteAddr)
+		}
+	}
+}
+
+func TestServerProxyProtocolUntrusted(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	_, trusted, _ := net.ParseCIDR("192.0.2.0/24")
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch:        DefaultSocksVersionSwitch,
+		CMDConfig:            DefaultSocksCMDConfig,
+		Socks5AuthCb:         S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+		ProxyProtocolTrusted: []*net.IPNet{trusted},
+	})
+	dr, err := SOCKS5CONNECTP("tcp", listen.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testConn(t, conn, newData(64))
+}
@@ -0,0 +1,352 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// a reverse relay is a RelayServer that dials out to a RelayWorkerPool, the pool then opens
+// mux streams to it and every stream carries one relay request. the worker registers with
+//
+//	MAGIC VER IDLEN ID NLABELS (LEN LABEL)*
+//
+// and the pool answers AUTH(1), with AUTH set NONCE(32) follows and the worker sends
+// MAC(32) = HMAC-SHA256(key, NONCE VER IDLEN ID NLABELS ... ID). REP(1) ends the registration,
+// the mux frames start right after a successful one
+const (
+	relayReverseMagic   = 0xfc
+	relayReverseVersion = 0x01
+)
+
+const relayRegisterTimeout = 10 * time.Second
+
+const (
+	relayRetryMin = 1 * time.Second
+	relayRetryMax = 30 * time.Second
+)
+
+var ErrRelayNoWorker = errors.New("relay no worker available")
+
+// WithRelayLabels sets the labels a reverse relay registers with, see RelayWorkerPool.DialLabel
+func WithRelayLabels(labels ...string) RelayOption {
+	return func(opts *relayOptions) {
+		opts.labels = labels
+	}
+}
+
+// ServeReverse registers at the RelayWorkerPool behind dial and serves its requests,
+// a lost registration is renewed with backoff until Shutdown or Close.
+// WithRelayKey authenticates the worker and WithRelayLabels describes it, it only returns early when the pool rejects it
+func (rs *RelayServer) ServeReverse(dial func(ctx context.Context) (net.Conn, error), opts ...RelayOption) error {
+	rs.mux.Lock()
+	if rs.lnCtx.Err() != nil {
+		rs.mux.Unlock()
+		return rs.lnCtx.Err()
+	}
+	rs.wg.Add(1)
+	rs.mux.Unlock()
+	defer rs.wg.Done()
+	ro := newRelayOptions(opts)
+	delay := relayRetryMin
+	for {
+		start := time.Now()
+		err := rs.reverse(dial, ro)
+		if rs.lnCtx.Err() != nil {
+			return rs.lnCtx.Err()
+		}
+		if errors.Is(err, ErrRelayAuthRejected) {
+			return err
+		}
+		// a registration that held for a while starts over with a short delay
+		if time.Since(start) > relayRetryMax {
+			delay = relayRetryMin
+		}
+		select {
+		case <-rs.lnCtx.Done():
+			return rs.lnCtx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > relayRetryMax {
+			delay = relayRetryMax
+		}
+	}
+}
+
+// reverse serves one registration, it returns once the session died or the server shuts down,
+// in the latter case the session stays until the streams it carries are done
+func (rs *RelayServer) reverse(dial func(ctx context.Context) (net.Conn, error), ro relayOptions) error {
+	ctx, cl := context.WithCancel(rs.lnCtx)
+	defer cl()
+	conn, err := dial(ctx)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(relayRegisterTimeout))
+	err = relayRegister(conn, ro)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	sess := newMuxSession(conn, false, rs.cfg.Mux.build())
+	go func() {
+		select {
+		case <-rs.ctx.Done():
+			_ = sess.Close()
+		case <-sess.die:
+		}
+	}()
+	go func() {
+		for {
+			stream, err := sess.accept()
+			if err != nil {
+				return
+			}
+			if !rs.track() {
+				_ = stream.Close()
+				continue
+			}
+			go func() {
+				defer rs.wg.Done()
+				_ = relayServe(rs.ctx, stream, rs.cfg, false)
+			}()
+		}
+	}()
+	select {
+	case <-sess.die:
+		return ErrMuxSessionClosed
+	case <-rs.lnCtx.Done():
+		return rs.lnCtx.Err()
+	}
+}
+
+func relayRegister(rw io.ReadWriter, ro relayOptions) error {
+	if len(ro.id) > 255 || len(ro.labels) > 255 {
+		return ErrRelayAuthIdInvalid
+	}
+	req := append([]byte{relayReverseVersion}, makeStrBytes(ro.id)...)
+	req = append(req, byte(len(ro.labels)))
+	for _, label := range ro.labels {
+		if len(label) > 255 {
+			return ErrRelayAuthIdInvalid
+		}
+		req = append(req, makeStrBytes(label)...)
+	}
+	_, err := rw.Write(append([]byte{relayReverseMagic}, req...))
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 1)
+	_, err = io.ReadFull(rw, b)
+	if err != nil {
+		return err
+	}
+	if b[0] != 0 {
+		nonce := make([]byte, relayNonceLen)
+		_, err = io.ReadFull(rw, nonce)
+		if err != nil {
+			return err
+		}
+		_, err = rw.Write(relayMAC(ro.key, nonce, req, ro.id))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.ReadFull(rw, b)
+	if err != nil {
+		return err
+	}
+	if b[0] != socks5CMDRespSuccess {
+		return ErrRelayAuthRejected
+	}
+	return nil
+}
+
+type RelayWorkerPoolConfig struct {
+	// AuthKey returns the pre-shared key of a worker id, if nil any worker may register
+	AuthKey func(id string) (key []byte, ok bool)
+	Mux     *MuxConfig //settings of the worker sessions, if nil, defaults
+}
+
+// RelayWorkerPool is the front end of reverse relays, workers behind NAT dial in to it with
+// RelayServer.ServeReverse and the relay handlers reach them through Dial or DialLabel
+type RelayWorkerPool struct {
+	cfg *RelayWorkerPoolConfig
+	serverLife
+
+	wmux    sync.Mutex
+	workers []*relayWorker
+	next    int
+}
+
+type relayWorker struct {
+	id     string
+	labels []string
+	sess   *muxSession
+}
+
+func (w *relayWorker) hasLabel(label string) bool {
+	if label == "" {
+		return true
+	}
+	for _, one := range w.labels {
+		if one == label {
+			return true
+		}
+	}
+	return false
+}
+
+func NewRelayWorkerPool(ctx context.Context, cfg *RelayWorkerPoolConfig) *RelayWorkerPool {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if cfg == nil {
+		cfg = &RelayWorkerPoolConfig{}
+	}
+	rwp := &RelayWorkerPool{
+		cfg: cfg,
+	}
+	rwp.init(ctx)
+	return rwp
+}
+
+// Serve accepts the registrations of workers on ln
+func (rwp *RelayWorkerPool) Serve(ln net.Listener) error {
+	return rwp.serve(ln, rwp.handleConn)
+}
+
+func (rwp *RelayWorkerPool) ListenAndServe(network string, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return rwp.Serve(ln)
+}
+
+// Dial opens a stream to any worker, it fits the cb of the relay handlers
+func (rwp *RelayWorkerPool) Dial(ctx context.Context) (net.Conn, error) {
+	return rwp.dial(ctx, "")
+}
+
+// DialLabel returns a cb for the relay handlers that only uses workers registered with label
+func (rwp *RelayWorkerPool) DialLabel(label string) func(ctx context.Context) (net.Conn, error) {
+	return func(ctx context.Context) (net.Conn, error) {
+		return rwp.dial(ctx, label)
+	}
+}
+
+func (rwp *RelayWorkerPool) dial(ctx context.Context, label string) (net.Conn, error) {
+	rwp.wmux.Lock()
+	var candidates []*relayWorker
+	alive := rwp.workers[:0]
+	for _, w := range rwp.workers {
+		if w.sess.isClosed() {
+			continue
+		}
+		alive = append(alive, w)
+		if w.hasLabel(label) {
+			candidates = append(candidates, w)
+		}
+	}
+	rwp.workers = alive
+	rwp.next++
+	next := rwp.next
+	rwp.wmux.Unlock()
+	// round robin, a session that died meanwhile passes on to the next worker
+	for i := range candidates {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		stream, err := candidates[(next+i)%len(candidates)].sess.open(ctx)
+		if err == nil {
+			return stream, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrRelayNoWorker
+}
+
+func (rwp *RelayWorkerPool) handleConn(ctx context.Context, conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(relayRegisterTimeout))
+	w, err := rwp.register(conn)
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	w.sess = newMuxSession(conn, true, rwp.cfg.Mux.build())
+	defer w.sess.Close()
+	rwp.wmux.Lock()
+	rwp.workers = append(rwp.workers, w)
+	rwp.wmux.Unlock()
+	select {
+	case <-w.sess.die:
+	case <-ctx.Done():
+	}
+}
+
+func (rwp *RelayWorkerPool) register(rw io.ReadWriter) (*relayWorker, error) {
+	// the request is kept for the MAC
+	req := new(bytes.Buffer)
+	r := io.TeeReader(rw, req)
+	b := make([]byte, 2)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != relayReverseMagic || b[1] != relayReverseVersion {
+		return nil, ErrRelayVersionNotSupport
+	}
+	id, err := readStr(r)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(r, b[:1])
+	if err != nil {
+		return nil, err
+	}
+	w := &relayWorker{id: id}
+	for i := 0; i < int(b[0]); i++ {
+		label, err := readStr(r)
+		if err != nil {
+			return nil, err
+		}
+		w.labels = append(w.labels, label)
+	}
+	if rwp.cfg.AuthKey == nil {
+		_, err = rw.Write([]byte{0, socks5CMDRespSuccess})
+		return w, err
+	}
+	nonce := make([]byte, relayNonceLen)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rw.Write(append([]byte{1}, nonce...))
+	if err != nil {
+		return nil, err
+	}
+	mac := make([]byte, sha256.Size)
+	_, err = io.ReadFull(rw, mac)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rwp.cfg.AuthKey(id)
+	if !ok || !hmac.Equal(mac, relayMAC(key, nonce, req.Bytes()[1:], id)) {
+		_, _ = rw.Write([]byte{socks5CMDRespConnNotAllowed})
+		return nil, ErrRelayAuthRejected
+	}
+	_, err = rw.Write([]byte{socks5CMDRespSuccess})
+	return w, err
+}
@@ -0,0 +1,172 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// testWaitWorker waits until cb reaches a worker
+func testWaitWorker(t *testing.T, cb func(ctx context.Context) (net.Conn, error)) {
+	for i := 0; i < 100; i++ {
+		conn, err := cb(context.Background())
+		if err == nil {
+			_ = conn.Close()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("no worker registered")
+}
+
+func TestRelayReverse(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	pool := NewRelayWorkerPool(context.Background(), &RelayWorkerPoolConfig{
+		AuthKey: func(id string) ([]byte, bool) {
+			return []byte("test123"), id == "eu1" || id == "us1"
+		},
+	})
+	defer pool.Close()
+	poolLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = pool.Serve(poolLn)
+	}()
+	dial := func(ctx context.Context) (net.Conn, error) {
+		dr := net.Dialer{}
+		return dr.DialContext(ctx, poolLn.Addr().Network(), poolLn.Addr().String())
+	}
+
+	events := make(map[string]chan SessionEvent)
+	workers := make(map[string]*RelayServer)
+	for _, id := range []string{"eu1", "us1"} {
+		ch := make(chan SessionEvent, 8)
+		events[id] = ch
+		rs, err := NewRelayServer(context.Background(), &RelayConfig{
+			SessionHook: func(event SessionEvent) {
+				if event.Type == SessionOpen {
+					ch <- event
+				}
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Close()
+		workers[id] = rs
+		go func(id string) {
+			_ = rs.ServeReverse(dial, WithRelayKey(id, []byte("test123")), WithRelayLabels(id[:2]))
+		}(id)
+	}
+	testWaitWorker(t, pool.DialLabel("eu"))
+	testWaitWorker(t, pool.DialLabel("us"))
+	if _, err = pool.DialLabel("asia")(context.Background()); !errors.Is(err, ErrRelayNoWorker) {
+		t.Fatalf("want no worker, got %v", err)
+	}
+
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+	}
+	cfg.CMDConfig.CMDCONNECTHandler = RelayCMDCONNECTHandler(pool.DialLabel("us"))
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	dr, err := SOCKS5CONNECT(listen.Addr().Network(), listen.Addr().String(), &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(64*1024))
+	_ = conn.Close()
+	ev := testSessionEvent(t, events["us1"])
+	if ev.Info.Target != ln.Addr().String() {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	select {
+	case ev = <-events["eu1"]:
+		t.Fatalf("request went to the wrong worker: %+v", ev)
+	default:
+	}
+
+	// a lost session is registered again
+	pool.wmux.Lock()
+	for _, w := range pool.workers {
+		if w.id == "us1" {
+			_ = w.sess.Close()
+		}
+	}
+	pool.wmux.Unlock()
+	testWaitWorker(t, pool.DialLabel("us"))
+	conn, err = dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(4096))
+	_ = conn.Close()
+
+	// a worker without the key is turned away for good
+	rs, err := NewRelayServer(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	if err = rs.ServeReverse(dial, WithRelayKey("eu1", []byte("wrong"))); !errors.Is(err, ErrRelayAuthRejected) {
+		t.Fatalf("want auth rejected, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err = workers["eu1"].Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayWorkerPoolDialContext(t *testing.T) {
+	pool := NewRelayWorkerPool(context.Background(), nil)
+	defer pool.Close()
+	// the peer never reads, the SYN of the stream is stuck
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	sess := newMuxSession(c1, true, (*MuxConfig)(nil).build())
+	defer sess.Close()
+	pool.wmux.Lock()
+	pool.workers = append(pool.workers, &relayWorker{id: "stalled", sess: sess})
+	pool.wmux.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := pool.Dial(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("dial outlived ctx")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := pool.DialLabel("")(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want canceled, got %v", err)
+	}
+}
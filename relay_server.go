@@ -0,0 +1,42 @@
+package socks
+
+import (
+	"context"
+	"net"
+)
+
+// RelayServer serves the relay protocol on listeners like Server does for socks
+type RelayServer struct {
+	cfg *RelayConfig
+	serverLife
+}
+
+func NewRelayServer(ctx context.Context, cfg *RelayConfig) (*RelayServer, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if cfg == nil {
+		cfg = &RelayConfig{}
+	}
+	rs := &RelayServer{
+		cfg: cfg,
+	}
+	rs.init(ctx)
+	return rs, nil
+}
+
+func (rs *RelayServer) Serve(ln net.Listener) error {
+	return rs.serve(ln, rs.handleConn)
+}
+
+func (rs *RelayServer) ListenAndServe(network string, addr string) error {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return rs.Serve(ln)
+}
+
+func (rs *RelayServer) handleConn(ctx context.Context, conn net.Conn) {
+	_ = relayServe(ctx, conn, rs.cfg, true)
+}
@@ -1,20 +1,22 @@
 package socks
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
-	"fmt"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
+	"os"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
 	cfg *ServerConfig
-
-	ctx    context.Context
-	cancel context.CancelFunc
+	serverLife
 }
 
 func NewServer(cfg *ServerConfig) (*Server, error) {
@@ -28,12 +30,19 @@ func NewServerContext(ctx context.Context, cfg *ServerConfig) (*Server, error) {
 	if cfg == nil {
 		return nil, ErrNeedServerConfig
 	}
-	if !cfg.VersionSwitch.SwitchSocksVersion4 && !cfg.VersionSwitch.SwitchSocksVersion5 {
+	if !cfg.VersionSwitch.SwitchSocksVersion4 && !cfg.VersionSwitch.SwitchSocksVersion5 &&
+		!cfg.VersionSwitch.SwitchHTTP && !cfg.VersionSwitch.SwitchTransparent {
 		return nil, ErrMeaninglessServiceVersion
 	}
 	if !cfg.CMDConfig.SwitchCMDCONNECT && !cfg.CMDConfig.SwitchCMDBIND && !cfg.CMDConfig.SwitchCMDUDPASSOCIATE {
 		return nil, ErrMeaninglessServiceCmd
 	}
+	if cfg.TLSCertUser != nil && (cfg.TLSConfig == nil || cfg.TLSConfig.ClientAuth < tls.VerifyClientCertIfGiven) {
+		return nil, ErrTLSCertUnverified
+	}
+	if cfg.ProxyProtocolHeader != 0 && cfg.ProxyProtocolHeader != 1 && cfg.ProxyProtocolHeader != 2 {
+		return nil, ErrProxyProtocolVersion
+	}
 	if cfg.BindTimeout == 0 {
 		cfg.BindTimeout = 5 * time.Second
 	}
@@ -47,15 +56,18 @@ func NewServerContext(ctx context.Context, cfg *ServerConfig) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.init(ctx)
 	return s, nil
 }
 
 func (s *Server) Serve(ln net.Listener) error {
-	if s.ctx.Err() != nil {
-		return s.ctx.Err()
-	}
-	return s.listen(ln)
+	return s.serve(ln, s.handleConn)
+}
+
+// ServeConn serves one connection accepted elsewhere like Serve does, a ssh channel or stdio
+// with NewReadWriteConn. it returns once the session ended, ctx ends it early
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) error {
+	return s.serveConn(ctx, conn, s.handleConn)
 }
 
 func (s *Server) ListenAndServe(network string, addr string) error {
@@ -66,57 +78,192 @@ func (s *Server) ListenAndServe(network string, addr string) error {
 	return s.Serve(ln)
 }
 
-func (s *Server) Close() error {
-	s.cancel()
-	return s.ctx.Err()
-}
-
-func (s *Server) listen(ln net.Listener) error {
-	ctx, canecl := context.WithCancel(s.ctx)
-	defer canecl()
-	waitFunc(ctx, func() {
-		_ = ln.Close()
-	})
-	for {
-		conn, err := ln.Accept()
+func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
+	sess := newSession("", conn, s.cfg.Ruleset, s.cfg.SessionHook)
+	sc := &serverConn{
+		Conn:      conn,
+		sess:      sess,
+		ctx:       ctx,
+		halfClose: s.cfg.HalfCloseHandshake,
+	}
+	var err error
+	defer func() {
+		_ = sc.Close()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			err = ErrHandshakeTimeout
+		}
+		sess.end(err)
+	}()
+	s.setHandshakeDeadline(sc, 0)
+	if isProxyTrusted(conn.RemoteAddr(), s.cfg.ProxyProtocolTrusted) {
+		sc.Conn, err = acceptProxyHeader(conn)
 		if err != nil {
-			return err
+			return
 		}
-		go s.handleConn(conn)
+		sess.info.LocalAddr = sc.LocalAddr()
+		sess.info.RemoteAddr = sc.RemoteAddr()
 	}
-}
-
-func (s *Server) handleConn(conn net.Conn) {
-	sc := &serverConn{
-		Conn: conn,
+	if s.cfg.TLSConfig != nil {
+		err = s.serverTLS(ctx, sc)
+		if err != nil {
+			return
+		}
 	}
-	defer sc.Close()
-	ctx, cl := context.WithCancel(s.ctx)
-	defer cl()
-	waitFunc(ctx, func() {
-		_ = conn.Close()
-	})
+	sc.Conn = &countConn{Conn: sc.Conn, sess: sess}
 	buf := make([]byte, socksVersionLen)
-	_, err := io.ReadFull(conn, buf)
+	_, err = io.ReadFull(sc, buf)
 	if err != nil {
 		return
 	}
 
 	switch buf[0] {
 	case socksVersion4:
+		sess.info.Proto = "socks4"
 		err = s.handleSocks4(sc)
 		if err != nil {
 			return
 		}
 	case socksVersion5:
+		sess.info.Proto = "socks5"
 		err = s.handleSocks5(sc)
 		if err != nil {
 			return
 		}
 	default:
-		return
+		if !s.cfg.VersionSwitch.SwitchHTTP {
+			err = ErrSocksVersionNotSupport
+			return
+		}
+		sess.info.Proto = "http"
+		err = s.handleHTTP(sc, buf)
+		if err != nil {
+			return
+		}
 	}
-	sc.ioCopy()
+	s.clearHandshakeDeadline(sc)
+	sess.open()
+	err = s.relay(sc)
+}
+
+// setHandshakeDeadline bounds the handshake by ConnTimeout, extra is the time the server itself waits
+func (s *Server) setHandshakeDeadline(conn *serverConn, extra time.Duration) {
+	if s.cfg.ConnTimeout != 0 {
+		conn.deadline = time.Now().Add(s.cfg.ConnTimeout + extra)
+		_ = conn.SetDeadline(conn.deadline)
+	}
+}
+
+func (s *Server) clearHandshakeDeadline(conn *serverConn) {
+	if s.cfg.ConnTimeout != 0 {
+		conn.deadline = time.Time{}
+		_ = conn.SetDeadline(conn.deadline)
+	}
+}
+
+// relay copies a granted session until it ends, the error tells the timer that ended it
+func (s *Server) relay(sc *serverConn) error {
+	var idle time.Duration
+	if sc.udpConn == nil {
+		idle = s.cfg.IdleTimeout
+	}
+	if idle == 0 && s.cfg.MaxLifetime == 0 {
+		sc.ioCopy(true)
+		return nil
+	}
+	done := make(chan struct{})
+	reason := make(chan error, 1)
+	go func() {
+		reason <- sc.sess.watch(done, idle, s.cfg.MaxLifetime, func() {
+			_ = sc.Close()
+		})
+	}()
+	sc.ioCopy(idle == 0)
+	close(done)
+	return <-reason
+}
+
+// connect dials addr with the CMDCONNECTHandler within DialTimeout, ctx is of the session
+func (s *Server) connect(ctx context.Context, sess *session, addr string) (net.Conn, error) {
+	ctx = s.netContext(ctx, sess)
+	if s.cfg.DialTimeout != 0 {
+		tmpctx, cancel := context.WithTimeout(ctx, s.cfg.DialTimeout)
+		defer cancel()
+		ctx = tmpctx
+	}
+	handler := s.cfg.CMDConfig.CMDCONNECTHandler
+	if handler == nil {
+		handler = DefaultCMDCONNECTHandler
+	}
+	conn, err := handler(ctx, addr)
+	if err != nil || s.cfg.ProxyProtocolHeader == 0 {
+		return conn, err
+	}
+	_, err = conn.Write(marshalProxyHeader(s.cfg.ProxyProtocolHeader, sess.info.RemoteAddr, sess.info.LocalAddr))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// netContext carries the outbound network of the config and the SocketOptions of sess to the default handlers
+func (s *Server) netContext(ctx context.Context, sess *session) context.Context {
+	var o *SocketOptions
+	if s.cfg.SocketControl != nil {
+		o = s.cfg.SocketControl(sess.info)
+	}
+	if s.cfg.EgressPool != nil && (o == nil || o.LocalAddr == nil) {
+		if ip := s.cfg.EgressPool.pick(sess.info, sess.egressSession); ip != nil {
+			eo := SocketOptions{}
+			if o != nil {
+				eo = *o
+			}
+			eo.LocalAddr, eo.egress = ip, s.cfg.EgressPool
+			sess.info.Egress = ip
+			o = &eo
+		}
+	}
+	if o != nil {
+		ctx = context.WithValue(ctx, socketOptionsKey, o)
+	}
+	if s.cfg.Dialer != nil {
+		ctx = context.WithValue(ctx, dialerKey, s.cfg.Dialer)
+	}
+	if s.cfg.ListenerConfig != nil {
+		ctx = context.WithValue(ctx, listenerKey, s.cfg.ListenerConfig)
+	}
+	if s.cfg.PacketListenerConfig != nil {
+		ctx = context.WithValue(ctx, packetListenerKey, s.cfg.PacketListenerConfig)
+	}
+	return ctx
+}
+
+// egressUser sets the user of the session, the session id for the EgressPool is taken off
+func (s *Server) egressUser(conn *serverConn, user string) string {
+	if s.cfg.EgressPool != nil {
+		user, conn.sess.egressSession = parseEgressUser(user)
+	}
+	conn.sess.info.User = user
+	return user
+}
+
+// allowConn asks the Ruleset with a context that ends if the client goes away meanwhile
+func (s *Server) allowConn(conn *serverConn, cmd string, addr string) error {
+	if conn.sess.ruleset == nil {
+		return conn.sess.allow(conn.ctx, cmd, addr)
+	}
+	ctx, stop := conn.watchClient()
+	defer stop()
+	return conn.sess.allow(ctx, cmd, addr)
+}
+
+// allowSocks5 asks the Ruleset about the request and replies to a rejection
+func (s *Server) allowSocks5(conn *serverConn, cmd string, addr string) error {
+	err := s.allowConn(conn, cmd, addr)
+	if err != nil {
+		_ = conn.writeSocks5CMDResp(getReplyCode(err, socks5CMDRespConnNotAllowed), conn.LocalAddr())
+	}
+	return err
 }
 
 func (s *Server) handleSock5AuthPriority() error {
@@ -148,6 +295,10 @@ func (s *Server) handleSock5AuthPriority() error {
 		}
 	}
 	if len(sl) == 0 {
+		if s.cfg.TLSConfig != nil && s.cfg.TLSCertUser != nil {
+			//only clients with a certificate
+			return nil
+		}
 		return ErrSocks5NeedMETHODSAuth
 	}
 	sort.Slice(sl, func(i, j int) bool {
@@ -159,10 +310,24 @@ func (s *Server) handleSock5AuthPriority() error {
 	return nil
 }
 
+// wrapTCPDataConn applies CMDConfig.TCPDataHandler to the client side of CONNECT and BIND after the final reply
+func (s *Server) wrapTCPDataConn(conn *serverConn) {
+	if s.cfg.CMDConfig.TCPDataHandler != nil {
+		conn.Conn = newTCPDataConn(conn.Conn, s.cfg.CMDConfig.TCPDataHandler)
+	}
+}
+
 type serverConn struct {
 	net.Conn
-	copyConn net.Conn
-	udpConn  net.PacketConn
+	copyConn   net.Conn
+	udpConn    net.PacketConn
+	udpOverTCP bool //udpConn reads the control connection itself
+	sess       *session
+	certAuth   bool            //a TLS client certificate authenticated the client
+	serve      func()          //if set, ioCopy runs it instead of copying, the http forward proxy
+	ctx        context.Context //the session, it ends with the connection
+	deadline   time.Time       //the handshake deadline in effect
+	halfClose  bool            //ServerConfig.HalfCloseHandshake
 }
 
 func (c *serverConn) Close() error {
@@ -175,48 +340,93 @@ func (c *serverConn) Close() error {
 	return c.Conn.Close()
 }
 
-func (c *serverConn) ioCopy() {
-	copyBuffer := io.Discard
-	if c.udpConn != nil {
-		defer c.udpConn.Close()
-		go func() {
-			buf := make([]byte, 32*1024)
-			for {
-				n, addr, err := c.udpConn.ReadFrom(buf)
-				if err != nil {
-					return
-				}
-				_, err = c.udpConn.WriteTo(buf[:n], addr)
-				if err != nil {
-					return
+// watchClient returns a context of the session that also ends if the client goes away while the server
+// waits on a handler. stop ends the watch, what the client sent meanwhile is read again after. stop may run more than once
+func (c *serverConn) watchClient() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	conn := c.Conn
+	var stopped atomic.Bool
+	var buf []byte
+	exit := make(chan struct{})
+	go func() {
+		defer close(exit)
+		b := make([]byte, 512)
+		for len(buf) < pipeBufferSize {
+			n, err := conn.Read(b)
+			buf = append(buf, b[:n]...)
+			if err != nil {
+				// closed, reset or out of time, as the handshake would find it.
+				// with HalfCloseHandshake an EOF is a client that still waits for the reply
+				if !stopped.Load() && !(c.halfClose && errors.Is(err, io.EOF)) {
+					cancel()
 				}
+				return
 			}
-		}()
+		}
+	}()
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			stopped.Store(true)
+			_ = conn.SetReadDeadline(time.Now())
+			<-exit
+			_ = conn.SetReadDeadline(c.deadline)
+			cancel()
+			if len(buf) > 0 {
+				c.Conn = &bufConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buf), conn)}
+			}
+		})
+	}
+}
+
+// ioCopy relays the granted session, splice allows the kernel copy, see pipe
+func (c *serverConn) ioCopy(splice bool) {
+	if c.serve != nil {
+		c.serve()
+		return
+	}
+	if c.udpConn != nil {
+		defer c.udpConn.Close()
+		if c.udpOverTCP {
+			c.udpCopy()
+			return
+		}
+		go c.udpCopy()
 	}
 	if c.copyConn != nil {
 		defer c.copyConn.Close()
-		go io.Copy(c.Conn, c.copyConn)
-		copyBuffer = c.copyConn
+		_ = pipe(c.Conn, c.copyConn, splice)
+		return
+	}
+	_, _ = io.Copy(io.Discard, c.Conn)
+}
+
+func (c *serverConn) udpCopy() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, addr, err := c.udpConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		_, err = c.udpConn.WriteTo(buf[:n], addr)
+		if err != nil {
+			return
+		}
 	}
-	_, _ = io.Copy(copyBuffer, c.Conn)
 }
 
 func (c *serverConn) writeSocks4Resp(code byte, addr net.Addr) error {
-	bs := append([]byte{0x00, code}, getSocks4AddrBytes(addr)...)
+	ad := getSocks4AddrBytes(addr)
+	if len(ad) != 2+4 {
+		ad = make([]byte, 2+4)
+	}
+	bs := append([]byte{0x00, code}, ad...)
 	_, err := c.Write(bs)
 	return err
 }
 
 func (c *serverConn) writeSocks5CMDResp(code byte, addr net.Addr) error {
-	ad := getSocks5AddrBytes(addr)
-	var atyp byte = 0x00
-	switch len(ad) {
-	case 4 + 2:
-		atyp = socks5AddrTypeIPv4
-	case 16 + 2:
-		atyp = socks5AddrTypeIPv6
-	}
-	_, err := c.Write(append([]byte{socksVersion5, code, 0x00, atyp}, ad...))
+	_, err := c.Write(append([]byte{socksVersion5, code, 0x00}, getSocks5AddrTypeBytes(addr)...))
 	return err
 }
 
@@ -235,35 +445,5 @@ func (c *serverConn) writeSocks5AuthPasswordResp(state bool) error {
 }
 
 func (c *serverConn) getSocks5AddrInfo(atyp byte) (string, error) {
-	buf := make([]byte, 256)
-	switch atyp {
-	case socks5AddrTypeIPv4:
-		_, err := io.ReadFull(c, buf[:4+2])
-		if err != nil {
-			return "", err
-		}
-		addr := fmt.Sprintf("%s:%d", net.IP(buf[:4]).String(), binary.BigEndian.Uint16(buf[4:4+2]))
-		return addr, nil
-	case socks5AddrTypeDomain:
-		_, err := io.ReadFull(c, buf[:1])
-		if err != nil {
-			return "", err
-		}
-		addrL := int(buf[0])
-		_, err = io.ReadFull(c, buf[:addrL+2])
-		if err != nil {
-			return "", err
-		}
-		addr := fmt.Sprintf("%s:%d", string(buf[:addrL]), binary.BigEndian.Uint16(buf[addrL:addrL+2]))
-		return addr, nil
-	case socks5AddrTypeIPv6:
-		_, err := io.ReadFull(c, buf[:16+2])
-		if err != nil {
-			return "", err
-		}
-		addr := fmt.Sprintf("[%s]:%d", net.IP(buf[:16]).String(), binary.BigEndian.Uint16(buf[16:16+2]))
-		return addr, nil
-	default:
-		return "", ErrSocksMessageParsingFailure
-	}
+	return readSocks5Addr(c, atyp)
 }
@@ -0,0 +1,323 @@
+package socks
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// with VersionSwitch.SwitchHTTP, a first byte that is no socks version starts an HTTP/1.1 proxy request.
+// CONNECT opens a tunnel like the socks CONNECT, an absolute-form request is forwarded to its origin
+// and the connection keeps forwarding requests until one side closes it
+
+const httpMaxHeaderBytes = 1 << 20
+
+const httpRealm = "go-socks"
+
+var httpHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// bufConn reads through r, which holds what was buffered past the request
+type bufConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufConn) CloseWrite() error {
+	return closeWriteOf(c.Conn)
+}
+
+// httpReader bounds the request head, the body is not limited
+type httpReader struct {
+	lr *io.LimitedReader
+	br *bufio.Reader
+}
+
+func (hr *httpReader) readRequest() (*http.Request, error) {
+	hr.lr.N = httpMaxHeaderBytes
+	req, err := http.ReadRequest(hr.br)
+	hr.lr.N = math.MaxInt64
+	return req, err
+}
+
+func (s *Server) handleHTTP(conn *serverConn, first []byte) error {
+	lr := &io.LimitedReader{R: conn.Conn, N: httpMaxHeaderBytes}
+	hr := &httpReader{lr: lr, br: bufio.NewReader(io.MultiReader(bytes.NewReader(first), lr))}
+	req, err := hr.readRequest()
+	if err != nil {
+		_ = writeHTTPStatus(conn, http.StatusBadRequest)
+		return err
+	}
+	conn.Conn = &bufConn{Conn: conn.Conn, r: hr.br}
+	err = s.authHTTP(conn, req)
+	if err != nil {
+		_ = writeHTTPStatus(conn, http.StatusProxyAuthRequired)
+		return err
+	}
+	if !s.cfg.CMDConfig.SwitchCMDCONNECT {
+		_ = writeHTTPStatus(conn, http.StatusMethodNotAllowed)
+		return ErrHTTPMethodNotSupport
+	}
+	if req.Method == http.MethodConnect {
+		return s.handleHTTPCONNECT(conn, req)
+	}
+	return s.handleHTTPForward(conn, req, hr)
+}
+
+// authHTTP checks Proxy-Authorization with the socks5 PASSWORD callback,
+// a request without credentials is let in by the NOAUTH callback
+func (s *Server) authHTTP(conn *serverConn, req *http.Request) error {
+	if conn.certAuth {
+		return nil
+	}
+	if s.cfg.Socks5AuthCb.Socks5AuthPASSWORD != nil {
+		if user, password, ok := parseProxyAuth(req.Header.Get("Proxy-Authorization")); ok {
+			user = s.egressUser(conn, user)
+			nconn := s.cfg.Socks5AuthCb.Socks5AuthPASSWORD(conn.Conn, S5AuthPassword{
+				User:     user,
+				Password: password,
+			})
+			if nconn == nil {
+				return ErrHTTPAuthRejected
+			}
+			conn.Conn = nconn
+			return nil
+		}
+	}
+	if s.cfg.Socks5AuthCb.Socks5AuthNOAUTH != nil {
+		if nconn := s.cfg.Socks5AuthCb.Socks5AuthNOAUTH(conn.Conn); nconn != nil {
+			conn.Conn = nconn
+			return nil
+		}
+	}
+	return ErrHTTPAuthRejected
+}
+
+func (s *Server) handleHTTPCONNECT(conn *serverConn, req *http.Request) error {
+	addr := req.RequestURI
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		_ = writeHTTPStatus(conn, http.StatusBadRequest)
+		return ErrHTTPRequestInvalid
+	}
+	ctx, stop := conn.watchClient()
+	cc, err := s.allowHTTP(ctx, conn, addr)
+	stop()
+	if err != nil {
+		return err
+	}
+	conn.copyConn = cc
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	s.wrapTCPDataConn(conn)
+	return nil
+}
+
+func (s *Server) handleHTTPForward(conn *serverConn, req *http.Request, hr *httpReader) error {
+	addr, err := getHTTPForwardAddr(req)
+	if err != nil {
+		_ = writeHTTPStatus(conn, http.StatusBadRequest)
+		return err
+	}
+	// no watch of the client, the forward proxy reads ahead for the next request
+	cc, err := s.allowHTTP(conn.ctx, conn, addr)
+	if err != nil {
+		return err
+	}
+	conn.copyConn = cc
+	conn.serve = func() {
+		s.serveHTTPForward(conn, req, addr, hr)
+	}
+	return nil
+}
+
+// allowHTTP asks the Ruleset about addr and dials it with ctx, failures are answered with a status
+func (s *Server) allowHTTP(ctx context.Context, conn *serverConn, addr string) (net.Conn, error) {
+	err := conn.sess.allow(ctx, "CONNECT", addr)
+	if err != nil {
+		_ = writeHTTPStatus(conn, getHTTPStatus(err, socks5CMDRespConnNotAllowed))
+		return nil, err
+	}
+	cc, err := s.connect(ctx, conn.sess, addr)
+	if err != nil {
+		_ = writeHTTPStatus(conn, getHTTPStatus(err, socks5CMDRespFailure))
+		return nil, err
+	}
+	return cc, nil
+}
+
+// serveHTTPForward forwards req and the requests that follow on the connection,
+// a request to another origin is asked about and dialed again
+func (s *Server) serveHTTPForward(conn *serverConn, req *http.Request, addr string, hr *httpReader) {
+	or := bufio.NewReader(conn.copyConn)
+	for {
+		upgrade := removeHopHeaders(req.Header)
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// keep req.Write from adding its own
+			req.Header.Set("User-Agent", "")
+		}
+		origin := conn.copyConn
+		werr := make(chan error, 1)
+		go func() {
+			werr <- req.Write(origin)
+		}()
+		resp, err := http.ReadResponse(or, req)
+		// interim responses go through, 101 ends the http part
+		for err == nil && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			err = resp.Write(conn)
+			if err == nil {
+				resp, err = http.ReadResponse(or, req)
+			}
+		}
+		if err != nil {
+			_ = writeHTTPStatus(conn, http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if upgrade == "" || removeHopHeaders(resp.Header) == "" {
+				_ = writeHTTPStatus(conn, http.StatusBadGateway)
+				return
+			}
+			err = resp.Write(conn)
+			if err != nil {
+				return
+			}
+			_ = pipe(conn.Conn, &bufConn{Conn: origin, r: or}, false)
+			return
+		}
+		removeHopHeaders(resp.Header)
+		err = resp.Write(conn)
+		_ = resp.Body.Close()
+		if err != nil || resp.Close || req.Close {
+			return
+		}
+		if <-werr != nil {
+			return
+		}
+
+		req, err = hr.readRequest()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				_ = writeHTTPStatus(conn, http.StatusBadRequest)
+			}
+			return
+		}
+		if req.Method == http.MethodConnect {
+			_ = writeHTTPStatus(conn, http.StatusMethodNotAllowed)
+			return
+		}
+		naddr, err := getHTTPForwardAddr(req)
+		if err != nil {
+			_ = writeHTTPStatus(conn, http.StatusBadRequest)
+			return
+		}
+		if naddr != addr {
+			_ = origin.Close()
+			cc, err := s.allowHTTP(conn.ctx, conn, naddr)
+			if err != nil {
+				return
+			}
+			conn.copyConn = cc
+			or = bufio.NewReader(cc)
+			addr = naddr
+		}
+	}
+}
+
+func getHTTPForwardAddr(req *http.Request) (string, error) {
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" || req.URL.Host == "" {
+		return "", ErrHTTPRequestInvalid
+	}
+	if req.URL.Port() == "" {
+		return net.JoinHostPort(req.URL.Hostname(), "80"), nil
+	}
+	return req.URL.Host, nil
+}
+
+// removeHopHeaders drops the hop-by-hop headers of h, an Upgrade that Connection asks for
+// is kept and returned
+func removeHopHeaders(h http.Header) string {
+	upgrade := ""
+	for _, field := range h.Values("Connection") {
+		for _, one := range strings.Split(field, ",") {
+			one = strings.TrimSpace(one)
+			if strings.EqualFold(one, "upgrade") {
+				upgrade = h.Get("Upgrade")
+			}
+			if one != "" {
+				h.Del(one)
+			}
+		}
+	}
+	for _, one := range httpHopHeaders {
+		h.Del(one)
+	}
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	return upgrade
+}
+
+func parseProxyAuth(auth string) (user string, password string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
+
+// getHTTPStatus maps err like getReplyCode does for socks5
+func getHTTPStatus(err error, def byte) int {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	switch getReplyCode(err, def) {
+	case socks5CMDRespConnNotAllowed:
+		return http.StatusForbidden
+	case socks5CMDRespTTLExpired:
+		return http.StatusGatewayTimeout
+	case socks5CMDRespCMDNotSupported, socks5CMDRespAddNotSupported:
+		return http.StatusNotImplemented
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// writeHTTPStatus answers with an empty response that closes the connection
+func writeHTTPStatus(w io.Writer, code int) error {
+	extra := ""
+	if code == http.StatusProxyAuthRequired {
+		extra = fmt.Sprintf("Proxy-Authenticate: Basic realm=%q\r\n", httpRealm)
+	}
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n%sConnection: close\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code), extra)
+	return err
+}
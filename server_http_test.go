@@ -0,0 +1,298 @@
+package socks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func testHTTPServer(t *testing.T, events chan SessionEvent) net.Listener {
+	ln := testServer(t, &ServerConfig{
+		VersionSwitch: VersionSwitch{SwitchSocksVersion5: true, SwitchHTTP: true},
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthPASSWORD: func(conn net.Conn, auth S5AuthPassword) net.Conn {
+				return auth.IsEqual2(conn, "test", "test123")
+			},
+		},
+		Ruleset: func(ctx context.Context, info SessionInfo) error {
+			if info.Target == "127.0.0.1:1" {
+				return errors.New("blocked")
+			}
+			return nil
+		},
+		SessionHook: func(event SessionEvent) {
+			if event.Type != SessionClose {
+				events <- event
+			}
+		},
+	})
+	return ln
+}
+
+func testHTTPCONNECT(t *testing.T, proxy net.Addr, target string, auth string) (net.Conn, *http.Response) {
+	conn, err := net.Dial(proxy.Network(), proxy.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &bufConn{Conn: conn, r: br}, resp
+}
+
+func TestHTTPProxy(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	events := make(chan SessionEvent, 16)
+	listen := testHTTPServer(t, events)
+	auth := "Basic dGVzdDp0ZXN0MTIz" // test:test123
+
+	conn, resp := testHTTPCONNECT(t, listen.Addr(), ln.Addr().String(), "")
+	_ = conn.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Fatalf("want 407, got %s", resp.Status)
+	}
+	if ev := testSessionEvent(t, events); ev.Type != SessionReject || ev.Info.Proto != "http" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	conn, resp = testHTTPCONNECT(t, listen.Addr(), ln.Addr().String(), auth)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want 200, got %s", resp.Status)
+	}
+	testConn(t, conn, newData(64*1024))
+	_ = conn.Close()
+	if ev := testSessionEvent(t, events); ev.Type != SessionOpen || ev.Info.User != "test" || ev.Info.Target != ln.Addr().String() {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	conn, resp = testHTTPCONNECT(t, listen.Addr(), "127.0.0.1:1", auth)
+	_ = conn.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("want 403, got %s", resp.Status)
+	}
+	_ = testSessionEvent(t, events)
+
+	// socks5 still works on the same port
+	dr, err := SOCKS5CONNECTP(listen.Addr().Network(), listen.Addr().String(), &S5AuthPassword{User: "test", Password: "test123"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(4096))
+	_ = conn.Close()
+	if ev := testSessionEvent(t, events); ev.Info.Proto != "socks5" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	events := make(chan SessionEvent, 16)
+	listen := testHTTPServer(t, events)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" || r.Header.Get("Proxy-Connection") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Upgrade") == "echo" {
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			_ = brw.Flush()
+			_, _ = io.Copy(conn, brw)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(append([]byte(r.Method+" "+r.URL.Path+" "), body...))
+	}))
+	defer origin.Close()
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword("test", "test123"), Host: listen.Addr().String()}),
+	}}
+	defer client.CloseIdleConnections()
+
+	for _, path := range []string{"/a", "/b"} {
+		resp, err := client.Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "GET "+path+" " {
+			t.Fatalf("unexpected response: %s %q", resp.Status, body)
+		}
+	}
+	// both requests went over one connection
+	if ev := testSessionEvent(t, events); ev.Type != SessionOpen || ev.Info.User != "test" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event: %+v", ev)
+	default:
+	}
+
+	// a body of unknown length is sent chunked
+	data := newData(4096)
+	resp, err := client.Post(origin.URL+"/c", "application/octet-stream", io.MultiReader(strings.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "POST /c "+data {
+		t.Fatalf("unexpected response: %s", resp.Status)
+	}
+
+	// an upgraded connection turns into a tunnel
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET "+origin.URL+"/ws HTTP/1.1\r\nHost: "+origin.Listener.Addr().String()+
+		"\r\nProxy-Authorization: Basic dGVzdDp0ZXN0MTIz\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("unexpected response: %s", resp.Status)
+	}
+	testConn(t, &bufConn{Conn: conn, r: br}, newData(4096))
+}
+
+func TestHTTPCONNECTDialer(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	events := make(chan SessionEvent, 16)
+	listen := testHTTPServer(t, events)
+	auth := &S5AuthPassword{User: "test", Password: "test123"}
+
+	dr, err := HTTPCONNECT(listen.Addr().Network(), listen.Addr().String(), auth, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(4096))
+	_ = conn.Close()
+	_, err = dr.Dial("tcp", "127.0.0.1:1")
+	var re *ReplyError
+	if !errors.As(err, &re) || re.Code != socks5CMDRespConnNotAllowed {
+		t.Fatalf("want connection not allowed, got %v", err)
+	}
+	if _, err = dr.Dial("udp", ln.Addr().String()); err != ErrNetworkNotSupport {
+		t.Fatalf("want network not support, got %v", err)
+	}
+
+	// as the forward of a socks dialer
+	sdr, err := SOCKS5CONNECTP(listen.Addr().Network(), listen.Addr().String(), auth, dr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = sdr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(4096))
+	_ = conn.Close()
+
+	dr, err = HTTPCONNECT(listen.Addr().Network(), listen.Addr().String(), &S5AuthPassword{User: "test", Password: "wrong"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dr.Dial(ln.Addr().Network(), ln.Addr().String()); !errors.Is(err, ErrHTTPAuthRejected) {
+		t.Fatalf("want auth rejected, got %v", err)
+	}
+
+	// https proxy
+	self := testCert(t, "self", nil)
+	listen2 := testServer(t, &ServerConfig{
+		VersionSwitch: VersionSwitch{SwitchHTTP: true},
+		CMDConfig:     DefaultSocksCMDConfig,
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{self}},
+		Socks5AuthCb:  S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+	})
+	dr, err = HTTPCONNECT(listen2.Addr().Network(), listen2.Addr().String(), nil, nil, nil, WithTLS(nil, TLSPin(self.Leaf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(4096))
+	_ = conn.Close()
+}
+
+func TestHTTPCONNECTDialerHeader(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Header.Get("X-Tenant") != "blue" {
+			_ = writeHTTPStatus(conn, http.StatusBadRequest)
+			return
+		}
+		// the first bytes of the tunnel come with the response
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\nhello")
+	}()
+	dr, err := HTTPCONNECT("tcp", listen.Addr().String(), nil, http.Header{"X-Tenant": {"blue"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	b, err := io.ReadAll(conn)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("want hello, got %q %v", b, err)
+	}
+}
@@ -2,8 +2,10 @@ package socks
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -26,30 +28,15 @@ func (s *Server) handleSocks4(conn *serverConn) (err error) {
 	if err != nil {
 		return err
 	}
-	bs, err := reader.ReadBytes(socks4ByteNull)
+	bs, err := readSocks4Str(reader)
 	if err != nil {
 		return err
 	}
-	//userid check
-	userId := bs[:len(bs)-1]
-	if s.cfg.Socks4AuthCb.Socks4UserIdAuth != nil {
-		nconn, code := s.cfg.Socks4AuthCb.Socks4UserIdAuth(conn.Conn, userId)
-		if code == socks4RespCodeGranted {
-			conn.Conn = nconn
-		} else if code == socks4RespCodeRejectedClientIdentd || code == socks4RespCodeRejectedDifferentUserId {
-			otherCode = byte(code)
-			return ErrSocks4UserIdInvalid
-		} else {
-			otherCode = socks4RespCodeRejectedFailed
-			return ErrSocks4UserIdInvalid
-		}
-	}
-
 	//parse addr
 	addr := ""
 	if buf[3] == 0 && buf[4] == 0 && buf[5] == 0 && buf[6] != 0 {
 		//socks4a
-		bs2, err := reader.ReadBytes(socks4ByteNull)
+		bs2, err := readSocks4Str(reader)
 		if err != nil {
 			return err
 		}
@@ -61,11 +48,36 @@ func (s *Server) handleSocks4(conn *serverConn) (err error) {
 		addr = fmt.Sprintf("%s:%d", net.IP(buf[socks4CDLen+socks4DSTPORTLen:socks4CDLen+socks4DSTPORTLen+socks4DSTIPLen]).String(), binary.BigEndian.Uint16(buf[socks4CDLen:socks4CDLen+socks4DSTPORTLen]))
 	}
 
+	// what the client sent past the request belongs to the stream
+	conn.Conn = unreadConn(conn.Conn, reader)
+
+	//userid check
+	userId := bs[:len(bs)-1]
+	if !conn.certAuth {
+		conn.sess.info.User = string(userId)
+	}
+	if s.cfg.Socks4AuthCb.Socks4UserIdAuth != nil && !conn.certAuth {
+		nconn, code := s.cfg.Socks4AuthCb.Socks4UserIdAuth(conn.Conn, userId)
+		if code == socks4RespCodeGranted {
+			conn.Conn = nconn
+		} else if code == socks4RespCodeRejectedClientIdentd || code == socks4RespCodeRejectedDifferentUserId {
+			otherCode = byte(code)
+			return ErrSocks4UserIdInvalid
+		} else {
+			otherCode = socks4RespCodeRejectedFailed
+			return ErrSocks4UserIdInvalid
+		}
+	}
+
 	switch buf[0] {
 	case socks4CDCONNECT:
 		if !s.cfg.CMDConfig.SwitchCMDCONNECT {
 			return ErrSocks4CDNotSupport
 		}
+		err = s.allowConn(conn, "CONNECT", addr)
+		if err != nil {
+			return err
+		}
 		err = s.handleSocks4CDCONNECT(conn, addr)
 		if err != nil {
 			return err
@@ -75,6 +87,10 @@ func (s *Server) handleSocks4(conn *serverConn) (err error) {
 		if !s.cfg.CMDConfig.SwitchCMDBIND {
 			return ErrSocks4CDNotSupport
 		}
+		err = s.allowConn(conn, "BIND", addr)
+		if err != nil {
+			return err
+		}
 		err = s.handleSocks4CDBIND(conn, addr)
 		if err != nil {
 			return err
@@ -86,24 +102,19 @@ func (s *Server) handleSocks4(conn *serverConn) (err error) {
 }
 
 func (s *Server) handleSocks4CDCONNECT(conn *serverConn, addr string) error {
-	var handler CMDCONNECTHandler
-	ctx := s.ctx
-	if s.cfg.DialTimeout != 0 {
-		tmpctx, cancel := context.WithTimeout(s.ctx, s.cfg.DialTimeout)
-		defer cancel()
-		ctx = tmpctx
-	}
-	if s.cfg.CMDConfig.CMDCONNECTHandler != nil {
-		handler = s.cfg.CMDConfig.CMDCONNECTHandler
-	} else {
-		handler = DefaultCMDCONNECTHandler
-	}
-	cc, err := handler(ctx, addr)
+	ctx, stop := conn.watchClient()
+	cc, err := s.connect(ctx, conn.sess, addr)
+	stop()
 	if err != nil {
 		return err
 	}
 	conn.copyConn = cc
-	return conn.writeSocks4Resp(socks4RespCodeGranted, conn.LocalAddr())
+	err = conn.writeSocks4Resp(socks4RespCodeGranted, conn.LocalAddr())
+	if err != nil {
+		return err
+	}
+	s.wrapTCPDataConn(conn)
+	return nil
 }
 
 func (s *Server) handleSocks4CDBIND(conn *serverConn, addr string) error {
@@ -114,7 +125,10 @@ func (s *Server) handleSocks4CDBIND(conn *serverConn, addr string) error {
 		handler = DefaultCMDBINDHandler
 	}
 	ch := make(chan net.Conn)
-	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.BindTimeout)
+	wctx, stop := conn.watchClient()
+	defer stop()
+	ctx, cancel := context.WithTimeout(s.netContext(wctx, conn.sess), s.cfg.BindTimeout)
+	s.setHandshakeDeadline(conn, s.cfg.BindTimeout)
 	defer cancel()
 	laddr, err := handler(ctx, ch, addr)
 	if err != nil {
@@ -127,8 +141,39 @@ func (s *Server) handleSocks4CDBIND(conn *serverConn, addr string) error {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
-	case bc := <-ch:
+	case bc, ok := <-ch:
+		if !ok {
+			return ErrSocksBINDFailure
+		}
 		conn.copyConn = bc
-		return conn.writeSocks4Resp(socks4RespCodeGranted, bc.RemoteAddr())
+		// the bytes the client sent early go through the TCPDataHandler too
+		stop()
+		err = conn.writeSocks4Resp(socks4RespCodeGranted, bc.RemoteAddr())
+		if err != nil {
+			return err
+		}
+		s.wrapTCPDataConn(conn)
+		return nil
+	}
+}
+
+// unreadConn gives back the bytes r buffered past the request before reading conn again
+func unreadConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r.Buffered() == 0 {
+		return conn
+	}
+	b, _ := r.Peek(r.Buffered())
+	return &bufConn{Conn: conn, r: io.MultiReader(bytes.NewReader(append([]byte{}, b...)), conn)}
+}
+
+// readSocks4Str reads a NULL terminated USERID or socks4a host, bounded by the reader buffer size
+func readSocks4Str(reader *bufio.Reader) ([]byte, error) {
+	bs, err := reader.ReadSlice(socks4ByteNull)
+	if err != nil {
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return nil, ErrSocksMessageParsingFailure
+		}
+		return nil, err
 	}
+	return append([]byte{}, bs...), nil
 }
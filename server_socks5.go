@@ -31,35 +31,25 @@ func (s *Server) handleSocks5Auth(conn *serverConn, methods []byte) (err error)
 	for _, one := range methods {
 		m[one] = true
 	}
+	if conn.certAuth && m[socks5METHODCodeNOAUTH] {
+		//the certificate already authenticated the client
+		return conn.writeSocks5AuthResp(socks5METHODCodeNOAUTH)
+	}
 	var method byte = socks5RETHODCodeRejected
 	var methodCode byte = socks5RETHODCodeRejected
 	for _, one := range s.cfg.Socks5AuthCb.socks5AuthPriority {
-		if method != 0xFF {
+		if m[one] {
+			methodCode = one
 			break
 		}
-		switch one {
-		case socks5METHODCodeNOAUTH, socks5METHODCodeGSSAPI, socks5METHODCodePASSWORD:
-			if m[one] {
-				method = one
-				methodCode = one
-			}
-		case socks5METHODCodeIANA:
-			for i := one; i < socks5METHODCodePRIVATE; i++ {
-				if m[i] {
-					method = one
-					methodCode = i
-					break
-				}
-			}
-		case socks5METHODCodePRIVATE:
-			for i := one; i < socks5RETHODCodeRejected; i++ {
-				if m[i] {
-					method = one
-					methodCode = i
-					break
-				}
-			}
-		}
+	}
+	switch {
+	case methodCode < socks5METHODCodeIANA:
+		method = methodCode
+	case methodCode < socks5METHODCodePRIVATE:
+		method = socks5METHODCodeIANA
+	case methodCode < socks5RETHODCodeRejected:
+		method = socks5METHODCodePRIVATE
 	}
 	err = conn.writeSocks5AuthResp(methodCode)
 	if err != nil {
@@ -95,7 +85,7 @@ func (s *Server) handleSocks5Auth(conn *serverConn, methods []byte) (err error)
 		if err != nil {
 			return ErrSocks5AuthRejected
 		}
-		user := string(buf[:ul])
+		user := s.egressUser(conn, string(buf[:ul]))
 		pl := int(buf[ul])
 		buf = make([]byte, pl)
 		_, err = io.ReadFull(conn, buf)
@@ -161,19 +151,41 @@ func (s *Server) handleSocks5CMD(conn *serverConn) (err error) {
 			_ = conn.writeSocks5CMDResp(socks5CMDRespCMDNotSupported, conn.LocalAddr())
 			return ErrSocks5CMDNotSupport
 		}
+		err = s.allowSocks5(conn, "CONNECT", addr)
+		if err != nil {
+			return err
+		}
 		return s.handleSocks5CMDCONNECT(conn, addr)
 	case socks5CMDBIND:
 		if !s.cfg.CMDConfig.SwitchCMDBIND {
 			_ = conn.writeSocks5CMDResp(socks5CMDRespCMDNotSupported, conn.LocalAddr())
 			return ErrSocks5CMDNotSupport
 		}
+		err = s.allowSocks5(conn, "BIND", addr)
+		if err != nil {
+			return err
+		}
 		return s.handleSocks5CMDBind(conn, addr)
 	case socks5CMDUDPASSOCIATE:
 		if !s.cfg.CMDConfig.SwitchCMDUDPASSOCIATE {
 			_ = conn.writeSocks5CMDResp(socks5CMDRespCMDNotSupported, conn.LocalAddr())
 			return ErrSocks5CMDNotSupport
 		}
+		err = s.allowSocks5(conn, "UDPASSOCIATE", addr)
+		if err != nil {
+			return err
+		}
 		return s.handleSocks5CMDUDPASSOCIATE(conn, addr)
+	case socks5CMDUDPOVERTCP:
+		if !s.cfg.CMDConfig.SwitchCMDUDPOVERTCP {
+			_ = conn.writeSocks5CMDResp(socks5CMDRespCMDNotSupported, conn.LocalAddr())
+			return ErrSocks5CMDNotSupport
+		}
+		err = s.allowSocks5(conn, "UDPOVERTCP", addr)
+		if err != nil {
+			return err
+		}
+		return s.handleSocks5CMDUDPOVERTCP(conn)
 	default:
 		_ = conn.writeSocks5CMDResp(socks5CMDRespCMDNotSupported, conn.LocalAddr())
 		return ErrSocksMessageParsingFailure
@@ -181,25 +193,20 @@ func (s *Server) handleSocks5CMD(conn *serverConn) (err error) {
 }
 
 func (s *Server) handleSocks5CMDCONNECT(conn *serverConn, addr string) error {
-	var handler CMDCONNECTHandler
-	ctx := s.ctx
-	if s.cfg.DialTimeout != 0 {
-		tmpctx, cancel := context.WithTimeout(s.ctx, s.cfg.DialTimeout)
-		defer cancel()
-		ctx = tmpctx
-	}
-	if s.cfg.CMDConfig.CMDCONNECTHandler != nil {
-		handler = s.cfg.CMDConfig.CMDCONNECTHandler
-	} else {
-		handler = DefaultCMDCONNECTHandler
-	}
-	cc, err := handler(ctx, addr)
+	ctx, stop := conn.watchClient()
+	cc, err := s.connect(ctx, conn.sess, addr)
+	stop()
 	if err != nil {
-		_ = conn.writeSocks5CMDResp(socks5CMDRespNetworkUnreachable, conn.LocalAddr())
+		_ = conn.writeSocks5CMDResp(getReplyCode(err, socks5CMDRespNetworkUnreachable), conn.LocalAddr())
 		return err
 	}
 	conn.copyConn = cc
-	return conn.writeSocks5CMDResp(socks5CMDRespSuccess, conn.LocalAddr())
+	err = conn.writeSocks5CMDResp(socks5CMDRespSuccess, conn.LocalAddr())
+	if err != nil {
+		return err
+	}
+	s.wrapTCPDataConn(conn)
+	return nil
 }
 
 func (s *Server) handleSocks5CMDBind(conn *serverConn, addr string) error {
@@ -210,11 +217,14 @@ func (s *Server) handleSocks5CMDBind(conn *serverConn, addr string) error {
 		handler = DefaultCMDBINDHandler
 	}
 	ch := make(chan net.Conn)
-	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.BindTimeout)
+	wctx, stop := conn.watchClient()
+	defer stop()
+	ctx, cancel := context.WithTimeout(s.netContext(wctx, conn.sess), s.cfg.BindTimeout)
+	s.setHandshakeDeadline(conn, s.cfg.BindTimeout)
 	defer cancel()
 	laddr, err := handler(ctx, ch, addr)
 	if err != nil {
-		_ = conn.writeSocks5CMDResp(socks5CMDRespHostUnreachable, conn.LocalAddr())
+		_ = conn.writeSocks5CMDResp(getReplyCode(err, socks5CMDRespHostUnreachable), conn.LocalAddr())
 		return err
 	}
 	err = conn.writeSocks5CMDResp(socks5CMDRespSuccess, laddr)
@@ -232,7 +242,14 @@ func (s *Server) handleSocks5CMDBind(conn *serverConn, addr string) error {
 			return err
 		}
 		conn.copyConn = bc
-		return conn.writeSocks5CMDResp(socks5CMDRespSuccess, bc.RemoteAddr())
+		// the bytes the client sent early go through the TCPDataHandler too
+		stop()
+		err = conn.writeSocks5CMDResp(socks5CMDRespSuccess, bc.RemoteAddr())
+		if err != nil {
+			return err
+		}
+		s.wrapTCPDataConn(conn)
+		return nil
 	}
 }
 
@@ -258,19 +275,9 @@ func (s *Server) handleSocks5CMDUDPASSOCIATE(conn *serverConn, addr string) erro
 		checkAddr = uaddr
 	}
 
-	var handler CMDCMDUDPASSOCIATEHandler
-	if s.cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler != nil {
-		handler = s.cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler
-	} else {
-		handler = DefaultCMDCMDUDPASSOCIATEHandler
-	}
-	ctx := s.ctx
-	if s.cfg.UdpTimeout != 0 {
-		ctx = context.WithValue(s.ctx, udpTimeoutKey, s.cfg.UdpTimeout)
-	}
-	pconn, err := handler(ctx, checkAddr)
+	pconn, err := s.getUDPASSOCIATEHandler()(s.udpContext(conn.ctx, conn.sess), checkAddr)
 	if err != nil {
-		_ = conn.writeSocks5CMDResp(socks5CMDRespHostUnreachable, conn.LocalAddr())
+		_ = conn.writeSocks5CMDResp(getReplyCode(err, socks5CMDRespHostUnreachable), conn.LocalAddr())
 		return err
 	}
 	conn.udpConn = pconn
@@ -281,3 +288,42 @@ func (s *Server) handleSocks5CMDUDPASSOCIATE(conn *serverConn, addr string) erro
 	}
 	return nil
 }
+
+func (s *Server) handleSocks5CMDUDPOVERTCP(conn *serverConn) error {
+	// the handler relays through the control connection instead of listening on udp
+	ctx := context.WithValue(s.udpContext(conn.ctx, conn.sess), udpPacketConnKey, net.PacketConn(newTCPPacketConn(conn.Conn)))
+	pconn, err := s.getUDPASSOCIATEHandler()(ctx, nil)
+	if err != nil {
+		_ = conn.writeSocks5CMDResp(getReplyCode(err, socks5CMDRespHostUnreachable), conn.LocalAddr())
+		return err
+	}
+	conn.udpConn = pconn
+	conn.udpOverTCP = true
+	err = conn.writeSocks5CMDResp(socks5CMDRespSuccess, conn.LocalAddr())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) getUDPASSOCIATEHandler() CMDCMDUDPASSOCIATEHandler {
+	if s.cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler != nil {
+		return s.cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler
+	}
+	return DefaultCMDCMDUDPASSOCIATEHandler
+}
+
+// udpContext carries the udp settings to the handler in ctx of the session
+func (s *Server) udpContext(ctx context.Context, sess *session) context.Context {
+	ctx = s.netContext(ctx, sess)
+	if s.cfg.UdpTimeout != 0 {
+		ctx = context.WithValue(ctx, udpTimeoutKey, s.cfg.UdpTimeout)
+	}
+	if s.cfg.UDPFilter != nil {
+		ctx = context.WithValue(ctx, udpFilterKey, s.cfg.UDPFilter)
+	}
+	if s.cfg.CMDConfig.UDPDataHandler != nil {
+		ctx = context.WithValue(ctx, udpHandlerKey, s.cfg.CMDConfig.UDPDataHandler)
+	}
+	return ctx
+}
@@ -0,0 +1,344 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo describes one proxied request of a Server or a RelayServer
+type SessionInfo struct {
+	Id         uint64
+	Proto      string //socks4, socks5, http, transparent or relay
+	Cmd        string //CONNECT, BIND, UDPASSOCIATE or UDPOVERTCP, empty until the request was read
+	User       string //socks5 user, socks4 user-id or relay auth id
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+	Target     string //the requested address
+	Egress     net.IP //the source address the EgressPool chose
+	Start      time.Time
+	BytesIn    uint64 //read from the client, set on SessionClose
+	BytesOut   uint64 //written to the client, set on SessionClose
+}
+
+type SessionEventType int
+
+const (
+	SessionOpen   SessionEventType = iota //the request was granted
+	SessionClose                          //a granted session ended, Err is the timer that ended it if any
+	SessionReject                         //the handshake or the request failed, Err says why
+)
+
+func (t SessionEventType) String() string {
+	switch t {
+	case SessionOpen:
+		return "open"
+	case SessionClose:
+		return "close"
+	case SessionReject:
+		return "reject"
+	default:
+		return "unknown"
+	}
+}
+
+type SessionEvent struct {
+	Type SessionEventType
+	Info SessionInfo
+	Err  error
+}
+
+// SessionHook is called for every event of every session, it must not block for long
+type SessionHook func(event SessionEvent)
+
+// Ruleset is asked once the request of a session is known, an error rejects it.
+// socks5 and relay clients get the code of a *ReplyError, otherwise "connection not allowed by ruleset"
+type Ruleset func(ctx context.Context, info SessionInfo) error
+
+var sessionId atomic.Uint64
+
+// session tracks a connection for the Ruleset and the SessionHook
+type session struct {
+	info    SessionInfo
+	hook    SessionHook
+	ruleset Ruleset
+	opened  bool
+	in, out atomic.Uint64
+	last    atomic.Int64 //unix nano of the last traffic
+	once    sync.Once
+
+	egressSession string //the session id of the user, see EgressPool
+}
+
+func newSession(proto string, rwc io.ReadWriteCloser, ruleset Ruleset, hook SessionHook) *session {
+	sess := &session{
+		info: SessionInfo{
+			Id:    sessionId.Add(1),
+			Proto: proto,
+			Start: time.Now(),
+		},
+		hook:    hook,
+		ruleset: ruleset,
+	}
+	if conn, ok := rwc.(net.Conn); ok {
+		sess.info.LocalAddr = conn.LocalAddr()
+		sess.info.RemoteAddr = conn.RemoteAddr()
+	}
+	return sess
+}
+
+// allow records the request and asks the Ruleset
+func (sess *session) allow(ctx context.Context, cmd string, target string) error {
+	sess.info.Cmd = cmd
+	sess.info.Target = target
+	if sess.ruleset == nil {
+		return nil
+	}
+	return sess.ruleset(ctx, sess.info)
+}
+
+func (sess *session) open() {
+	sess.opened = true
+	sess.emit(SessionOpen, nil)
+}
+
+// end reports SessionClose for a granted session and SessionReject otherwise, only the first call counts
+func (sess *session) end(err error) {
+	sess.once.Do(func() {
+		if !sess.opened {
+			sess.emit(SessionReject, err)
+			return
+		}
+		sess.info.BytesIn = sess.in.Load()
+		sess.info.BytesOut = sess.out.Load()
+		sess.emit(SessionClose, err)
+	})
+}
+
+// add counts n bytes of traffic
+func (sess *session) add(counter *atomic.Uint64, n int64) {
+	if n > 0 {
+		counter.Add(uint64(n))
+		sess.last.Store(time.Now().UnixNano())
+	}
+}
+
+// watch calls stop once the session had no traffic for idle or lived for lifetime, zero disables either,
+// it returns the reason, or nil if done was closed first
+func (sess *session) watch(done <-chan struct{}, idle time.Duration, lifetime time.Duration, stop func()) error {
+	var idleC, lifeC <-chan time.Time
+	if lifetime != 0 {
+		lt := time.NewTimer(lifetime - time.Since(sess.info.Start))
+		defer lt.Stop()
+		lifeC = lt.C
+	}
+	var it *time.Timer
+	if idle != 0 {
+		sess.last.CompareAndSwap(0, time.Now().UnixNano())
+		it = time.NewTimer(idle)
+		defer it.Stop()
+		idleC = it.C
+	}
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-lifeC:
+			stop()
+			return ErrSessionLifetime
+		case <-idleC:
+			quiet := time.Duration(time.Now().UnixNano() - sess.last.Load())
+			if quiet >= idle {
+				stop()
+				return ErrSessionIdleTimeout
+			}
+			it.Reset(idle - quiet)
+		}
+	}
+}
+
+func (sess *session) emit(t SessionEventType, err error) {
+	if sess.hook != nil {
+		sess.hook(SessionEvent{Type: t, Info: sess.info, Err: err})
+	}
+}
+
+// countConn counts the bytes of the client side of a session
+type countConn struct {
+	net.Conn
+	sess *session
+}
+
+func (cc *countConn) Read(b []byte) (n int, err error) {
+	n, err = cc.Conn.Read(b)
+	cc.sess.add(&cc.sess.in, int64(n))
+	return n, err
+}
+
+func (cc *countConn) Write(b []byte) (n int, err error) {
+	n, err = cc.Conn.Write(b)
+	cc.sess.add(&cc.sess.out, int64(n))
+	return n, err
+}
+
+func (cc *countConn) CloseWrite() error {
+	return closeWriteOf(cc.Conn)
+}
+
+type countReadWriteCloser struct {
+	io.ReadWriteCloser
+	sess *session
+}
+
+func (crwc *countReadWriteCloser) Read(b []byte) (n int, err error) {
+	n, err = crwc.ReadWriteCloser.Read(b)
+	crwc.sess.add(&crwc.sess.in, int64(n))
+	return n, err
+}
+
+func (crwc *countReadWriteCloser) Write(b []byte) (n int, err error) {
+	n, err = crwc.ReadWriteCloser.Write(b)
+	crwc.sess.add(&crwc.sess.out, int64(n))
+	return n, err
+}
+
+func (crwc *countReadWriteCloser) CloseWrite() error {
+	return closeWriteOf(crwc.ReadWriteCloser)
+}
+
+// serverLife is the lifecycle shared by Server and RelayServer
+type serverLife struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// canceled by Shutdown to stop the listeners only
+	lnCtx    context.Context
+	lnCancel context.CancelFunc
+
+	mux sync.Mutex
+	wg  sync.WaitGroup
+	lns map[net.Listener]struct{} // served ones, for Handoff
+}
+
+func (sl *serverLife) init(ctx context.Context) {
+	sl.ctx, sl.cancel = context.WithCancel(ctx)
+	sl.lnCtx, sl.lnCancel = context.WithCancel(sl.ctx)
+}
+
+func (sl *serverLife) serve(ln net.Listener, handle func(ctx context.Context, conn net.Conn)) error {
+	sl.mux.Lock()
+	if sl.lnCtx.Err() != nil {
+		sl.mux.Unlock()
+		return sl.lnCtx.Err()
+	}
+	// the listener holds the group while it adds connections
+	sl.wg.Add(1)
+	if sl.lns == nil {
+		sl.lns = make(map[net.Listener]struct{})
+	}
+	sl.lns[ln] = struct{}{}
+	sl.mux.Unlock()
+	defer func() {
+		sl.mux.Lock()
+		delete(sl.lns, ln)
+		sl.mux.Unlock()
+		sl.wg.Done()
+	}()
+	ctx, cancel := context.WithCancel(sl.lnCtx)
+	defer cancel()
+	waitFunc(ctx, func() {
+		_ = ln.Close()
+	})
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		sl.wg.Add(1)
+		go func() {
+			defer sl.wg.Done()
+			ctx, cl := context.WithCancel(sl.ctx)
+			defer cl()
+			waitFunc(ctx, func() {
+				_ = conn.Close()
+			})
+			handle(ctx, conn)
+		}()
+	}
+}
+
+// serveConn runs handle for a connection accepted by the caller, as serve does. ctx ends it early
+func (sl *serverLife) serveConn(ctx context.Context, conn net.Conn, handle func(ctx context.Context, conn net.Conn)) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !sl.track() {
+		_ = conn.Close()
+		return sl.lnCtx.Err()
+	}
+	defer sl.wg.Done()
+	hctx, cl := context.WithCancel(sl.ctx)
+	defer cl()
+	go func() {
+		select {
+		case <-ctx.Done():
+			cl()
+		case <-hctx.Done():
+		}
+	}()
+	waitFunc(hctx, func() {
+		_ = conn.Close()
+	})
+	handle(hctx, conn)
+	return ctx.Err()
+}
+
+// listeners returns the listeners being served
+func (sl *serverLife) listeners() []net.Listener {
+	sl.mux.Lock()
+	defer sl.mux.Unlock()
+	lns := make([]net.Listener, 0, len(sl.lns))
+	for ln := range sl.lns {
+		lns = append(lns, ln)
+	}
+	return lns
+}
+
+// track adds a session to the group unless the server shuts down
+func (sl *serverLife) track() bool {
+	sl.mux.Lock()
+	defer sl.mux.Unlock()
+	if sl.lnCtx.Err() != nil {
+		return false
+	}
+	sl.wg.Add(1)
+	return true
+}
+
+func (sl *serverLife) Close() error {
+	sl.cancel()
+	return sl.ctx.Err()
+}
+
+// Shutdown closes the listeners and waits for the sessions to end,
+// once ctx is done the remaining ones are closed and ctx.Err() is returned
+func (sl *serverLife) Shutdown(ctx context.Context) error {
+	sl.mux.Lock()
+	sl.lnCancel()
+	sl.mux.Unlock()
+	done := make(chan struct{})
+	go func() {
+		sl.wg.Wait()
+		close(done)
+	}()
+	defer sl.cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
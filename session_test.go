@@ -0,0 +1,521 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testSessionEvent(t *testing.T, events <-chan SessionEvent) SessionEvent {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(3 * time.Second):
+		t.Fatal("no session event")
+		return SessionEvent{}
+	}
+}
+
+func TestServerSession(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	denied := testListen(t)
+	defer denied.Close()
+	events := make(chan SessionEvent, 8)
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthPASSWORD: func(conn net.Conn, auth S5AuthPassword) net.Conn {
+				return auth.IsEqual2(conn, "test", "test123")
+			},
+		},
+		Ruleset: func(ctx context.Context, info SessionInfo) error {
+			if info.Target == denied.Addr().String() {
+				return ErrRelayNotAllowed
+			}
+			return nil
+		},
+		SessionHook: func(event SessionEvent) {
+			events <- event
+		},
+	}
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	dr, err := SOCKS5CONNECTP(listen.Addr().Network(), listen.Addr().String(), &S5AuthPassword{
+		User:     "test",
+		Password: "test123",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := testSessionEvent(t, events)
+	if ev.Type != SessionOpen || ev.Info.Proto != "socks5" || ev.Info.Cmd != "CONNECT" ||
+		ev.Info.User != "test" || ev.Info.Target != ln.Addr().String() {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	testConn(t, conn, newData(4096))
+	_ = conn.Close()
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionClose || ev.Info.BytesIn < 4096 || ev.Info.BytesOut < 4096 {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	_, err = dr.Dial(denied.Addr().Network(), denied.Addr().String())
+	if err == nil {
+		t.Fatal("ruleset did not reject")
+	}
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionReject || !errors.Is(ev.Err, ErrRelayNotAllowed) {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+func TestRelayServer(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	denied := testListen(t)
+	defer denied.Close()
+	events := make(chan SessionEvent, 8)
+	rs, err := NewRelayServer(context.Background(), &RelayConfig{
+		Ruleset: func(ctx context.Context, info SessionInfo) error {
+			if info.Target == denied.Addr().String() {
+				return &ReplyError{Code: socks5CMDRespHostUnreachable, Err: ErrRelayNotAllowed}
+			}
+			return nil
+		},
+		SessionHook: func(event SessionEvent) {
+			events <- event
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- rs.Serve(listen)
+	}()
+	cb := func(ctx context.Context) (net.Conn, error) {
+		dr := net.Dialer{}
+		return dr.DialContext(ctx, listen.Addr().Network(), listen.Addr().String())
+	}
+	ctx := context.Background()
+
+	_, err = RelayCMDCONNECTHandler(cb)(ctx, denied.Addr().String())
+	var re *ReplyError
+	if !errors.As(err, &re) || re.Code != socks5CMDRespHostUnreachable {
+		t.Fatalf("want host unreachable, got %v", err)
+	}
+	ev := testSessionEvent(t, events)
+	if ev.Type != SessionReject || ev.Info.Proto != "relay" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	conn, err := RelayCMDCONNECTHandler(cb)(ctx, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testConn(t, conn, newData(4096))
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionOpen || ev.Info.Cmd != "CONNECT" || ev.Info.Target != ln.Addr().String() {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	// the open session holds the shutdown until its ctx is done
+	sctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if err = rs.Shutdown(sctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionClose || ev.Info.BytesOut < 4096 {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	if _, err = cb(ctx); err == nil {
+		t.Fatal("listener still open")
+	}
+	if err = rs.Serve(listen); err == nil {
+		t.Fatal("Serve after Shutdown")
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	events := make(chan SessionEvent, 8)
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb:  S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+		ConnTimeout:   200 * time.Millisecond,
+		IdleTimeout:   300 * time.Millisecond,
+		MaxLifetime:   1500 * time.Millisecond,
+		SessionHook: func(event SessionEvent) {
+			if event.Type != SessionOpen {
+				events <- event
+			}
+		},
+	})
+
+	// a client that stalls in the handshake is dropped
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte{socksVersion5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := testSessionEvent(t, events)
+	if ev.Type != SessionReject || ev.Err != ErrHandshakeTimeout {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	_ = conn.Close()
+
+	dr, err := SOCKS5CONNECT(listen.Addr().Network(), listen.Addr().String(), &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// traffic keeps a relay open past the handshake and idle timeouts
+	conn, err = dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		time.Sleep(150 * time.Millisecond)
+		testConn(t, conn, newData(64))
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("idle relay not closed")
+	}
+	_ = conn.Close()
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionClose || ev.Err != ErrSessionIdleTimeout {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	// and the lifetime ends it anyway
+	conn, err = dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	for time.Since(start) < 3*time.Second {
+		time.Sleep(100 * time.Millisecond)
+		_, err = conn.Write([]byte("ping"))
+		if err != nil {
+			break
+		}
+		_, err = conn.Read(make([]byte, 4))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		t.Fatal("session outlived MaxLifetime")
+	}
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionClose || ev.Err != ErrSessionLifetime {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+func TestServerClientGone(t *testing.T) {
+	started := make(chan struct{}, 2)
+	gone := make(chan struct{}, 2)
+	wait := func(ctx context.Context) {
+		started <- struct{}{}
+		<-ctx.Done()
+		gone <- struct{}{}
+	}
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig: CMDConfig{
+			SwitchCMDCONNECT: true,
+			SwitchCMDBIND:    true,
+			CMDCONNECTHandler: func(ctx context.Context, addr string) (net.Conn, error) {
+				wait(ctx)
+				return nil, ctx.Err()
+			},
+			CMDBINDHandler: func(ctx context.Context, ch chan<- net.Conn, raddr string) (net.Addr, error) {
+				wait(ctx)
+				return nil, ctx.Err()
+			},
+		},
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+		BindTimeout: time.Minute,
+	})
+	for _, cmd := range []byte{socks5CMDCONNECT, socks5CMDBIND} {
+		conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write([]byte{socksVersion5, 1, socks5METHODCodeNOAUTH, socksVersion5, cmd, 0, socks5AddrTypeIPv4, 127, 0, 0, 1, 0, 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-started:
+		case <-time.After(3 * time.Second):
+			t.Fatal("handler not called")
+		}
+		_ = conn.Close()
+		select {
+		case <-gone:
+		case <-time.After(3 * time.Second):
+			t.Fatal("handler context not cancelled")
+		}
+	}
+}
+
+func TestServerHTTPClientGone(t *testing.T) {
+	started := make(chan struct{}, 1)
+	gone := make(chan struct{}, 1)
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: VersionSwitch{SwitchHTTP: true},
+		CMDConfig: CMDConfig{
+			SwitchCMDCONNECT: true,
+			CMDCONNECTHandler: func(ctx context.Context, addr string) (net.Conn, error) {
+				started <- struct{}{}
+				<-ctx.Done()
+				gone <- struct{}{}
+				return nil, ctx.Err()
+			},
+		},
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+	})
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("CONNECT 127.0.0.1:1 HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler not called")
+	}
+	_ = conn.Close()
+	select {
+	case <-gone:
+	case <-time.After(3 * time.Second):
+		t.Fatal("handler context not cancelled")
+	}
+}
+
+func TestServerBINDEarlyData(t *testing.T) {
+	tcpCb := testStreamHandler{testAddHandler(3)}
+	cmdCfg := DefaultSocksCMDConfig
+	cmdCfg.TCPDataHandler = tcpCb
+	// the default listener is on [::], which a socks4 reply cannot carry
+	cmdCfg.CMDBINDHandler = func(ctx context.Context, ch chan<- net.Conn, raddr string) (net.Addr, error) {
+		laddr, err := DefaultCMDBINDHandler(ctx, ch, raddr)
+		if err != nil {
+			return nil, err
+		}
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: laddr.(*net.TCPAddr).Port}, nil
+	}
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     cmdCfg,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+	})
+	for _, v := range []byte{socksVersion4, socksVersion5} {
+		conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the default handler only takes the peer from the requested address
+		free, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		paddr := free.Addr().(*net.TCPAddr)
+		_ = free.Close()
+		pport := binary.BigEndian.AppendUint16(nil, uint16(paddr.Port))
+		req, replyLen, secondLen := []byte{socksVersion4, socks4CDBIND, pport[0], pport[1], 127, 0, 0, 1, 0}, 8, 8
+		if v == socksVersion5 {
+			req, replyLen, secondLen = []byte{socksVersion5, 1, socks5METHODCodeNOAUTH, socksVersion5, socks5CMDBIND, 0, socks5AddrTypeIPv4, 127, 0, 0, 1, pport[0], pport[1]}, 2+10, 10
+		}
+		_, err = conn.Write(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, replyLen)
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := binary.BigEndian.Uint16(reply[2:4])
+		if v == socksVersion5 {
+			port = binary.BigEndian.Uint16(reply[len(reply)-2:])
+		}
+		// the client does not wait for the peer before it sends
+		dconn := newTCPDataConn(conn, tcpCb)
+		data := newData(64)
+		_, err = dconn.Write([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		dr := net.Dialer{LocalAddr: paddr}
+		peer, err := dr.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadFull(conn, reply[len(reply)-secondLen:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data))
+		_, err = io.ReadFull(peer, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != data {
+			t.Fatalf("v%d: early data not decoded", v)
+		}
+		_, err = peer.Write(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadFull(dconn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != data {
+			t.Fatalf("v%d: reply not encoded", v)
+		}
+		_ = peer.Close()
+		_ = conn.Close()
+	}
+}
+
+func TestServerRulesetClientGone(t *testing.T) {
+	started := make(chan struct{}, 1)
+	gone := make(chan struct{}, 1)
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+		Ruleset: func(ctx context.Context, info SessionInfo) error {
+			started <- struct{}{}
+			<-ctx.Done()
+			gone <- struct{}{}
+			return ctx.Err()
+		},
+	})
+	for _, req := range [][]byte{
+		{socksVersion4, socks4CDCONNECT, 0, 1, 127, 0, 0, 1, 0},
+		{socksVersion5, 1, socks5METHODCodeNOAUTH, socksVersion5, socks5CMDCONNECT, 0, socks5AddrTypeIPv4, 127, 0, 0, 1, 0, 1},
+	} {
+		conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-started:
+		case <-time.After(3 * time.Second):
+			t.Fatal("ruleset not called")
+		}
+		_ = conn.Close()
+		select {
+		case <-gone:
+		case <-time.After(3 * time.Second):
+			t.Fatal("ruleset context not cancelled")
+		}
+	}
+}
+
+func TestServerClientHalfClose(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig: CMDConfig{
+			SwitchCMDCONNECT: true,
+			CMDCONNECTHandler: func(ctx context.Context, addr string) (net.Conn, error) {
+				// the watch sees the half-close first
+				time.Sleep(100 * time.Millisecond)
+				return DefaultCMDCONNECTHandler(ctx, addr)
+			},
+		},
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+		HalfCloseHandshake: true,
+	})
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	taddr := ln.Addr().(*net.TCPAddr)
+	req := []byte{socksVersion5, 1, socks5METHODCodeNOAUTH, socksVersion5, socks5CMDCONNECT, 0, socks5AddrTypeIPv4}
+	req = append(req, taddr.IP.To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(taddr.Port))
+	data := newData(64)
+	_, err = conn.Write(append(req, data...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.(*net.TCPConn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 2+10+len(data) || b[3] != socks5CMDRespSuccess || string(b[12:]) != data {
+		t.Fatalf("unexpected reply: %v", b)
+	}
+}
@@ -0,0 +1,87 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// SocketOptions set up the outbound sockets of a session, the CONNECT dial, the BIND listener
+// and the UDP ASSOCIATE sockets of the default handlers. they need the host network, a
+// ServerConfig.Dialer or the ListenerConfigs ignore them. Interface, Mark, DSCP and UserTimeout need linux
+type SocketOptions struct {
+	LocalAddr   net.IP        //the source address
+	Interface   string        //SO_BINDTODEVICE, needs CAP_NET_RAW
+	Mark        int           //SO_MARK for policy routing, needs CAP_NET_ADMIN
+	DSCP        int           //0 to 63, set as IP_TOS or IPV6_TCLASS
+	KeepAlive   time.Duration //tcp keepalive period, 0 is the default of net, negative is off
+	UserTimeout time.Duration //TCP_USER_TIMEOUT, how long sent data may stay unacknowledged
+	// Control runs after the options above for anything else
+	Control func(network, address string, c syscall.RawConn) error
+
+	egress *EgressPool //LocalAddr came from it
+}
+
+func (o *SocketOptions) dialer() Dialer {
+	dr := &net.Dialer{
+		KeepAlive: o.KeepAlive,
+		Control:   o.control,
+	}
+	if o.LocalAddr != nil {
+		dr.LocalAddr = &net.TCPAddr{IP: o.LocalAddr}
+	}
+	if o.egress != nil {
+		return &egressDialer{Dialer: dr, o: o}
+	}
+	return dr
+}
+
+func (o *SocketOptions) listenConfig() *netListenConfig {
+	return &netListenConfig{
+		ListenConfig: net.ListenConfig{
+			KeepAlive: o.KeepAlive,
+			Control:   o.control,
+		},
+		ip:     o.LocalAddr,
+		egress: o.egress,
+	}
+}
+
+// egressDialer tells the EgressPool about an address that failed to bind
+type egressDialer struct {
+	*net.Dialer
+	o *SocketOptions
+}
+
+func (d *egressDialer) Dial(network string, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *egressDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		d.o.egress.failed(d.o.LocalAddr, err)
+	}
+	return conn, err
+}
+
+func (o *SocketOptions) control(network, address string, c syscall.RawConn) error {
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return ErrSocketOptionInvalid
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = o.setsockopt(fd, network)
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return serr
+	}
+	if o.Control != nil {
+		return o.Control(network, address, c)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package socks
+
+import (
+	"strings"
+	"syscall"
+)
+
+const tcpUserTimeout = 18 //TCP_USER_TIMEOUT
+
+func (o *SocketOptions) setsockopt(fd uintptr, network string) error {
+	s := int(fd)
+	if o.Interface != "" {
+		err := syscall.BindToDevice(s, o.Interface)
+		if err != nil {
+			return err
+		}
+	}
+	if o.Mark != 0 {
+		err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark)
+		if err != nil {
+			return err
+		}
+	}
+	if o.DSCP != 0 {
+		tos := o.DSCP << 2
+		if isIPv6Network(network) {
+			err := syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+			if err != nil {
+				return err
+			}
+			// a dual stack socket may carry ipv4 too
+			_ = syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		} else {
+			err := syscall.SetsockoptInt(s, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if o.UserTimeout > 0 && strings.HasPrefix(network, "tcp") {
+		err := syscall.SetsockoptInt(s, syscall.IPPROTO_TCP, tcpUserTimeout, int(o.UserTimeout.Milliseconds()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
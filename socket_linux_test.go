@@ -0,0 +1,53 @@
+//go:build linux
+
+package socks
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSocketOptionsLinux(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	raddr := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		raddr <- conn.RemoteAddr()
+		_ = conn.Close()
+	}()
+	got := make(chan [2]int, 1)
+	conn, err := testSocketDial(t, func(info SessionInfo) *SocketOptions {
+		return &SocketOptions{
+			LocalAddr:   net.IPv4(127, 0, 0, 2),
+			DSCP:        46,
+			UserTimeout: 5 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				// read back what was set before
+				return c.Control(func(fd uintptr) {
+					tos, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+					ut, _ := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout)
+					got <- [2]int{tos, ut}
+				})
+			},
+		}
+	}, "policy", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if v := <-got; v[0] != 46<<2 || v[1] != 5000 {
+		t.Fatalf("unexpected socket options: %v", v)
+	}
+	if addr := <-raddr; !addr.(*net.TCPAddr).IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("unexpected source: %v", addr)
+	}
+}
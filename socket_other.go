@@ -0,0 +1,10 @@
+//go:build !linux
+
+package socks
+
+func (o *SocketOptions) setsockopt(fd uintptr, network string) error {
+	if o.Interface != "" || o.Mark != 0 || o.DSCP != 0 || o.UserTimeout > 0 {
+		return ErrSocketOptionNotSupport
+	}
+	return nil
+}
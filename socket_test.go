@@ -0,0 +1,66 @@
+package socks
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+// testSocketDial dials addr through a server with control as the given user
+func testSocketDial(t *testing.T, control func(info SessionInfo) *SocketOptions, user string, addr string) (net.Conn, error) {
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthPASSWORD: func(conn net.Conn, auth S5AuthPassword) net.Conn {
+				return conn
+			},
+		},
+		SocketControl: control,
+	})
+	dr, err := SOCKS5CONNECTP(listen.Addr().Network(), listen.Addr().String(), &S5AuthPassword{User: user, Password: "x"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dr.Dial("tcp", addr)
+}
+
+func TestSocketControl(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	var controlled atomic.Int32
+	control := func(info SessionInfo) *SocketOptions {
+		if info.User != "policy" || info.Target != ln.Addr().String() {
+			return nil
+		}
+		return &SocketOptions{
+			KeepAlive: -1,
+			Control: func(network, address string, c syscall.RawConn) error {
+				controlled.Add(1)
+				return nil
+			},
+		}
+	}
+	for _, user := range []string{"other", "policy"} {
+		conn, err := testSocketDial(t, control, user, ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testConn(t, conn, newData(1024))
+		_ = conn.Close()
+	}
+	if controlled.Load() != 1 {
+		t.Fatal("socket options not applied to the session")
+	}
+
+	// a bad option fails the dial
+	_, err := testSocketDial(t, func(info SessionInfo) *SocketOptions {
+		return &SocketOptions{DSCP: 64}
+	}, "policy", ln.Addr().String())
+	var rerr *ReplyError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("invalid socket option accepted: %v", err)
+	}
+}
@@ -0,0 +1,427 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fuzzSessionTimeout = 10 * time.Second
+
+// hand-written seeds for the corners of the protocols. the corpus in testdata/fuzz holds captures:
+// the handshakes of curl and golang.org/x/net/proxy, the replies of this server to them and to the
+// clients of this package, the socks5 udp datagrams and the relay v1/v2 exchanges
+var fuzzSeedServerSocks5 = [][]byte{
+	// CONNECT to an ipv4
+	{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x50},
+	// CONNECT to a domain
+	append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 0x0b}, append([]byte("example.com"), 0x00, 0x50)...),
+	// user/password
+	append(append([]byte{0x05, 0x02, 0x00, 0x02, 0x01, 0x04}, []byte("test")...), append([]byte{0x07}, append([]byte("test123"), 0x05, 0x01, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x1f, 0x90)...)...),
+	// ipv6 CONNECT
+	{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb},
+	// BIND
+	{0x05, 0x01, 0x00, 0x05, 0x02, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x27, 0x10},
+	// UDP ASSOCIATE
+	{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	// UDP over TCP with a framed datagram and a truncated one
+	{0x05, 0x01, 0x00, 0x05, 0x83, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x0b, 0x00, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x35, 0x61,
+		0x00, 0x20, 0x00},
+	// IANA / PRIVATE methods
+	{0x05, 0x03, 0x03, 0x04, 0x80},
+	{0x05, 0x01, 0xfe},
+	// 255 bytes domain
+	append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 0xff}, append([]byte(strings.Repeat("a", 255)), 0x00, 0x50)...),
+}
+
+var fuzzSeedServerSocks4 = [][]byte{
+	// CONNECT
+	{0x04, 0x01, 0x00, 0x50, 0x7f, 0x00, 0x00, 0x01, 0x00},
+	// socks4a CONNECT to a domain
+	append([]byte{0x04, 0x01, 0x00, 0x50, 0x00, 0x00, 0x00, 0x01, 0x00}, append([]byte("example.com"), 0x00)...),
+	// userid
+	{0x04, 0x01, 0x00, 0x50, 0x7f, 0x00, 0x00, 0x01, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x00},
+	// BIND
+	{0x04, 0x02, 0x27, 0x10, 0x7f, 0x00, 0x00, 0x01, 0x00},
+}
+
+func fuzzServer(tb testing.TB) *Server {
+	s5auth := S5AuthCb{
+		Socks5AuthNOAUTHPriority: 1,
+		Socks5AuthNOAUTH:         DefaultAuthConnCb,
+		Socks5AuthPASSWORD: func(conn net.Conn, auth S5AuthPassword) net.Conn {
+			return auth.IsEqual2(conn, "test", "test123")
+		},
+	}
+	s5auth.Socks5AuthIANA[0] = DefaultAuthConnCb
+	s5auth.Socks5AuthPRIVATE[0] = DefaultAuthConnCb
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig: CMDConfig{
+			SwitchCMDCONNECT: true,
+			CMDCONNECTHandler: func(ctx context.Context, addr string) (net.Conn, error) {
+				c1, c2 := net.Pipe()
+				_ = c2.Close()
+				return c1, nil
+			},
+			SwitchCMDBIND: true,
+			CMDBINDHandler: func(ctx context.Context, ch chan<- net.Conn, raddr string) (laddr net.Addr, err error) {
+				close(ch)
+				return &net.TCPAddr{IP: net.IP{127, 0, 0, 1}, Port: 10000}, nil
+			},
+			SwitchCMDUDPASSOCIATE: true,
+			CMDCMDUDPASSOCIATEHandler: func(ctx context.Context, addr net.Addr) (net.PacketConn, error) {
+				// datagrams over the control connection are echoed, real udp is not touched
+				if pconn, ok := ctx.Value(udpPacketConnKey).(net.PacketConn); ok {
+					return pconn, nil
+				}
+				return nil, errors.New("udp disabled in fuzzing")
+			},
+			SwitchCMDUDPOVERTCP: true,
+		},
+		Socks5AuthCb: s5auth,
+		Socks4AuthCb: S4AuthCb{Socks4UserIdAuth: func(conn net.Conn, id S4UserId) (net.Conn, S4IdAuthCode) {
+			if len(id) == 0 {
+				return conn, CodeGranted
+			}
+			return id.IsEqual3(conn, S4UserId{1, 2, 3, 4, 5, 6})
+		}},
+	}
+	server, err := NewServer(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return server
+}
+
+// fuzzServeBytes feeds b to a server session over net.Pipe and fails if the session outlives fuzzSessionTimeout.
+func fuzzServeBytes(t *testing.T, s *Server, b []byte) {
+	c1, c2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.handleConn(s.ctx, c2)
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, c1)
+	}()
+	_, _ = c1.Write(b)
+	_ = c1.Close()
+	select {
+	case <-done:
+	case <-time.After(fuzzSessionTimeout):
+		t.Fatalf("server session hangs on %x", b)
+	}
+}
+
+func FuzzServerSocks5(f *testing.F) {
+	for _, seed := range fuzzSeedServerSocks5 {
+		f.Add(seed)
+	}
+	server := fuzzServer(f)
+	defer server.Close()
+	f.Fuzz(func(t *testing.T, b []byte) {
+		fuzzServeBytes(t, server, b)
+	})
+}
+
+func FuzzServerSocks4(f *testing.F) {
+	for _, seed := range fuzzSeedServerSocks4 {
+		f.Add(seed)
+	}
+	server := fuzzServer(f)
+	defer server.Close()
+	f.Fuzz(func(t *testing.T, b []byte) {
+		fuzzServeBytes(t, server, b)
+	})
+}
+
+type fuzzPipeDialer struct {
+	resp []byte
+}
+
+func (d *fuzzPipeDialer) Dial(network string, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *fuzzPipeDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	go func() {
+		defer c2.Close()
+		go func() {
+			_, _ = io.Copy(io.Discard, c2)
+		}()
+		_, _ = c2.Write(d.resp)
+	}()
+	return c1, nil
+}
+
+var fuzzSeedClientSocks5 = [][]byte{
+	// NOAUTH + succeeded ipv4
+	{0x05, 0x00, 0x05, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x04, 0x38},
+	// PASSWORD + succeeded ipv6
+	{0x05, 0x02, 0x01, 0x00, 0x05, 0x00, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x04, 0x38},
+	// bound domain (dante)
+	append([]byte{0x05, 0x00, 0x05, 0x00, 0x00, 0x03, 0x09}, append([]byte("localhost"), 0x04, 0x38)...),
+	// BIND two replies with unspecified addr
+	{0x05, 0x00, 0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0x27, 0x10, 0x05, 0x00, 0x00, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x27, 0x11},
+	// connection refused
+	{0x05, 0x00, 0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+	// no acceptable methods
+	{0x05, 0xff},
+}
+
+var fuzzSeedClientSocks4 = [][]byte{
+	{0x00, 0x5a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	// BIND two replies with unspecified addr
+	{0x00, 0x5a, 0x27, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x5a, 0x27, 0x11, 0x7f, 0x00, 0x00, 0x01},
+}
+
+func fuzzClientDial(t *testing.T, dr Dialer) {
+	ctx, cancel := context.WithTimeout(context.Background(), fuzzSessionTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := dr.DialContext(ctx, "tcp", "127.0.0.1:1080")
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * fuzzSessionTimeout):
+		t.Fatal("client dial hangs")
+	}
+}
+
+func FuzzClientSocks5(f *testing.F) {
+	for _, seed := range fuzzSeedClientSocks5 {
+		f.Add(seed, byte(socks5CMDCONNECT))
+		f.Add(seed, byte(socks5CMDBIND))
+	}
+	f.Fuzz(func(t *testing.T, b []byte, cmd byte) {
+		if cmd != socks5CMDCONNECT && cmd != socks5CMDBIND {
+			cmd = socks5CMDCONNECT
+		}
+		auth := &S5Auth{
+			Socks5AuthNOAUTH:   DefaultAuthConnCb,
+			Socks5AuthPASSWORD: &S5AuthPassword{User: "test", Password: "test123"},
+		}
+		auth.Socks5AuthIANA[0] = DefaultAuthConnCb
+		dr, err := newSocks5Config("tcp", "127.0.0.1:1080", cmd, auth, &fuzzPipeDialer{resp: b}, nil, func(addr net.Addr) error {
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fuzzClientDial(t, dr)
+	})
+}
+
+func FuzzClientSocks5UDPASSOCIATE(f *testing.F) {
+	for _, seed := range fuzzSeedClientSocks5 {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		dr, err := newSocks5Config("tcp", "127.0.0.1:1080", socks5CMDUDPASSOCIATE, &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}, &fuzzPipeDialer{resp: b}, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pconn, err := dr.ListenPacket("udp", "127.0.0.1:0")
+		if err == nil {
+			_ = pconn.Close()
+		}
+	})
+}
+
+func FuzzClientSocks4(f *testing.F) {
+	for _, seed := range fuzzSeedClientSocks4 {
+		f.Add(seed, byte(socks4CDCONNECT))
+		f.Add(seed, byte(socks4CDBIND))
+	}
+	f.Fuzz(func(t *testing.T, b []byte, cd byte) {
+		if cd != socks4CDCONNECT && cd != socks4CDBIND {
+			cd = socks4CDCONNECT
+		}
+		dr, err := newSocks4Config("tcp", "127.0.0.1:1080", cd, S4UserId("test"), &fuzzPipeDialer{resp: b}, func(addr net.Addr) error {
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fuzzClientDial(t, dr)
+	})
+}
+
+var fuzzSeedUDPASSOCIATEData = [][]byte{
+	// dig @8.8.8.8 through socks5 udp
+	append([]byte{0x00, 0x00, 0x00, 0x01, 0x08, 0x08, 0x08, 0x08, 0x00, 0x35}, 0x00, 0x03, 0x01, 0x00, 0x00, 0x01),
+	append([]byte{0x00, 0x00, 0x00, 0x04, 0x20, 0x01, 0x48, 0x60, 0x48, 0x60, 0, 0, 0, 0, 0, 0, 0, 0, 0x88, 0x88, 0x00, 0x35}, []byte("payload")...),
+	append(append([]byte{0x00, 0x00, 0x00, 0x03, 0x09}, []byte("localhost")...), 0x00, 0x35, 0xde, 0xad),
+	// fragmented datagram
+	{0x00, 0x00, 0x01, 0x01, 0x7f, 0x00, 0x00, 0x01, 0x00, 0x35},
+	{},
+}
+
+func FuzzUnmarshalSocks5UDPASSOCIATEData(f *testing.F) {
+	for _, seed := range fuzzSeedUDPASSOCIATEData {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		data, addr, err := unmarshalSocks5UDPASSOCIATEData(b)
+		data3, addr3, err3 := unmarshalSocks5UDPASSOCIATEData3(b)
+		if err3 != nil {
+			return
+		}
+		if err != nil {
+			t.Fatalf("forms disagree on %x: %v", b, err)
+		}
+		if len(data) > len(b) || !bytes.Equal(data, data3) {
+			t.Fatalf("forms disagree on payload of %x", b)
+		}
+		if addr != addr3.String() {
+			t.Fatalf("forms disagree on addr of %x: %s != %s", b, addr, addr3)
+		}
+		data4, addr4, err := unmarshalSocks5UDPASSOCIATEData3(marshalSocks5UDPASSOCIATEData(data3, addr3))
+		if err != nil || !bytes.Equal(data3, data4) {
+			t.Fatalf("round trip of %x failed: %v", b, err)
+		}
+		if da, ok := addr3.(*DomainAddr); ok && net.ParseIP(da.Host) == nil {
+			if addr4.String() != addr3.String() {
+				t.Fatalf("round trip of %x changed domain %s -> %s", b, addr3, addr4)
+			}
+		}
+	})
+}
+
+var fuzzSeedRelay = [][]byte{
+	{0xff},
+	append([]byte{0x0e}, []byte("127.0.0.1:4000")...),
+	append(append([]byte{0x0e}, []byte("127.0.0.1:4000")...), 0xff),
+	append([]byte{0x0c}, []byte("[::1]:65535")...),
+	{0x05, 'h', 'e', 'l', 'l', 'o', 0x00},
+}
+
+var fuzzSeedRelayV2 = [][]byte{
+	// CONNECT reply
+	{relayVersion2, 0x00, 0x07, 0x00, 0x01, 127, 0, 0, 1, 0x0f, 0xa0},
+	// BIND replies
+	{relayVersion2, 0x00, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0x0f, 0xa0, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50},
+	// auth challenge followed by a CONNECT reply
+	append(append([]byte{relayVersion2, 0x01, 0x07}, make([]byte, relayNonceLen)...), 0x00, 0x01, 127, 0, 0, 1, 0x0f, 0xa0),
+	// connection refused
+	{relayVersion2, 0x00, 0x07, 0x05, 0x01, 0, 0, 0, 0, 0, 0},
+	// udp frame with a domain target
+	append(append([]byte{0x01, 127, 0, 0, 1, 0x30, 0x39, 0x03, 0x09}, "localhost"...), 0x00, 0x35, 0x00, 0x02, 'h', 'i'),
+}
+
+func FuzzRelayV2UdpFrame(f *testing.F) {
+	for _, seed := range fuzzSeedRelayV2 {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		laddr, raddr, data, err := readRelayUdpFrame(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		xraddr, err := parseUDPAddr(raddr)
+		if err != nil {
+			return
+		}
+		laddr2, raddr2, data2, err := readRelayUdpFrame(bytes.NewReader(makeRelayUdpFrame(laddr, xraddr, data)))
+		if err != nil || !bytes.Equal(data, data2) {
+			t.Fatalf("round trip of %x failed: %v", b, err)
+		}
+		if laddr2 != laddr || raddr2 != raddr {
+			t.Fatalf("round trip of %x changed %s %s -> %s %s", b, laddr, raddr, laddr2, raddr2)
+		}
+	})
+}
+
+func FuzzRelayFraming(f *testing.F) {
+	for _, seed := range fuzzSeedRelay {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := bytes.NewReader(b)
+		for {
+			s, err := readStr(r)
+			if err != nil {
+				break
+			}
+			if !bytes.Equal(makeStrBytes(s)[1:], []byte(s)) {
+				t.Fatalf("str frame mismatch %q", s)
+			}
+		}
+		r = bytes.NewReader(b)
+		for {
+			bs, err := readBytes(r)
+			if err != nil {
+				break
+			}
+			if len(bs) > 255 {
+				t.Fatalf("bytes frame too long: %d", len(bs))
+			}
+		}
+	})
+}
+
+func FuzzRelayHandlers(f *testing.F) {
+	for _, seed := range append(fuzzSeedRelay, fuzzSeedRelayV2...) {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		cb := func(ctx context.Context) (net.Conn, error) {
+			return (&fuzzPipeDialer{resp: b}).DialContext(ctx, "tcp", "")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), fuzzSessionTimeout)
+		defer cancel()
+		conn, err := RelayCMDCONNECTHandler(cb)(ctx, "127.0.0.1:80")
+		if err == nil {
+			_ = conn.Close()
+		}
+		ch := make(chan net.Conn)
+		_, err = RelayCMDBINDHandler(cb)(ctx, ch, "127.0.0.1:80")
+		if err == nil {
+			select {
+			case conn, ok := <-ch:
+				if ok {
+					_ = conn.Close()
+				}
+			case <-time.After(fuzzSessionTimeout):
+				t.Fatal("relay bind hangs")
+			}
+		}
+	})
+}
+
+func FuzzSocks5AddrRoundTrip(f *testing.F) {
+	f.Add([]byte{127, 0, 0, 1}, uint16(80))
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, uint16(443))
+	f.Fuzz(func(t *testing.T, ip []byte, port uint16) {
+		if len(ip) != 4 && len(ip) != 16 {
+			return
+		}
+		addr := &net.UDPAddr{IP: append(net.IP{}, ip...), Port: int(port)}
+		b := marshalSocks5UDPASSOCIATEData([]byte("x"), addr)
+		data, uaddr, err := unmarshalSocks5UDPASSOCIATEData2(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "x" || uaddr.Port != int(port) || !uaddr.IP.Equal(net.IP(ip)) {
+			t.Fatalf("round trip %v -> %v", addr, uaddr)
+		}
+		if binary.BigEndian.Uint16(b[len(b)-3:]) != port {
+			t.Fatal("port mismatch")
+		}
+	})
+}
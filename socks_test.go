@@ -1,7 +1,9 @@
 package socks
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/net/dns/dnsmessage"
 	"golang.org/x/net/proxy"
@@ -10,6 +12,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"testing"
 	"time"
 )
@@ -159,6 +162,25 @@ func testListen(t *testing.T) net.Listener {
 	return listener
 }
 
+// testServer serves cfg on a loopback listener until the test ends
+func testServer(t *testing.T, cfg *ServerConfig) net.Listener {
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	return listen
+}
+
 func testConn(t *testing.T, conn net.Conn, data string) {
 	_, err := conn.Write([]byte(data))
 	if err != nil {
@@ -532,6 +554,375 @@ func TestSOCKS5UDPASSOCIATEP(t *testing.T) {
 	}
 }
 
+func TestSOCKS5UDPASSOCIATEDomain(t *testing.T) {
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+	}
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	pConn := testLPConn(t)
+	defer pConn.Close()
+	ucfg, err := SOCKS5UDPASSOCIATE(listen.Addr().Network(), listen.Addr().String(), &S5Auth{
+		Socks5AuthNOAUTH: DefaultAuthConnCb,
+	}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pConn2, err := ucfg.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pConn2.Close()
+	daddr := &DomainAddr{Host: "localhost", Port: pConn.LocalAddr().(*net.UDPAddr).Port}
+	for i := 0; i < 3; i++ {
+		testPConn(t, pConn2, daddr, newData(4096))
+	}
+}
+
+func TestSOCKS5UDPASSOCIATENATFilter(t *testing.T) {
+	lc := net.ListenConfig{}
+	peer, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	stranger, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	filter := &UDPFilter{
+		NATMode:    UDPNATAddressAndPortRestricted,
+		AllowPorts: []uint16{uint16(peer.LocalAddr().(*net.UDPAddr).Port)},
+	}
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+		UDPFilter: filter,
+	}
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	ucfg, err := SOCKS5UDPASSOCIATE(listen.Addr().Network(), listen.Addr().String(), &S5Auth{
+		Socks5AuthNOAUTH: DefaultAuthConnCb,
+	}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pConn, err := ucfg.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pConn.Close()
+
+	buf := make([]byte, 1024)
+	_, err = pConn.WriteTo([]byte("hello"), peer.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, oaddr, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stranger is filtered, the contacted endpoint is not
+	_, err = stranger.WriteTo([]byte("stranger"), oaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; filter.DroppedNAT() == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if filter.DroppedNAT() != 1 {
+		t.Fatalf("dropped nat: %d", filter.DroppedNAT())
+	}
+	_, err = peer.WriteTo([]byte("peer"), oaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, raddr, err := pConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "peer" || raddr.String() != peer.LocalAddr().String() {
+		t.Fatal("test failed")
+	}
+
+	// the port of the stranger is not allowed
+	_, err = pConn.WriteTo([]byte("hello"), stranger.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stranger.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err = stranger.ReadFrom(buf); err == nil {
+		t.Fatal("datagram to a disallowed port was relayed")
+	}
+	if filter.DroppedDest() != 1 {
+		t.Fatalf("dropped dest: %d", filter.DroppedDest())
+	}
+}
+
+type testPrefixHandler string
+
+func (tph testPrefixHandler) Encode(b []byte) ([]byte, error) {
+	return append([]byte(tph), b...), nil
+}
+
+func (tph testPrefixHandler) Decode(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte(tph)) {
+		return nil, errors.New("missing prefix")
+	}
+	return b[len(tph):], nil
+}
+
+type testAddHandler byte
+
+func (tah testAddHandler) Encode(b []byte) ([]byte, error) {
+	nb := make([]byte, len(b))
+	for i := range b {
+		nb[i] = b[i] + byte(tah)
+	}
+	return nb, nil
+}
+
+func (tah testAddHandler) Decode(b []byte) ([]byte, error) {
+	nb := make([]byte, len(b))
+	for i := range b {
+		nb[i] = b[i] - byte(tah)
+	}
+	return nb, nil
+}
+
+type testStreamHandler struct {
+	UDPDataHandler
+}
+
+func (tsh testStreamHandler) Encode(w io.Writer) io.Writer {
+	return testWriterFunc(func(b []byte) (int, error) {
+		nb, _ := tsh.UDPDataHandler.Encode(b)
+		_, err := w.Write(nb)
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	})
+}
+
+func (tsh testStreamHandler) Decode(r io.Reader) io.Reader {
+	return testReaderFunc(func(b []byte) (int, error) {
+		n, err := r.Read(b)
+		nb, _ := tsh.UDPDataHandler.Decode(b[:n])
+		copy(b, nb)
+		return n, err
+	})
+}
+
+type testWriterFunc func(b []byte) (int, error)
+
+func (f testWriterFunc) Write(b []byte) (int, error) { return f(b) }
+
+type testReaderFunc func(b []byte) (int, error)
+
+func (f testReaderFunc) Read(b []byte) (int, error) { return f(b) }
+
+func TestSOCKS5DataHandler(t *testing.T) {
+	// neither transform is its own inverse, and the chain order matters
+	udpCb := UDPDataHandlerChain(testPrefixHandler("x:"), testAddHandler(7))
+	tcpCb := TCPDataHandlerChain(testStreamHandler{testAddHandler(3)}, testStreamHandler{testAddHandler(11)})
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+	}
+	cfg.CMDConfig.UDPDataHandler = udpCb
+	cfg.CMDConfig.TCPDataHandler = tcpCb
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	auth := &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}
+
+	// the peer speaks plain udp, so it must see the decoded payload
+	lc := net.ListenConfig{}
+	peer, err := lc.ListenPacket(context.Background(), "udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	ucfg, err := SOCKS5UDPASSOCIATE(listen.Addr().Network(), listen.Addr().String(), auth, nil, nil, udpCb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pConn, err := ucfg.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pConn.Close()
+	buf := make([]byte, 1024)
+	_, err = pConn.WriteTo([]byte("hello"), peer.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = peer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, oaddr, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("peer got %q", buf[:n])
+	}
+	_, err = peer.WriteTo([]byte("world"), oaddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err = pConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "world" {
+		t.Fatalf("client got %q", buf[:n])
+	}
+
+	// the target speaks plain tcp as well
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		got <- string(b)
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("world"))
+	}()
+	dr, err := SOCKS5CONNECT(listen.Addr().Network(), listen.Addr().String(), auth, nil, WithTCPDataHandler(tcpCb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "hello" {
+		t.Fatalf("target got %q", s)
+	}
+	b := make([]byte, 5)
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "world" {
+		t.Fatalf("client got %q", b)
+	}
+}
+
+func TestSOCKS5UDPOverTCP(t *testing.T) {
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+	}
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	auth := &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}
+	ucfg, err := SOCKS5UDPASSOCIATE(listen.Addr().Network(), listen.Addr().String(), auth, nil, nil, nil, WithUDPOverTCP())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the private cmd is off by default
+	_, err = ucfg.ListenPacket("udp", "127.0.0.1:0")
+	if err == nil {
+		t.Fatal("udp over tcp should be rejected")
+	}
+
+	cfg.CMDConfig.SwitchCMDUDPOVERTCP = true
+	pConn := testLPConn(t)
+	defer pConn.Close()
+	pConn2, err := ucfg.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pConn2.Close()
+	if pConn2.LocalAddr().Network() != "tcp" {
+		t.Fatal("datagrams are not carried on the control connection")
+	}
+	for i := 0; i < 3; i++ {
+		testPConn(t, pConn2, pConn.LocalAddr(), newData(4096))
+	}
+	testPConn(t, pConn2, &DomainAddr{Host: "localhost", Port: pConn.LocalAddr().(*net.UDPAddr).Port}, newData(16))
+}
+
 func TestDNS(t *testing.T) {
 	cfg := &ServerConfig{
 		VersionSwitch: DefaultSocksVersionSwitch,
@@ -672,6 +1063,10 @@ func TestHttp(t *testing.T) {
 }
 
 func testRelayServer(t *testing.T) net.Listener {
+	return testRelayServerWithConfig(t, nil)
+}
+
+func testRelayServerWithConfig(t *testing.T, cfg *RelayConfig) net.Listener {
 	listen, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
@@ -685,7 +1080,7 @@ func testRelayServer(t *testing.T) net.Listener {
 			}
 			go func(conn2 net.Conn) {
 				defer conn2.Close()
-				_ = RelayServe(conn2)
+				_ = RelayServeWithConfig(conn2, cfg)
 			}(conn)
 		}
 	}()
@@ -929,3 +1324,249 @@ func TestSOCKS4BINDRelay(t *testing.T) {
 		testConn(t, conn, newData(4096))
 	}
 }
+
+func TestSOCKS5UDPASSOCIATERelay(t *testing.T) {
+	relay := testRelayServer(t)
+	defer relay.Close()
+
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+	}
+	cfg.CMDConfig.CMDCMDUDPASSOCIATEHandler = RelayCMDCMDUDPASSOCIATE(func(ctx context.Context) (net.Conn, error) {
+		dr := net.Dialer{}
+		return dr.DialContext(ctx, relay.Addr().Network(), relay.Addr().String())
+	})
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	pConn := testLPConn(t)
+	defer pConn.Close()
+	ucfg, err := SOCKS5UDPASSOCIATE(listen.Addr().Network(), listen.Addr().String(), &S5Auth{
+		Socks5AuthNOAUTH: DefaultAuthConnCb,
+	}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pConn2, err := ucfg.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pConn2.Close()
+	_ = pConn2.SetReadDeadline(time.Now().Add(3 * time.Second))
+	// v1 framing truncated anything over 255 bytes
+	for i := 0; i < 3; i++ {
+		testPConn(t, pConn2, pConn.LocalAddr(), newData(4096))
+	}
+	testPConn(t, pConn2, &DomainAddr{Host: "localhost", Port: pConn.LocalAddr().(*net.UDPAddr).Port}, newData(16))
+}
+
+func TestSOCKS5CONNECTRelayReplyCode(t *testing.T) {
+	relay := testRelayServer(t)
+	defer relay.Close()
+
+	cfg := &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthNOAUTH: DefaultAuthConnCb,
+		},
+	}
+	cfg.CMDConfig.CMDCONNECTHandler = RelayCMDCONNECTHandler(func(ctx context.Context) (net.Conn, error) {
+		dr := net.Dialer{}
+		return dr.DialContext(ctx, relay.Addr().Network(), relay.Addr().String())
+	})
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	ln := testListen(t)
+	closed := ln.Addr().String()
+	_ = ln.Close()
+	dr, err := SOCKS5CONNECT(listen.Addr().Network(), listen.Addr().String(), &S5Auth{
+		Socks5AuthNOAUTH: DefaultAuthConnCb,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dr.Dial("tcp", closed)
+	var re *ReplyError
+	if !errors.As(err, &re) || re.Code != socks5CMDRespConnRefused {
+		t.Fatalf("want connection refused from the relay, got %v", err)
+	}
+}
+
+func TestRelayServeV1(t *testing.T) {
+	relay := testRelayServer(t)
+	defer relay.Close()
+	ln := testListen(t)
+	defer ln.Close()
+	conn, err := net.Dial(relay.Addr().Network(), relay.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(append([]byte{relayCMDCONNECT}, makeStrBytes(ln.Addr().String())...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0xff {
+		t.Fatal("test failed")
+	}
+	testConn(t, conn, newData(4096))
+}
+
+func TestRelayAuth(t *testing.T) {
+	allowed := testListen(t)
+	defer allowed.Close()
+	denied := testListen(t)
+	defer denied.Close()
+	relay := testRelayServerWithConfig(t, &RelayConfig{
+		AuthKey: func(id string) ([]byte, bool) {
+			if id == "test" {
+				return []byte("test123"), true
+			}
+			return nil, false
+		},
+		Allow: func(id string, network string, addr string) bool {
+			return id == "test" && addr != denied.Addr().String()
+		},
+	})
+	defer relay.Close()
+	cb := func(ctx context.Context) (net.Conn, error) {
+		dr := net.Dialer{}
+		return dr.DialContext(ctx, relay.Addr().Network(), relay.Addr().String())
+	}
+	ctx := context.Background()
+
+	conn, err := RelayCMDCONNECTHandler(cb, WithRelayKey("test", []byte("test123")))(ctx, allowed.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(4096))
+	_ = conn.Close()
+
+	for _, opts := range [][]RelayOption{
+		{WithRelayKey("test", []byte("wrong"))},
+		{WithRelayKey("other", []byte("test123"))},
+		nil,
+	} {
+		_, err = RelayCMDCONNECTHandler(cb, opts...)(ctx, allowed.Addr().String())
+		var re *ReplyError
+		if !errors.As(err, &re) || re.Code != socks5CMDRespConnNotAllowed {
+			t.Fatalf("want not allowed, got %v", err)
+		}
+	}
+
+	_, err = RelayCMDCONNECTHandler(cb, WithRelayKey("test", []byte("test123")))(ctx, denied.Addr().String())
+	var re *ReplyError
+	if !errors.As(err, &re) || re.Code != socks5CMDRespConnNotAllowed {
+		t.Fatalf("want not allowed by the acl, got %v", err)
+	}
+
+	// v1 can not authenticate
+	conn, err = cb(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(append([]byte{relayCMDCONNECT}, makeStrBytes(allowed.Addr().String())...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("v1 peer was served: %v", err)
+	}
+}
+
+func TestUdpResolver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := newUdpResolver()
+	// a lookup that has not ended holds up only its own domain
+	slow := &udpLookup{done: make(chan struct{})}
+	r.m["slow.test"] = slow
+	_, wait, err := r.resolve(ctx, &DomainAddr{Host: "slow.test", Port: 53})
+	if wait == nil || err != nil {
+		t.Fatalf("pending lookup not reported: %v", err)
+	}
+	ip := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	raddr, w, err := r.resolve(ctx, ip)
+	if raddr != ip || w != nil || err != nil {
+		t.Fatal("ip target waits")
+	}
+	slow.ip = net.IPv4(192, 0, 2, 1)
+	close(slow.done)
+	raddr, err = wait()
+	if err != nil || raddr.String() != "192.0.2.1:53" {
+		t.Fatalf("unexpected address: %v %v", raddr, err)
+	}
+	// a failure is tried again once it expired
+	failed := &udpLookup{done: make(chan struct{}), err: errors.New("servfail"), end: time.Now().Add(-time.Second)}
+	close(failed.done)
+	r.m["localhost"] = failed
+	l := r.lookup(ctx, "localhost")
+	if l == failed || r.lookup(ctx, "localhost") != l {
+		t.Fatal("lookup not retried once or not shared")
+	}
+	<-l.done
+	if l.err != nil || !l.ip.IsLoopback() {
+		t.Fatalf("unexpected lookup: %v %v", l.ip, l.err)
+	}
+}
+
+func TestUdpSubConnLimit(t *testing.T) {
+	sc := newUdpSubConn(nil, &UDPFilter{NATMode: UDPNATAddressAndPortRestricted}, time.Minute)
+	peer := func(i int) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 53}
+	}
+	for i := 0; i < udpSubConnMaxEntries; i++ {
+		if !sc.record(peer(i), &DomainAddr{Host: "a.test", Port: 53}) {
+			t.Fatalf("peer %d refused", i)
+		}
+	}
+	// a client spraying targets stops at the limit, the known peers keep working
+	if sc.record(peer(udpSubConnMaxEntries), &DomainAddr{Host: "a.test", Port: 53}) {
+		t.Fatal("peers beyond the limit")
+	}
+	if !sc.record(peer(0), nil) || !sc.accept(peer(1)) || len(sc.domains) != udpSubConnMaxEntries {
+		t.Fatal("known peer refused")
+	}
+	// entries unused for the timeout make room
+	sc.timeout = 0
+	time.Sleep(time.Millisecond)
+	if !sc.record(peer(udpSubConnMaxEntries), nil) || len(sc.peers) != 1 || len(sc.domains) != 0 {
+		t.Fatalf("expired entries kept: %d %d", len(sc.peers), len(sc.domains))
+	}
+	if sc.accept(peer(1)) {
+		t.Fatal("expired peer accepted")
+	}
+}
@@ -0,0 +1,211 @@
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// NewReadWriteConn makes a net.Conn of r and w for Server.ServeConn or a Dialer, like the two pipes of a
+// ProxyCommand or a ssh channel given as both. read deadlines work even if r has none, so the timeouts
+// of the server apply. Close closes r and w if they can be, CloseWrite closes w
+func NewReadWriteConn(r io.Reader, w io.Writer) net.Conn {
+	tr, tw := reflect.TypeOf(r), reflect.TypeOf(w)
+	return &rwConn{
+		r:    r,
+		w:    w,
+		same: tr == tw && tr != nil && tr.Comparable() && any(r) == any(w),
+		data: make(chan []byte),
+		die:  make(chan struct{}),
+		dch:  make(chan struct{}),
+	}
+}
+
+// StdioConn is the stdin and stdout of the process as a net.Conn, for inetd or ssh ProxyCommand
+func StdioConn() net.Conn {
+	return NewReadWriteConn(os.Stdin, os.Stdout)
+}
+
+type rwAddr struct{}
+
+func (rwAddr) Network() string { return "pipe" }
+func (rwAddr) String() string  { return "pipe" }
+
+type rwConn struct {
+	r    io.Reader
+	w    io.Writer
+	same bool //r and w are one, it is closed once
+
+	// a goroutine reads r, so a Read can leave at its deadline
+	rmux  sync.Mutex
+	buf   []byte
+	data  chan []byte
+	err   error //set before data is closed
+	start sync.Once
+
+	dmux     sync.Mutex
+	deadline time.Time
+	dch      chan struct{} //closed when the deadline changes
+
+	die  chan struct{}
+	once sync.Once
+}
+
+func (c *rwConn) readLoop() {
+	defer close(c.data)
+	for {
+		b := make([]byte, pipeBufferSize)
+		n, err := c.r.Read(b)
+		if n > 0 {
+			select {
+			case c.data <- b[:n]:
+			case <-c.die:
+				c.err = net.ErrClosed
+				return
+			}
+		}
+		if err != nil {
+			c.err = err
+			return
+		}
+	}
+}
+
+func (c *rwConn) Read(b []byte) (int, error) {
+	c.rmux.Lock()
+	defer c.rmux.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for len(c.buf) == 0 {
+		c.start.Do(func() {
+			go c.readLoop()
+		})
+		err := c.wait()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// wait takes the next chunk of the goroutine into buf
+func (c *rwConn) wait() error {
+	for {
+		c.dmux.Lock()
+		deadline, dch := c.deadline, c.dch
+		c.dmux.Unlock()
+		var tr *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			tr = time.NewTimer(d)
+			timeout = tr.C
+		}
+		changed, err := c.waitChunk(timeout, dch)
+		if tr != nil {
+			tr.Stop()
+		}
+		if !changed {
+			return err
+		}
+	}
+}
+
+// waitChunk tells if the deadline changed before a chunk came
+func (c *rwConn) waitChunk(timeout <-chan time.Time, dch chan struct{}) (bool, error) {
+	select {
+	case b, ok := <-c.data:
+		if !ok {
+			return false, c.err
+		}
+		c.buf = b
+		return false, nil
+	case <-c.die:
+		return false, net.ErrClosed
+	case <-timeout:
+		return false, os.ErrDeadlineExceeded
+	case <-dch:
+		return true, nil
+	}
+}
+
+func (c *rwConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.die:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.w.Write(b)
+}
+
+func (c *rwConn) CloseWrite() error {
+	if cw, ok := c.w.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	if wc, ok := c.w.(io.Closer); ok && !c.same {
+		return wc.Close()
+	}
+	return errNoHalfClose
+}
+
+func (c *rwConn) Close() error {
+	err := net.ErrClosed
+	c.once.Do(func() {
+		close(c.die)
+		err = nil
+		if wc, ok := c.w.(io.Closer); ok {
+			err = wc.Close()
+		}
+		if rc, ok := c.r.(io.Closer); ok && !c.same {
+			if rerr := rc.Close(); err == nil {
+				err = rerr
+			}
+		}
+	})
+	return err
+}
+
+func (c *rwConn) LocalAddr() net.Addr {
+	return rwAddr{}
+}
+
+func (c *rwConn) RemoteAddr() net.Addr {
+	return rwAddr{}
+}
+
+func (c *rwConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *rwConn) SetReadDeadline(t time.Time) error {
+	c.dmux.Lock()
+	defer c.dmux.Unlock()
+	c.deadline = t
+	close(c.dch)
+	c.dch = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline is passed on to w if it has deadlines, a write cannot be left otherwise
+func (c *rwConn) SetWriteDeadline(t time.Time) error {
+	if wd, ok := c.w.(interface{ SetWriteDeadline(t time.Time) error }); ok {
+		if err := wd.SetWriteDeadline(t); !errors.Is(err, os.ErrNoDeadline) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package socks
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type testConnDialer struct {
+	conn net.Conn
+}
+
+func (d *testConnDialer) Dial(network string, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+func (d *testConnDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+// testPipeConns returns the two ends of a pair of pipes, as a ProxyCommand sees them
+func testPipeConns() (net.Conn, net.Conn) {
+	r1, w1 := io.Pipe()
+	r2, w2 := io.Pipe()
+	return NewReadWriteConn(r1, w2), NewReadWriteConn(r2, w1)
+}
+
+func TestServeConn(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	events := make(chan SessionEvent, 8)
+	server, err := NewServer(&ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb:  S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+		ConnTimeout:   200 * time.Millisecond,
+		SessionHook: func(event SessionEvent) {
+			events <- event
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	sconn, cconn := testPipeConns()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeConn(context.Background(), sconn)
+	}()
+	dr, err := SOCKS5CONNECT("tcp", "pipe", &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}, &testConnDialer{conn: cconn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := testSessionEvent(t, events)
+	if ev.Type != SessionOpen || ev.Info.RemoteAddr.String() != "pipe" || ev.Info.Target != ln.Addr().String() {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	// past the handshake timeout, which no longer applies
+	time.Sleep(300 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		testConn(t, conn, newData(64*1024))
+	}
+	_ = conn.Close()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("ServeConn not returned")
+	}
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionClose {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	// the handshake timeout works without deadlines of the pipes
+	sconn, cconn = testPipeConns()
+	defer cconn.Close()
+	go func() {
+		done <- server.ServeConn(context.Background(), sconn)
+	}()
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionReject || ev.Err != ErrHandshakeTimeout {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	<-done
+
+	// and ctx ends a session
+	sconn, cconn = testPipeConns()
+	defer cconn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- server.ServeConn(ctx, sconn)
+	}()
+	cancel()
+	select {
+	case err = <-done:
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("ServeConn not returned")
+	}
+}
@@ -0,0 +1,100 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// WithTLS wraps the connection to the proxy in TLS, the server needs ServerConfig.TLSConfig.
+// an empty cfg.ServerName is taken from the proxy address. with pins, the SHA-256 of the
+// SubjectPublicKeyInfo of the server certificate must match one of them and the chain is not
+// verified against roots, so self-signed certificates work. udp datagrams of UDP ASSOCIATE
+// stay plaintext, WithUDPOverTCP keeps them in the tunnel
+func WithTLS(cfg *tls.Config, pins ...[]byte) ClientOption {
+	return func(opts *clientOptions) {
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		opts.tlsCfg = cfg
+		opts.tlsPins = pins
+	}
+}
+
+// TLSPin returns the pin of cert for WithTLS
+func TLSPin(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// clientTLS runs the handshake with the proxy at address if WithTLS was given
+func (co *clientOptions) clientTLS(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	if co.tlsCfg == nil {
+		return conn, nil
+	}
+	cfg := co.tlsCfg.Clone()
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+	if len(co.tlsPins) != 0 {
+		pins := co.tlsPins
+		verify := cfg.VerifyConnection
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return ErrTLSPinMismatch
+			}
+			pin := TLSPin(state.PeerCertificates[0])
+			for _, one := range pins {
+				if bytes.Equal(one, pin) {
+					if verify != nil {
+						return verify(state)
+					}
+					return nil
+				}
+			}
+			return ErrTLSPinMismatch
+		}
+	}
+	tconn := tls.Client(conn, cfg)
+	err := tconn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tconn, nil
+}
+
+// serverTLS runs the handshake of ServerConfig.TLSConfig, a client certificate
+// that TLSCertUser maps to a user authenticates the connection
+func (s *Server) serverTLS(ctx context.Context, conn *serverConn) error {
+	if s.cfg.ConnTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.cfg.ConnTimeout)
+		defer cancel()
+	}
+	tconn := tls.Server(conn.Conn, s.cfg.TLSConfig)
+	conn.Conn = tconn
+	err := tconn.HandshakeContext(ctx)
+	if err != nil {
+		return err
+	}
+	// only a chain go verified maps to a user, NewServer makes sure ClientAuth verifies
+	chains := tconn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 || s.cfg.TLSCertUser == nil {
+		return nil
+	}
+	user, ok := s.cfg.TLSCertUser(chains[0][0])
+	if !ok {
+		return ErrTLSCertRejected
+	}
+	conn.sess.info.User = user
+	conn.certAuth = true
+	return nil
+}
@@ -0,0 +1,241 @@
+package socks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCert issues a certificate for cn from parent, a nil parent makes a self-signed CA
+func testCert(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tpl, any(key)
+	if parent == nil {
+		tpl.IsCA = true
+		tpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestSOCKSOverTLS(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	ca := testCert(t, "ca", nil)
+	serverCert := testCert(t, "proxy.test", &ca)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	sni := make(chan string, 8)
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		Socks5AuthCb: S5AuthCb{
+			Socks5AuthPASSWORD: func(conn net.Conn, auth S5AuthPassword) net.Conn {
+				return auth.IsEqual2(conn, "test", "test123")
+			},
+		},
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				sni <- hello.ServerName
+				return nil, nil
+			},
+		},
+	})
+	auth := &S5AuthPassword{User: "test", Password: "test123"}
+
+	for _, cfg := range []*tls.Config{
+		{RootCAs: roots},
+		{RootCAs: roots, ServerName: "proxy.test"},
+	} {
+		dr, err := SOCKS5CONNECTP(listen.Addr().Network(), listen.Addr().String(), auth, nil, WithTLS(cfg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		testConn(t, conn, newData(4096))
+		_ = conn.Close()
+		if name := <-sni; name != cfg.ServerName {
+			t.Fatalf("want sni %q, got %q", cfg.ServerName, name)
+		}
+	}
+
+	// pinned, the self-signed certificate needs no roots
+	self := testCert(t, "self", nil)
+	listen2 := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{self}},
+		Socks5AuthCb:  S5AuthCb{Socks5AuthNOAUTH: DefaultAuthConnCb},
+	})
+	dr4, err := SOCKS4CONNECT(listen2.Addr().Network(), listen2.Addr().String(), nil, nil, WithTLS(nil, TLSPin(self.Leaf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr4.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(4096))
+	_ = conn.Close()
+	dr4, err = SOCKS4CONNECT(listen2.Addr().Network(), listen2.Addr().String(), nil, nil, WithTLS(nil, TLSPin(ca.Leaf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dr4.Dial(ln.Addr().Network(), ln.Addr().String()); err == nil {
+		t.Fatal("pin mismatch accepted")
+	}
+	// and without pins it is not trusted
+	dr4, err = SOCKS4CONNECT(listen2.Addr().Network(), listen2.Addr().String(), nil, nil, WithTLS(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dr4.Dial(ln.Addr().Network(), ln.Addr().String()); err == nil {
+		t.Fatal("self-signed certificate accepted")
+	}
+}
+
+func TestSOCKSOverTLSCertUser(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	ca := testCert(t, "ca", nil)
+	serverCert := testCert(t, "proxy.test", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	events := make(chan SessionEvent, 8)
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		},
+		TLSCertUser: func(cert *x509.Certificate) (string, bool) {
+			return cert.Subject.CommonName, cert.Subject.CommonName == "alice"
+		},
+		SessionHook: func(event SessionEvent) {
+			events <- event
+		},
+	})
+	auth := &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}
+
+	alice := testCert(t, "alice", &ca)
+	dr, err := SOCKS5CONNECT(listen.Addr().Network(), listen.Addr().String(), auth, nil,
+		WithTLS(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{alice}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(4096))
+	_ = conn.Close()
+	ev := testSessionEvent(t, events)
+	if ev.Type != SessionOpen || ev.Info.User != "alice" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	_ = testSessionEvent(t, events)
+
+	mallory := testCert(t, "mallory", &ca)
+	dr, err = SOCKS5CONNECT(listen.Addr().Network(), listen.Addr().String(), auth, nil,
+		WithTLS(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{mallory}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dr.Dial(ln.Addr().Network(), ln.Addr().String()); err == nil {
+		t.Fatal("unmapped certificate accepted")
+	}
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionReject || ev.Err != ErrTLSCertRejected {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+func TestSOCKSOverTLSCertUserSelfSigned(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	ca := testCert(t, "ca", nil)
+	serverCert := testCert(t, "proxy.test", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	certUser := func(cert *x509.Certificate) (string, bool) {
+		return cert.Subject.CommonName, true
+	}
+	// an unverified certificate must not name the user
+	_, err := NewServer(&ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.RequireAnyClientCert,
+		},
+		TLSCertUser: certUser,
+	})
+	if err != ErrTLSCertUnverified {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	events := make(chan SessionEvent, 8)
+	listen := testServer(t, &ServerConfig{
+		VersionSwitch: DefaultSocksVersionSwitch,
+		CMDConfig:     DefaultSocksCMDConfig,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			ClientCAs:    pool,
+		},
+		TLSCertUser: certUser,
+		SessionHook: func(event SessionEvent) {
+			events <- event
+		},
+	})
+	auth := &S5Auth{Socks5AuthNOAUTH: DefaultAuthConnCb}
+	forged := testCert(t, "alice", nil)
+	dr, err := SOCKS5CONNECT(listen.Addr().Network(), listen.Addr().String(), auth, nil,
+		WithTLS(&tls.Config{RootCAs: pool, Certificates: []tls.Certificate{forged}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dr.Dial(ln.Addr().Network(), ln.Addr().String())
+	if err == nil {
+		_ = conn.Close()
+		t.Fatal("self-signed certificate accepted")
+	}
+	ev := testSessionEvent(t, events)
+	if ev.Type == SessionOpen || ev.Info.User == "alice" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
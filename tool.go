@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -22,49 +23,81 @@ func UnmarshalSocks5UDPASSOCIATEData2(b []byte) (data []byte, addr *net.UDPAddr,
 	return unmarshalSocks5UDPASSOCIATEData2(b)
 }
 
+// UnmarshalSocks5UDPASSOCIATEData3 does not resolve domain targets, addr is either *net.UDPAddr or *DomainAddr
+func UnmarshalSocks5UDPASSOCIATEData3(b []byte) (data []byte, addr net.Addr, err error) {
+	return unmarshalSocks5UDPASSOCIATEData3(b)
+}
+
 func marshalSocks5UDPASSOCIATEData(b []byte, addr net.Addr) []byte {
-	ab := getSocks5AddrBytes(addr)
 	bs := new(bytes.Buffer)
 	bs.Write([]byte{0x00, 0x00, 0x00})
-	if len(ab) == 4+2 {
-		bs.Write([]byte{socks5AddrTypeIPv4})
-	} else if len(ab) == 16+2 {
-		bs.Write([]byte{socks5AddrTypeIPv6})
-	} else {
-		bs.Write([]byte{0x00})
-	}
-	bs.Write(ab)
+	bs.Write(getSocks5AddrTypeBytes(addr))
 	bs.Write(b)
 	return bs.Bytes()
 }
 func unmarshalSocks5UDPASSOCIATEData(b []byte) (data []byte, addr string, err error) {
-	if b[0] != 0x00 || b[1] != 0x00 || b[2] != 0x00 {
+	if len(b) < 4 || b[0] != 0x00 || b[1] != 0x00 || b[2] != 0x00 {
 		return nil, "", ErrSocks5UDPASSOCIATEDataUnmarshalFailure
 	}
 	switch b[3] {
 	case socks5AddrTypeIPv4:
+		if len(b) < 4+4+2 {
+			return nil, "", ErrSocks5UDPASSOCIATEDataUnmarshalFailure
+		}
 		ab := b[4 : 4+4+2]
-		addr = fmt.Sprintf("%s:%d", string(ab[:4]), binary.BigEndian.Uint16(ab[4:4+2]))
+		addr = fmt.Sprintf("%s:%d", net.IP(ab[:4]).String(), binary.BigEndian.Uint16(ab[4:4+2]))
 		return b[4+4+2:], addr, nil
 	case socks5AddrTypeDomain:
+		if len(b) < 5 || len(b) < 5+int(b[4])+2 {
+			return nil, "", ErrSocks5UDPASSOCIATEDataUnmarshalFailure
+		}
 		al := int(b[4])
 		ab := b[5 : 5+al+2]
-		addr = fmt.Sprintf("%s:%d", string(ab[:al]), binary.BigEndian.Uint16(ab[al:al+2]))
+		addr = net.JoinHostPort(string(ab[:al]), strconv.Itoa(int(binary.BigEndian.Uint16(ab[al:al+2]))))
 		return b[5+al+2:], addr, nil
 	case socks5AddrTypeIPv6:
+		if len(b) < 4+16+2 {
+			return nil, "", ErrSocks5UDPASSOCIATEDataUnmarshalFailure
+		}
 		ab := b[4 : 4+16+2]
-		addr = fmt.Sprintf("[%s]:%d", string(ab[:16]), binary.BigEndian.Uint16(ab[16:16+2]))
+		addr = net.JoinHostPort(net.IP(ab[:16]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(ab[16:16+2]))))
 		return b[4+16+2:], addr, nil
 	default:
 		return nil, "", ErrSocks5UDPASSOCIATEDataUnmarshalFailure
 	}
 }
 func unmarshalSocks5UDPASSOCIATEData2(b []byte) (data []byte, addr *net.UDPAddr, err error) {
-	if b[0] != 0x00 || b[1] != 0x00 || b[2] != 0x00 {
+	data, xaddr, err := unmarshalSocks5UDPASSOCIATEData3(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch a := xaddr.(type) {
+	case *net.UDPAddr:
+		return data, a, nil
+	case *DomainAddr:
+		ipAddr, err := net.ResolveIPAddr("", a.Host)
+		if err != nil {
+			return nil, nil, err
+		}
+		addr = &net.UDPAddr{
+			IP:   ipAddr.IP,
+			Port: a.Port,
+			Zone: "",
+		}
+		return data, addr, nil
+	default:
+		return nil, nil, ErrSocks5UDPASSOCIATEDataUnmarshalFailure
+	}
+}
+func unmarshalSocks5UDPASSOCIATEData3(b []byte) (data []byte, addr net.Addr, err error) {
+	if len(b) < 4 || b[0] != 0x00 || b[1] != 0x00 || b[2] != 0x00 {
 		return nil, nil, ErrSocks5UDPASSOCIATEDataUnmarshalFailure
 	}
 	switch b[3] {
 	case socks5AddrTypeIPv4:
+		if len(b) < 4+4+2 {
+			return nil, nil, ErrSocks5UDPASSOCIATEDataUnmarshalFailure
+		}
 		ab := b[4 : 4+4+2]
 		ip := make([]byte, 4)
 		copy(ip, ab[:4])
@@ -75,19 +108,24 @@ func unmarshalSocks5UDPASSOCIATEData2(b []byte) (data []byte, addr *net.UDPAddr,
 		}
 		return b[4+4+2:], addr, nil
 	case socks5AddrTypeDomain:
+		if len(b) < 5 || len(b) < 5+int(b[4])+2 {
+			return nil, nil, ErrSocks5UDPASSOCIATEDataUnmarshalFailure
+		}
 		al := int(b[4])
-		ab := b[5 : 5+al+2]
-		ipAddr, err := net.ResolveIPAddr("", string(ab[:al]))
-		if err != nil {
-			return nil, nil, err
+		if al == 0 {
+			return nil, nil, ErrSocks5UDPASSOCIATEDataUnmarshalFailure
 		}
-		addr = &net.UDPAddr{
-			IP:   ipAddr.IP,
+		ab := b[5 : 5+al+2]
+		addr = &DomainAddr{
+			Net:  "udp",
+			Host: string(ab[:al]),
 			Port: int(binary.BigEndian.Uint16(ab[al : al+2])),
-			Zone: "",
 		}
 		return b[5+al+2:], addr, nil
 	case socks5AddrTypeIPv6:
+		if len(b) < 4+16+2 {
+			return nil, nil, ErrSocks5UDPASSOCIATEDataUnmarshalFailure
+		}
 		ab := b[4 : 4+16+2]
 		ip := make([]byte, 16)
 		copy(ip, ab[:16])
@@ -133,22 +171,160 @@ func getSocks5AddrBytes(addr net.Addr) []byte {
 	if addr == nil {
 		return nil
 	}
+	// the address may be shared, it is not normalized in place
+	var ip net.IP
+	var port int
 	switch a := addr.(type) {
 	case *net.TCPAddr:
-		taddr := a
-		if taddr.IP.To4() != nil {
-			taddr.IP = taddr.IP.To4()
-		}
-		return binary.BigEndian.AppendUint16(taddr.IP, uint16(taddr.Port))
+		ip, port = a.IP, a.Port
 	case *net.UDPAddr:
-		uaddr := a
-		if uaddr.IP.To4() != nil {
-			uaddr.IP = uaddr.IP.To4()
+		ip, port = a.IP, a.Port
+	default:
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), uint16(port))
+}
+
+// getSocks5AddrTypeBytes returns ATYP followed by DST.ADDR and DST.PORT, unknown addresses fall back to 0.0.0.0:0
+func getSocks5AddrTypeBytes(addr net.Addr) []byte {
+	switch addr.(type) {
+	case nil, *net.TCPAddr, *net.UDPAddr, *DomainAddr:
+	default:
+		if xaddr, err := parseUDPAddr(addr.String()); err == nil {
+			addr = xaddr
+		}
+	}
+	if da, ok := addr.(*DomainAddr); ok {
+		if ip := net.ParseIP(da.Host); ip != nil {
+			addr = &net.UDPAddr{IP: ip, Port: da.Port}
+		} else if len(da.Host) != 0 && len(da.Host) <= 255 {
+			bs := append([]byte{socks5AddrTypeDomain, byte(len(da.Host))}, da.Host...)
+			return binary.BigEndian.AppendUint16(bs, uint16(da.Port))
+		}
+	}
+	ab := getSocks5AddrBytes(addr)
+	switch len(ab) {
+	case 4 + 2:
+		return append([]byte{socks5AddrTypeIPv4}, ab...)
+	case 16 + 2:
+		return append([]byte{socks5AddrTypeIPv6}, ab...)
+	default:
+		return []byte{socks5AddrTypeIPv4, 0, 0, 0, 0, 0, 0}
+	}
+}
+
+// readSocks5Addr reads DST.ADDR and DST.PORT of type atyp as host:port
+func readSocks5Addr(r io.Reader, atyp byte) (string, error) {
+	buf := make([]byte, 256+2)
+	switch atyp {
+	case socks5AddrTypeIPv4:
+		_, err := io.ReadFull(r, buf[:4+2])
+		if err != nil {
+			return "", err
+		}
+		addr := fmt.Sprintf("%s:%d", net.IP(buf[:4]).String(), binary.BigEndian.Uint16(buf[4:4+2]))
+		return addr, nil
+	case socks5AddrTypeDomain:
+		_, err := io.ReadFull(r, buf[:1])
+		if err != nil {
+			return "", err
+		}
+		addrL := int(buf[0])
+		if addrL == 0 {
+			return "", ErrSocksMessageParsingFailure
+		}
+		_, err = io.ReadFull(r, buf[:addrL+2])
+		if err != nil {
+			return "", err
+		}
+		addr := net.JoinHostPort(string(buf[:addrL]), strconv.Itoa(int(binary.BigEndian.Uint16(buf[addrL:addrL+2]))))
+		return addr, nil
+	case socks5AddrTypeIPv6:
+		_, err := io.ReadFull(r, buf[:16+2])
+		if err != nil {
+			return "", err
 		}
-		return binary.BigEndian.AppendUint16(uaddr.IP, uint16(uaddr.Port))
+		addr := fmt.Sprintf("[%s]:%d", net.IP(buf[:16]).String(), binary.BigEndian.Uint16(buf[16:16+2]))
+		return addr, nil
 	default:
+		return "", ErrSocksMessageParsingFailure
+	}
+}
+
+// readSocks5TypedAddr reads ATYP followed by DST.ADDR and DST.PORT as host:port
+func readSocks5TypedAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, socks5ATYPLen)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return "", err
+	}
+	return readSocks5Addr(r, atyp[0])
+}
+
+// parseUDPAddr parses host:port without resolving, a host that is not an ip literal becomes a *DomainAddr
+func parseUDPAddr(addr string) (net.Addr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrAddrInvalid(addr, "port invalid")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: int(p)}, nil
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, ErrAddrInvalid(addr, "host invalid")
+	}
+	return &DomainAddr{Net: "udp", Host: host, Port: int(p)}, nil
+}
+
+func getAddrIP(addr net.Addr) net.IP {
+	if addr == nil {
 		return nil
 	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func getAddrPort(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+type tcpDataConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func newTCPDataConn(conn net.Conn, h TCPDataHandler) net.Conn {
+	return &tcpDataConn{
+		Conn: conn,
+		r:    h.Decode(conn),
+		w:    h.Encode(conn),
+	}
+}
+
+func (tdc *tcpDataConn) Read(b []byte) (n int, err error) {
+	return tdc.r.Read(b)
+}
+
+func (tdc *tcpDataConn) Write(b []byte) (n int, err error) {
+	return tdc.w.Write(b)
 }
 
 func waitFunc(ctx context.Context, fn func()) {
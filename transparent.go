@@ -0,0 +1,342 @@
+package socks
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a transparent proxy gets traffic that iptables REDIRECT or TPROXY sent to it, the clients
+// do not speak socks. a connection is relayed like a socks CONNECT to its original destination,
+// the datagrams of a source to one original destination make a UDP ASSOCIATE session
+
+const transparentQueueLen = 64
+
+// ServeTransparent relays the connections of ln to their original destination through the
+// CMDCONNECTHandler and the Ruleset, the sessions have Proto "transparent".
+// for TPROXY, ln comes from ListenTransparent
+func (s *Server) ServeTransparent(ln net.Listener) error {
+	return s.serve(ln, func(ctx context.Context, conn net.Conn) {
+		s.handleTransparent(ctx, conn, ln.Addr())
+	})
+}
+
+func (s *Server) handleTransparent(ctx context.Context, conn net.Conn, laddr net.Addr) {
+	sess := newSession("transparent", conn, s.cfg.Ruleset, s.cfg.SessionHook)
+	sc := &serverConn{
+		Conn:      &countConn{Conn: conn, sess: sess},
+		sess:      sess,
+		ctx:       ctx,
+		halfClose: s.cfg.HalfCloseHandshake,
+	}
+	var err error
+	defer func() {
+		_ = sc.Close()
+		sess.end(err)
+	}()
+	if !s.cfg.VersionSwitch.SwitchTransparent || !s.cfg.CMDConfig.SwitchCMDCONNECT {
+		err = ErrSocksVersionNotSupport
+		return
+	}
+	dst, err := s.transparentDst(conn)
+	if err != nil {
+		return
+	}
+	// a connection made to the listener itself was not redirected
+	if isTransparentLoop(dst, laddr) {
+		err = ErrTransparentLoop
+		return
+	}
+	err = sess.allow(ctx, "CONNECT", dst.String())
+	if err != nil {
+		return
+	}
+	wctx, stop := sc.watchClient()
+	sc.copyConn, err = s.connect(wctx, sess, dst.String())
+	stop()
+	if err != nil {
+		return
+	}
+	sess.open()
+	err = s.relay(sc)
+}
+
+// isTransparentLoop tells if dst is the listener at laddr, so the traffic was not redirected
+func isTransparentLoop(dst net.Addr, laddr net.Addr) bool {
+	if getAddrPort(dst) != getAddrPort(laddr) {
+		return false
+	}
+	ip := getAddrIP(laddr)
+	return ip == nil || ip.IsUnspecified() || ip.Equal(getAddrIP(dst))
+}
+
+func (s *Server) transparentDst(conn net.Conn) (net.Addr, error) {
+	if s.cfg.TransparentDst != nil {
+		return s.cfg.TransparentDst(conn)
+	}
+	return getOriginalDst(conn)
+}
+
+// ServeTransparentUDP relays the datagrams TPROXY delivers to conn, which comes from ListenTransparentUDP.
+// a source and original destination pair is a session of the CMDCMDUDPASSOCIATEHandler and the Ruleset,
+// it ends after UdpTimeout without traffic. replies are sent from the address they answer for, which needs CAP_NET_ADMIN
+func (s *Server) ServeTransparentUDP(conn *net.UDPConn) error {
+	s.mux.Lock()
+	if s.lnCtx.Err() != nil {
+		s.mux.Unlock()
+		return s.lnCtx.Err()
+	}
+	s.wg.Add(1)
+	s.mux.Unlock()
+	defer s.wg.Done()
+	err := setRecvOrigDst(conn)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(s.lnCtx)
+	defer cancel()
+	waitFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	tu := newTransparentUDP(s, listenTransparentReply)
+	buf := make([]byte, defaultUdpBufferSize)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, src, err := conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			return err
+		}
+		dst, err := getOrigDstOOB(oob[:oobn])
+		if err != nil || isTransparentLoop(dst, conn.LocalAddr()) {
+			continue
+		}
+		tu.dispatch(src, dst, buf[:n])
+	}
+}
+
+type transparentUDP struct {
+	s     *Server
+	reply func(laddr *net.UDPAddr) (net.PacketConn, error)
+	mux   sync.Mutex
+	flows map[string]*transparentFlow
+}
+
+func newTransparentUDP(s *Server, reply func(laddr *net.UDPAddr) (net.PacketConn, error)) *transparentUDP {
+	return &transparentUDP{
+		s:     s,
+		reply: reply,
+		flows: make(map[string]*transparentFlow),
+	}
+}
+
+// dispatch hands a datagram to the flow of src and dst, starting one if needed
+func (tu *transparentUDP) dispatch(src *net.UDPAddr, dst *net.UDPAddr, b []byte) {
+	key := src.String() + "-" + dst.String()
+	tu.mux.Lock()
+	f, ok := tu.flows[key]
+	if !ok {
+		if !tu.s.track() {
+			tu.mux.Unlock()
+			return
+		}
+		f = newTransparentFlow(tu, src, dst)
+		tu.flows[key] = f
+		go func() {
+			defer tu.s.wg.Done()
+			tu.s.serveTransparentFlow(f)
+			tu.mux.Lock()
+			if tu.flows[key] == f {
+				delete(tu.flows, key)
+			}
+			tu.mux.Unlock()
+		}()
+	}
+	tu.mux.Unlock()
+	f.push(b)
+}
+
+func (s *Server) serveTransparentFlow(f *transparentFlow) {
+	var err error
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer func() {
+		cancel()
+		_ = f.Close()
+		f.sess.end(err)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = f.Close()
+		case <-f.die:
+		}
+	}()
+	if !s.cfg.VersionSwitch.SwitchTransparent || !s.cfg.CMDConfig.SwitchCMDUDPASSOCIATE {
+		err = ErrSocks5CMDNotSupport
+	} else {
+		err = f.sess.allow(ctx, "UDPASSOCIATE", f.dst.String())
+	}
+	var pconn net.PacketConn
+	if err == nil {
+		// the handler takes the flow for the client socket and reads it like socks5 datagrams
+		ctx := context.WithValue(s.udpContext(ctx, f.sess), udpPacketConnKey, net.PacketConn(f))
+		pconn, err = s.getUDPASSOCIATEHandler()(ctx, nil)
+	}
+	if err != nil {
+		// a rejected flow is reported now and drops its datagrams until it is idle
+		f.sess.end(err)
+		buf := make([]byte, 1)
+		for {
+			_, _, rerr := f.ReadFrom(buf)
+			if rerr != nil {
+				return
+			}
+		}
+	}
+	defer pconn.Close()
+	f.sess.open()
+	buf := make([]byte, defaultUdpBufferSize)
+	for {
+		n, addr, rerr := pconn.ReadFrom(buf)
+		if rerr != nil {
+			return
+		}
+		_, rerr = pconn.WriteTo(buf[:n], addr)
+		if rerr != nil {
+			return
+		}
+	}
+}
+
+// transparentFlow is the client side of a transparent udp session, it hands the datagrams of src
+// to the handler with dst in a socks5 header and sends the replies to src from their source
+type transparentFlow struct {
+	tu      *transparentUDP
+	src     *net.UDPAddr
+	dst     *net.UDPAddr
+	sess    *session
+	in      chan []byte
+	die     chan struct{}
+	once    sync.Once
+	timeout time.Duration
+	last    atomic.Int64
+
+	rmux    sync.Mutex
+	replies map[string]net.PacketConn
+}
+
+func newTransparentFlow(tu *transparentUDP, src *net.UDPAddr, dst *net.UDPAddr) *transparentFlow {
+	f := &transparentFlow{
+		tu:      tu,
+		src:     src,
+		dst:     dst,
+		sess:    newSession("transparent", nil, tu.s.cfg.Ruleset, tu.s.cfg.SessionHook),
+		in:      make(chan []byte, transparentQueueLen),
+		die:     make(chan struct{}),
+		timeout: tu.s.cfg.UdpTimeout,
+		replies: make(map[string]net.PacketConn),
+	}
+	f.sess.info.LocalAddr = dst
+	f.sess.info.RemoteAddr = src
+	f.last.Store(time.Now().UnixNano())
+	return f
+}
+
+func (f *transparentFlow) push(b []byte) {
+	select {
+	case f.in <- marshalSocks5UDPASSOCIATEData(b, f.dst):
+		f.sess.in.Add(uint64(len(b)))
+		f.last.Store(time.Now().UnixNano())
+	default:
+		// full, dropped like a busy socket would
+	}
+}
+
+func (f *transparentFlow) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		idle := time.Duration(time.Now().UnixNano() - f.last.Load())
+		if idle >= f.timeout {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		tr := time.NewTimer(f.timeout - idle)
+		select {
+		case b := <-f.in:
+			tr.Stop()
+			return copy(p, b), f.src, nil
+		case <-f.die:
+			tr.Stop()
+			return 0, nil, net.ErrClosed
+		case <-tr.C:
+		}
+	}
+}
+
+func (f *transparentFlow) WriteTo(p []byte, _ net.Addr) (int, error) {
+	data, from, err := unmarshalSocks5UDPASSOCIATEData2(p)
+	if err != nil {
+		// not ours to answer, drop it
+		return len(p), nil
+	}
+	rc, err := f.replyConn(from)
+	if err != nil {
+		return len(p), nil
+	}
+	_, err = rc.WriteTo(data, f.src)
+	if err != nil {
+		return 0, err
+	}
+	f.sess.out.Add(uint64(len(data)))
+	f.last.Store(time.Now().UnixNano())
+	return len(p), nil
+}
+
+// replyConn returns the socket that sends the replies of from
+func (f *transparentFlow) replyConn(from *net.UDPAddr) (net.PacketConn, error) {
+	f.rmux.Lock()
+	defer f.rmux.Unlock()
+	select {
+	case <-f.die:
+		return nil, net.ErrClosed
+	default:
+	}
+	key := from.String()
+	if rc, ok := f.replies[key]; ok {
+		return rc, nil
+	}
+	rc, err := f.tu.reply(from)
+	if err != nil {
+		return nil, err
+	}
+	f.replies[key] = rc
+	return rc, nil
+}
+
+func (f *transparentFlow) Close() error {
+	f.once.Do(func() {
+		close(f.die)
+		f.rmux.Lock()
+		defer f.rmux.Unlock()
+		for _, rc := range f.replies {
+			_ = rc.Close()
+		}
+	})
+	return nil
+}
+
+func (f *transparentFlow) LocalAddr() net.Addr {
+	return f.dst
+}
+
+func (f *transparentFlow) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (f *transparentFlow) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (f *transparentFlow) SetWriteDeadline(t time.Time) error {
+	return nil
+}
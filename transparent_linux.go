@@ -0,0 +1,180 @@
+//go:build linux
+
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst        = 80 //SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST at SOL_IPV6
+	ipv6Transparent      = 75 //IPV6_TRANSPARENT
+	ipv6RecvOrigDstAddr  = 74 //IPV6_RECVORIGDSTADDR
+	sockaddrPortOffset   = 2
+	sockaddrInet4Offset  = 4
+	sockaddrInet6Offset  = 8
+	sockaddrInet6AddrLen = 16
+)
+
+// ListenTransparent listens with IP_TRANSPARENT for iptables TPROXY, see Server.ServeTransparent.
+// REDIRECT works with any listener
+func ListenTransparent(ctx context.Context, network string, address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	return lc.Listen(ctx, network, address)
+}
+
+// ListenTransparentUDP listens with IP_TRANSPARENT for iptables TPROXY, see Server.ServeTransparentUDP
+func ListenTransparentUDP(ctx context.Context, network string, address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	pconn, err := lc.ListenPacket(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return pconn.(*net.UDPConn), nil
+}
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if isIPv6Network(network) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		} else {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func isIPv6Network(network string) bool {
+	return len(network) > 0 && network[len(network)-1] == '6'
+}
+
+// getOriginalDst asks conntrack where a REDIRECT connection was going,
+// for TPROXY it is the local address
+func getOriginalDst(conn net.Conn) (net.Addr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, ErrTransparentNoOrigDst
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := tc.LocalAddr().(*net.TCPAddr)
+	var dst *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() == nil {
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+			if err != nil {
+				serr = err
+				return
+			}
+			// the sockaddr_in6 is raw memory, its port in network order
+			b := (*[unsafe.Sizeof(info.Addr)]byte)(unsafe.Pointer(&info.Addr))[:]
+			dst = &net.TCPAddr{
+				IP:   net.IP(append([]byte{}, b[sockaddrInet6Offset:sockaddrInet6Offset+sockaddrInet6AddrLen]...)),
+				Port: int(binary.BigEndian.Uint16(b[sockaddrPortOffset:])),
+			}
+			return
+		}
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			serr = err
+			return
+		}
+		b := mreq.Multiaddr[:]
+		dst = &net.TCPAddr{
+			IP:   net.IPv4(b[sockaddrInet4Offset], b[sockaddrInet4Offset+1], b[sockaddrInet4Offset+2], b[sockaddrInet4Offset+3]),
+			Port: int(binary.BigEndian.Uint16(b[sockaddrPortOffset:])),
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if serr != nil {
+		// no conntrack entry, TPROXY keeps the original destination as the local address
+		if local == nil {
+			return nil, serr
+		}
+		return local, nil
+	}
+	return dst, nil
+}
+
+func setRecvOrigDst(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+		if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && local.IP.To4() == nil {
+			// a dual stack socket may get both
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1); err == nil {
+				serr = nil
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// getOrigDstOOB reads the original destination from the control messages of a TPROXY datagram
+func getOrigDstOOB(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		b := msg.Data
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_RECVORIGDSTADDR &&
+			len(b) >= sockaddrInet4Offset+net.IPv4len:
+			return &net.UDPAddr{
+				IP:   net.IPv4(b[sockaddrInet4Offset], b[sockaddrInet4Offset+1], b[sockaddrInet4Offset+2], b[sockaddrInet4Offset+3]),
+				Port: int(binary.BigEndian.Uint16(b[sockaddrPortOffset:])),
+			}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr &&
+			len(b) >= sockaddrInet6Offset+sockaddrInet6AddrLen:
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte{}, b[sockaddrInet6Offset:sockaddrInet6Offset+sockaddrInet6AddrLen]...)),
+				Port: int(binary.BigEndian.Uint16(b[sockaddrPortOffset:])),
+			}, nil
+		}
+	}
+	return nil, ErrTransparentNoOrigDst
+}
+
+// listenTransparentReply binds a socket to the foreign address laddr to answer from it
+func listenTransparentReply(laddr *net.UDPAddr) (net.PacketConn, error) {
+	network := "udp4"
+	if laddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		err := transparentControl(network, address, c)
+		if err != nil {
+			return err
+		}
+		var serr error
+		err = c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	return lc.ListenPacket(context.Background(), network, laddr.String())
+}
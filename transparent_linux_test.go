@@ -0,0 +1,47 @@
+//go:build linux
+
+package socks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransparentOrigDstOOB(t *testing.T) {
+	// without TPROXY the original destination is the address the datagram was sent to
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = setRecvOrigDst(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf, oob := make([]byte, 64), make([]byte, 128)
+	_, oobn, _, src, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := getOrigDstOOB(oob[:oobn])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.String() != conn.LocalAddr().String() || src.String() != client.LocalAddr().String() {
+		t.Fatalf("unexpected original destination %v from %v", dst, src)
+	}
+	if !isTransparentLoop(dst, conn.LocalAddr()) {
+		t.Fatal("loop not detected")
+	}
+}
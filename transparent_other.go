@@ -0,0 +1,34 @@
+//go:build !linux
+
+package socks
+
+import (
+	"context"
+	"net"
+)
+
+// ListenTransparent needs linux, ServeTransparent still works with ServerConfig.TransparentDst
+func ListenTransparent(ctx context.Context, network string, address string) (net.Listener, error) {
+	return nil, ErrTransparentNotSupport
+}
+
+// ListenTransparentUDP needs linux
+func ListenTransparentUDP(ctx context.Context, network string, address string) (*net.UDPConn, error) {
+	return nil, ErrTransparentNotSupport
+}
+
+func getOriginalDst(conn net.Conn) (net.Addr, error) {
+	return nil, ErrTransparentNotSupport
+}
+
+func setRecvOrigDst(conn *net.UDPConn) error {
+	return ErrTransparentNotSupport
+}
+
+func getOrigDstOOB(oob []byte) (*net.UDPAddr, error) {
+	return nil, ErrTransparentNotSupport
+}
+
+func listenTransparentReply(laddr *net.UDPAddr) (net.PacketConn, error) {
+	return nil, ErrTransparentNotSupport
+}
@@ -0,0 +1,134 @@
+package socks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTransparentServer(t *testing.T, events chan SessionEvent, dst func(conn net.Conn) (net.Addr, error)) *Server {
+	server, err := NewServer(&ServerConfig{
+		VersionSwitch: VersionSwitch{SwitchTransparent: true},
+		CMDConfig:     DefaultSocksCMDConfig,
+		Ruleset: func(ctx context.Context, info SessionInfo) error {
+			if strings.HasSuffix(info.Target, ":1") {
+				return errors.New("blocked")
+			}
+			return nil
+		},
+		SessionHook: func(event SessionEvent) {
+			if event.Type != SessionClose {
+				events <- event
+			}
+		},
+		TransparentDst: dst,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return server
+}
+
+func TestTransparent(t *testing.T) {
+	ln := testListen(t)
+	defer ln.Close()
+	events := make(chan SessionEvent, 16)
+	// a mock of the original destination, as REDIRECT would leave it
+	server := testTransparentServer(t, events, func(conn net.Conn) (net.Addr, error) {
+		return ln.Addr(), nil
+	})
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.ServeTransparent(listen)
+	}()
+	conn, err := net.Dial(listen.Addr().Network(), listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConn(t, conn, newData(64*1024))
+	_ = conn.Close()
+	ev := testSessionEvent(t, events)
+	if ev.Type != SessionOpen || ev.Info.Proto != "transparent" || ev.Info.Cmd != "CONNECT" || ev.Info.Target != ln.Addr().String() {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	// without a redirect the destination is the listener itself
+	server2 := testTransparentServer(t, events, nil)
+	listen2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server2.ServeTransparent(listen2)
+	}()
+	conn, err = net.Dial(listen2.Addr().Network(), listen2.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionReject || !errors.Is(ev.Err, ErrTransparentLoop) {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+func TestTransparentUDP(t *testing.T) {
+	pConn := testLPConn(t)
+	defer pConn.Close()
+	events := make(chan SessionEvent, 16)
+	server := testTransparentServer(t, events, nil)
+	// replies come from a plain socket, binding the foreign address needs CAP_NET_ADMIN
+	tu := newTransparentUDP(server, func(laddr *net.UDPAddr) (net.PacketConn, error) {
+		return net.ListenPacket("udp", "127.0.0.1:0")
+	})
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	src := client.LocalAddr().(*net.UDPAddr)
+	dst := pConn.LocalAddr().(*net.UDPAddr)
+
+	buf := make([]byte, 4096)
+	for i := 0; i < 2; i++ {
+		data := newData(1024)
+		tu.dispatch(src, dst, []byte(data))
+		_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != data {
+			t.Fatal("test failed")
+		}
+	}
+	// one session for the pair
+	ev := testSessionEvent(t, events)
+	if ev.Type != SessionOpen || ev.Info.Cmd != "UDPASSOCIATE" || ev.Info.Target != dst.String() || ev.Info.RemoteAddr.String() != src.String() {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	tu.dispatch(src, &net.UDPAddr{IP: dst.IP, Port: 1}, []byte("blocked"))
+	ev = testSessionEvent(t, events)
+	if ev.Type != SessionReject {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+	select {
+	case ev = <-events:
+		t.Fatalf("unexpected event: %+v", ev)
+	default:
+	}
+}
@@ -0,0 +1,82 @@
+package socks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// tcpPacketConn carries socks5 udp datagrams on a stream,
+// each one prefixed by its 2-byte big-endian length
+type tcpPacketConn struct {
+	conn net.Conn
+	rmux sync.Mutex
+	wmux sync.Mutex
+	buf  []byte
+}
+
+func newTCPPacketConn(conn net.Conn) *tcpPacketConn {
+	return &tcpPacketConn{
+		conn: conn,
+		buf:  make([]byte, 0xffff),
+	}
+}
+
+func (tpc *tcpPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	tpc.rmux.Lock()
+	defer tpc.rmux.Unlock()
+	var l [2]byte
+	n, err = io.ReadFull(tpc.conn, l[:])
+	if err != nil {
+		if n != 0 {
+			//the stream is out of sync
+			_ = tpc.conn.Close()
+		}
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(tpc.conn, tpc.buf[:size])
+	if err != nil {
+		_ = tpc.conn.Close()
+		return 0, nil, err
+	}
+	return copy(p, tpc.buf[:size]), tpc.conn.RemoteAddr(), nil
+}
+
+func (tpc *tcpPacketConn) WriteTo(p []byte, _ net.Addr) (n int, err error) {
+	if len(p) > 0xffff {
+		return 0, ErrSocks5UDPOverTCPFrameTooLarge
+	}
+	b := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	copy(b[2:], p)
+	tpc.wmux.Lock()
+	defer tpc.wmux.Unlock()
+	_, err = tpc.conn.Write(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (tpc *tcpPacketConn) Close() error {
+	return tpc.conn.Close()
+}
+
+func (tpc *tcpPacketConn) LocalAddr() net.Addr {
+	return tpc.conn.LocalAddr()
+}
+
+func (tpc *tcpPacketConn) SetDeadline(t time.Time) error {
+	return tpc.conn.SetDeadline(t)
+}
+
+func (tpc *tcpPacketConn) SetReadDeadline(t time.Time) error {
+	return tpc.conn.SetReadDeadline(t)
+}
+
+func (tpc *tcpPacketConn) SetWriteDeadline(t time.Time) error {
+	return tpc.conn.SetWriteDeadline(t)
+}